@@ -2,9 +2,7 @@ package main
 
 import (
 	"BootsDB/query_processor"
-	"io"
 	"log"
-	"unicode"
 )
 
 func main() {
@@ -12,41 +10,12 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	for {
-		err := scanner.Next()
-		if err == io.EOF {
-			break // End of file reached
-		}
-		if err != nil {
-			log.Fatal(err) // Handle any other errors
-		}
-
-		current_char := string(scanner.CurrentRune) 
-		switch {
-		case current_char == " ":
-			continue 
-		case unicode.IsDigit(scanner.CurrentRune):  
-			scanner.AddToken(current_char, true)
-		case current_char == "=":
-			scanner.AddToken("=", false) 
-		case current_char == ";":
-			scanner.AddToken(";", false) 
-		case current_char == ",":
-			scanner.AddToken(",", false) 
-		case current_char == "*":
-			scanner.AddToken("*", false) 
-		case current_char == "'":
-			scanner.AddToken("'", false)
-		case current_char == "(":
-			scanner.AddToken("(", false) 
-		case current_char == ")":
-			scanner.AddToken(")", false) 
-		case scanner.IsChar():
-			text := scanner.GetWord()
-			scanner.AddToken(text, false)
-		}
+	if err := scanner.Scan(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := query_processor.NewParser(scanner.Tokens).Parse(); err != nil {
+		log.Fatal(err)
 	}
-
 }
 
 //DONE:
@@ -55,9 +24,13 @@ func main() {
 //Work on writing back to disk DONE
 //Ensure we have correct functionality for when root gets full DONE
 //Ensure tests work DONE
+//Implement splitting algorithm in insert when page gets full DONE
+//Implement LRU Cache or similart to update cache DONE
+//Implement journaling/write ahead logging(WAL) which saves data when db crashes DONE
+//Implement simple query parse DONE
 
 //TODO:
-//Implement simple query parse
+//Implement simple query execution on top of the parsed syntax tree
 //	-Lets implement this so it can read from command line and file
 //	-The reason I am doing this is to create a clean interface between parse/b+ tree since this interface
 //	 may change some parts of the b+ tree
@@ -97,9 +70,6 @@ func main() {
 //Implement logic to create tables(I think these are just seperate b+ trees)
 //Make sure we have critical db architecture set up
 //	-Look at section 2 of the sqlite architecure and make sure we arent missing anything.
-//Implement splitting algorithm in insert when page gets full
 
 //TODO LATER:
-//Implement LRU Cache or similart to update cache
-//Implement journaling/write ahead logging(WAL) which saves data when db crashes
 //data compression for query processing / b+ trees(claude mentioned LZ4, ZSTD, and delta encoding.)
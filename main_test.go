@@ -2,10 +2,9 @@ package main
 
 import (
 	"BootsDB/query_processor"
-	"io"
 	"log"
+	"reflect"
 	"testing"
-	"unicode"
 )
 
 func TestScannerFunctionality(t *testing.T) {
@@ -13,45 +12,15 @@ func TestScannerFunctionality(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	for {
-		err := scanner.Next()
-		if err == io.EOF {
-			break // End of file reached
-		}
-		if err != nil {
-			log.Fatal(err) // Handle any other errors
-		}
-
-		current_char := string(scanner.CurrentRune) 
-		switch {
-		case current_char == " ":
-			continue 
-		case unicode.IsDigit(scanner.CurrentRune):  
-			scanner.AddToken(current_char, true)
-		case current_char == "=":
-			scanner.AddToken("=", false) 
-		case current_char == ";":
-			scanner.AddToken(";", false) 
-		case current_char == ",":
-			scanner.AddToken(",", false) 
-		case current_char == "*":
-			scanner.AddToken("*", false) 
-		case current_char == "'":
-			scanner.AddToken("'", false)
-		case current_char == "(":
-			scanner.AddToken("(", false) 
-		case current_char == ")":
-			scanner.AddToken(")", false) 
-		case scanner.IsChar():
-			text := scanner.GetWord()
-			scanner.AddToken(text, false)
-		}
+	if err := scanner.Scan(); err != nil {
+		log.Fatal(err)
 	}
 
 // Define expected tokens
     expected := []*query_processor.Token{
     // Line 1
-    {Token_type: "Keyword", Val: "insert_into"},
+    {Token_type: "Keyword", Val: "INSERT"},
+    {Token_type: "Keyword", Val: "INTO"},
     {Token_type: "Identifier", Val: "cats"},
     {Token_type: "Operator", Val: "("},
     {Token_type: "Identifier", Val: "cat_names"},
@@ -71,7 +40,8 @@ func TestScannerFunctionality(t *testing.T) {
     {Token_type: "Operator", Val: ")"},
     {Token_type: "Operator", Val: ";"},
     // Line 4
-    {Token_type: "Keyword", Val: "insert_into"},
+    {Token_type: "Keyword", Val: "INSERT"},
+    {Token_type: "Keyword", Val: "INTO"},
     {Token_type: "Identifier", Val: "cats"},
     {Token_type: "Operator", Val: "("},
     {Token_type: "Identifier", Val: "cat_names"},
@@ -113,7 +83,8 @@ func TestScannerFunctionality(t *testing.T) {
     // Line 11
     {Token_type: "Identifier", Val: "id"},
     {Token_type: "Keyword", Val: "integer"},
-    {Token_type: "Keyword", Val: "primary_key"},
+    {Token_type: "Keyword", Val: "PRIMARY"},
+    {Token_type: "Keyword", Val: "KEY"},
     {Token_type: "Operator", Val: ","},
     // Line 12
     {Token_type: "Identifier", Val: "cat_names"},
@@ -147,6 +118,53 @@ func TestScannerFunctionality(t *testing.T) {
     }
 }
 
+func TestParserFunctionality(t *testing.T) {
+	scanner, err := query_processor.NewScanner("queries/query1.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := scanner.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	statements, err := query_processor.NewParser(scanner.Tokens).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := func(values ...any) []query_processor.Expr {
+		var row []query_processor.Expr
+		for _, value := range values {
+			row = append(row, &query_processor.Literal{Value: value})
+		}
+		return row
+	}
+	columns := []string{"cat_names", "age", "weight"}
+	expected := []query_processor.Statement{
+		&query_processor.Insert{Table: "cats", Columns: columns, Rows: [][]query_processor.Expr{
+			values("whiskers", int64(3), int64(4)),
+		}},
+		&query_processor.Insert{Table: "cats", Columns: columns, Rows: [][]query_processor.Expr{
+			values("luna", int64(5), int64(5)),
+			values("milo", int64(2), int64(3)),
+		}},
+		&query_processor.Select{Columns: []query_processor.ResultColumn{{Star: true}}, From: "cats"},
+		&query_processor.CreateTable{Name: "cats", Columns: []query_processor.ColumnDef{
+			{Name: "id", Type: "integer", PrimaryKey: true},
+			{Name: "cat_names", Type: "text"},
+			{Name: "age", Type: "integer"},
+			{Name: "weight", Type: "real"},
+		}},
+	}
+	if len(statements) != len(expected) {
+		t.Fatalf("Expected %d statements, got %d", len(expected), len(statements))
+	}
+	for i, got := range statements {
+		if !reflect.DeepEqual(got, expected[i]) {
+			t.Errorf("Statement %d mismatch:\nExpected: %+v\nGot: %+v", i, expected[i], got)
+		}
+	}
+}
+
 // // runProgram executes the main program with the given inputs and returns its output.
 // func runProgram(t *testing.T, inputs string) string {
 //     cmd := exec.Command("go", "run", "main.go")
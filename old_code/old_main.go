@@ -5,23 +5,29 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type QueryType string
 
 const (
-	INSERT QueryType = "INSERT"
-	SELECT QueryType = "SELECT"
+	INSERT    QueryType = "INSERT"
+	SELECT    QueryType = "SELECT"
+	BEGIN     QueryType = "BEGIN"
+	COMMIT    QueryType = "COMMIT"
+	ROLLBACK  QueryType = "ROLLBACK"
+	SAVEPOINT QueryType = "SAVEPOINT"
+	RELEASE   QueryType = "RELEASE"
 )
 
 func scanQuery(input string) QueryType {
 	cmd := strings.ToUpper(strings.TrimSpace(input))
-	if strings.HasPrefix(cmd, string(INSERT)) {
-		return INSERT
-	}
-	if strings.HasPrefix(cmd, string(SELECT)) {
-		return SELECT
+	for _, query_type := range []QueryType{INSERT, SELECT, BEGIN, COMMIT, ROLLBACK, SAVEPOINT, RELEASE} {
+		if strings.HasPrefix(cmd, string(query_type)) {
+			return query_type
+		}
 	}
 	return ""
 }
@@ -29,28 +35,83 @@ func scanQuery(input string) QueryType {
 func main() {
 	scanner := bufio.NewScanner(os.Stdin)
 
-	storage_engine := storage_manager.InitializeStorage("Boots.db")
-	pager := storage_manager.InitializePager(storage_engine)
-	btree := storage_manager.InitializeBtree(pager)
+	btree, err := storage_manager.Open("Boots.db")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	btree.SetBusyTimeout(5 * time.Second)
+	var transaction *storage_manager.Transaction
 	for {
 		fmt.Print("BootsDB> ")
 		scanner.Scan()
 		input := scanner.Text()
 
 		if input == ".exit" {
-			pager.FlushCache()
+			if err := btree.Close(); err != nil {
+				fmt.Println(err)
+			}
 			break
 		}
 
 		switch scanQuery(input) {
 		case INSERT:
 			parts := strings.Fields(input)
-			username := parts[1]
-			email := parts[2]
-			btree.Insert(username, email)
+			key, err := strconv.ParseUint(parts[1], 10, 32)
+			if err != nil {
+				fmt.Println("Invalid key:", parts[1])
+				continue
+			}
+			username := parts[2]
+			email := parts[3]
+			if err := btree.Insert(uint32(key), []any{username, email}); err != nil {
+				fmt.Println(err)
+			}
 
 		case SELECT:
-			btree.Select()
+			if err := btree.Select(); err != nil {
+				fmt.Println(err)
+			}
+
+		case BEGIN:
+			if transaction, err = btree.Begin(); err != nil {
+				fmt.Println(err)
+			}
+
+		case COMMIT, ROLLBACK, SAVEPOINT, RELEASE:
+			if transaction == nil {
+				fmt.Println("No transaction is active")
+				continue
+			}
+			// SAVEPOINT name, RELEASE name and ROLLBACK TO name keep the transaction open
+			parts := strings.Fields(input)
+			if len(parts) == 2 || (len(parts) == 3 && strings.EqualFold(parts[1], "TO")) {
+				name := parts[len(parts)-1]
+				switch scanQuery(input) {
+				case SAVEPOINT:
+					err = transaction.Savepoint(name)
+				case RELEASE:
+					err = transaction.Release(name)
+				case ROLLBACK:
+					err = transaction.RollbackTo(name)
+				default:
+					err = fmt.Errorf("unexpected %s", name)
+				}
+				if err != nil {
+					fmt.Println(err)
+				}
+				continue
+			}
+			if scanQuery(input) == COMMIT {
+				err = transaction.Commit()
+			} else {
+				err = transaction.Rollback()
+			}
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			transaction = nil
 
 		default:
 			fmt.Println("Unknown command")
@@ -0,0 +1,201 @@
+/*
+Syntax Tree:
+
+The parser turns each SQL statement into one of the statement nodes below.
+Names are kept as they were written, without quotes, and keywords that pick
+between a few choices, like a column's type, are lower case.
+
+	CreateTable: CREATE TABLE [IF NOT EXISTS] name (column, ...)
+	CreateIndex: CREATE [UNIQUE] INDEX [IF NOT EXISTS] name ON table (column, ...)
+	Insert: INSERT INTO table [(column, ...)] VALUES (value, ...), ...
+	Select: SELECT [DISTINCT] result, ... [FROM table] [WHERE condition]
+	Update: UPDATE table SET column = value, ... [WHERE condition]
+	Delete: DELETE FROM table [WHERE condition]
+	Drop: DROP TABLE|INDEX [IF EXISTS] name
+	Begin, Commit, Rollback: BEGIN, COMMIT and ROLLBACK [TO savepoint], each
+	    optionally followed by TRANSACTION
+	Savepoint, Release: SAVEPOINT name and RELEASE [SAVEPOINT] name
+
+Values, results and conditions are expressions, trees an executor can
+evaluate once for each row (the grammar is in expression.go):
+
+	Literal: a value already converted, int64 for integers, float64 for
+	    floats, string for strings and nil for NULL
+	ColumnRef: column or table.column
+	UnaryExpr: -x, +x and NOT x
+	BinaryExpr: arithmetic, ||, comparisons, AND and OR
+	IsNull: x IS [NOT] NULL
+	InList: x [NOT] IN (y, ...)
+	Between: x [NOT] BETWEEN low AND high
+	Like: x [NOT] LIKE pattern
+	FunctionCall: name(x, ...), name(DISTINCT x, ...) or name(*)
+*/
+package query_processor
+
+type Statement interface {
+	statement_node()
+}
+
+type Expr interface {
+	expression_node()
+}
+
+type ColumnDef struct {
+	Name       string
+	Type       string // "integer", "text", "real", "blob" or "" when none is given
+	PrimaryKey bool
+	NotNull    bool
+	Unique     bool
+	Default    Expr // nil when the column has no default
+}
+
+type CreateTable struct {
+	Name        string
+	IfNotExists bool
+	Columns     []ColumnDef
+}
+
+type CreateIndex struct {
+	Name        string
+	Table       string
+	Columns     []string
+	Unique      bool
+	IfNotExists bool
+}
+
+type Insert struct {
+	Table   string
+	Columns []string // nil when the statement doesn't name them
+	Rows    [][]Expr // One list of values per row, all the same length
+}
+
+// ResultColumn is one item of a SELECT list, either * or an expression
+type ResultColumn struct {
+	Star  bool
+	Expr  Expr
+	Alias string
+}
+
+type Select struct {
+	Distinct bool
+	Columns  []ResultColumn
+	From     string // "" for a SELECT without FROM
+	Where    Expr   // nil when every row is selected
+}
+
+type Assignment struct {
+	Column string
+	Value  Expr
+}
+
+type Update struct {
+	Table string
+	Set   []Assignment
+	Where Expr
+}
+
+type Delete struct {
+	Table string
+	Where Expr
+}
+
+type Drop struct {
+	Kind     string // "table" or "index"
+	Name     string
+	IfExists bool
+}
+
+type Begin struct{}
+
+type Commit struct{}
+
+type Rollback struct {
+	Savepoint string // "" rolls back the whole transaction
+}
+
+type Savepoint struct {
+	Name string
+}
+
+type Release struct {
+	Name string
+}
+
+type Literal struct {
+	Value any
+}
+
+type ColumnRef struct {
+	Table  string // "" when the column isn't qualified
+	Column string
+}
+
+type UnaryExpr struct {
+	Op      string // "-", "+" or "not"
+	Operand Expr
+}
+
+// BinaryExpr applies an operator to two operands. Op is the operator as
+// written, except that "==" is "=", "!=" is "<>" and AND and OR are "and" and
+// "or"
+type BinaryExpr struct {
+	Op    string
+	Left  Expr
+	Right Expr
+}
+
+type IsNull struct {
+	Expr Expr
+	Not  bool // IS NOT NULL
+}
+
+type InList struct {
+	Expr Expr
+	List []Expr // Empty for IN (), which is always false
+	Not  bool
+}
+
+type Between struct {
+	Expr Expr
+	Low  Expr
+	High Expr
+	Not  bool
+}
+
+type Like struct {
+	Expr    Expr
+	Pattern Expr
+	Not     bool
+}
+
+// FunctionCall calls a function by name, like count or upper. Star is set
+// for count(*), which has no Args
+type FunctionCall struct {
+	Name     string
+	Args     []Expr // Empty, not nil, for name()
+	Distinct bool
+	Star     bool
+}
+
+func (*CreateTable) statement_node() {}
+func (*CreateIndex) statement_node() {}
+func (*Insert) statement_node()      {}
+func (*Select) statement_node()      {}
+func (*Update) statement_node()      {}
+func (*Delete) statement_node()      {}
+func (*Drop) statement_node()        {}
+func (*Begin) statement_node()       {}
+func (*Commit) statement_node()      {}
+func (*Rollback) statement_node()    {}
+func (*Savepoint) statement_node()   {}
+func (*Release) statement_node()     {}
+
+func (*Literal) expression_node()      {}
+func (*ColumnRef) expression_node()    {}
+func (*BinaryExpr) expression_node()   {}
+func (*UnaryExpr) expression_node()    {}
+func (*IsNull) expression_node()       {}
+func (*InList) expression_node()       {}
+func (*Between) expression_node()      {}
+func (*Like) expression_node()         {}
+func (*FunctionCall) expression_node() {}
@@ -0,0 +1,313 @@
+/*
+Expressions:
+
+Expressions are parsed by precedence climbing, one function per level, from
+the loosest binding operators to the tightest:
+
+	OR
+	AND
+	NOT x
+	= == <> !=, IS [NOT] NULL, [NOT] IN (...), [NOT] BETWEEN x AND y, [NOT] LIKE
+	< <= > >=
+	+ -
+	* / %
+	||
+	-x +x
+	literals, NULL, columns, table.column, function(...), (x)
+
+Binary operators at the same level group to the left, so 1 - 2 - 3 is
+(1 - 2) - 3, the same precedence SQLite uses. A minus sign directly before a
+number makes a negative literal, so -9223372036854775808 is still an integer.
+The bounds of BETWEEN bind tighter than its AND, so a BETWEEN 1 AND 2 AND b
+is (a BETWEEN 1 AND 2) AND b.
+*/
+package query_processor
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+func (p *Parser) parse_expression() (Expr, error) {
+	return p.parse_or()
+}
+
+// parse_binary parses operands of next joined by the operators of one level,
+// which may be operators or keywords
+func (p *Parser) parse_binary(next func() (Expr, error), operators ...string) (Expr, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token := p.peek()
+		if token == nil || !(token.IsOperator(operators...) || token.IsKeyword(operators...)) {
+			return left, nil
+		}
+		p.advance()
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: binary_op(token), Left: left, Right: right}
+	}
+}
+
+// binary_op names the operator of token, keywords in lower case, "==" as "="
+// and "!=" as "<>"
+func binary_op(token *Token) string {
+	switch {
+	case token.IsKeyword():
+		return strings.ToLower(token.Val)
+	case token.Val == "==":
+		return "="
+	case token.Val == "!=":
+		return "<>"
+	}
+	return token.Val
+}
+
+func (p *Parser) parse_or() (Expr, error) {
+	return p.parse_binary(p.parse_and, "or")
+}
+
+func (p *Parser) parse_and() (Expr, error) {
+	return p.parse_binary(p.parse_not, "and")
+}
+
+func (p *Parser) parse_not() (Expr, error) {
+	if !p.accept_keyword("not") {
+		return p.parse_equality()
+	}
+	operand, err := p.parse_not()
+	if err != nil {
+		return nil, err
+	}
+	return &UnaryExpr{Op: "not", Operand: operand}, nil
+}
+
+// parse_equality parses the equality comparisons and the tests that share
+// their precedence, IS NULL, IN, BETWEEN and LIKE
+func (p *Parser) parse_equality() (Expr, error) {
+	left, err := p.parse_relational()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token := p.peek()
+		switch {
+		case token == nil:
+			return left, nil
+		case token.IsOperator("=", "==", "<>", "!="):
+			p.advance()
+			right, err := p.parse_relational()
+			if err != nil {
+				return nil, err
+			}
+			left = &BinaryExpr{Op: binary_op(token), Left: left, Right: right}
+		case token.IsKeyword("is"):
+			p.advance()
+			not := p.accept_keyword("not")
+			if err := p.expect_keyword("null"); err != nil {
+				return nil, err
+			}
+			left = &IsNull{Expr: left, Not: not}
+		case token.IsKeyword("in", "between", "like"):
+			if left, err = p.parse_test(left, false); err != nil {
+				return nil, err
+			}
+		case token.IsKeyword("not") && p.index+1 < len(p.tokens) && p.tokens[p.index+1].IsKeyword("in", "between", "like"):
+			p.advance()
+			if left, err = p.parse_test(left, true); err != nil {
+				return nil, err
+			}
+		default:
+			return left, nil
+		}
+	}
+}
+
+// parse_test parses the IN, BETWEEN or LIKE test of left that starts at the
+// next token, not is set when it followed NOT
+func (p *Parser) parse_test(left Expr, not bool) (Expr, error) {
+	token := p.advance()
+	switch {
+	case token.IsKeyword("in"):
+		if err := p.expect_operator("("); err != nil {
+			return nil, err
+		}
+		list, err := p.parse_arguments()
+		if err != nil {
+			return nil, err
+		}
+		return &InList{Expr: left, List: list, Not: not}, nil
+	case token.IsKeyword("between"):
+		low, err := p.parse_relational()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect_keyword("and"); err != nil {
+			return nil, err
+		}
+		high, err := p.parse_relational()
+		if err != nil {
+			return nil, err
+		}
+		return &Between{Expr: left, Low: low, High: high, Not: not}, nil
+	default:
+		pattern, err := p.parse_relational()
+		if err != nil {
+			return nil, err
+		}
+		return &Like{Expr: left, Pattern: pattern, Not: not}, nil
+	}
+}
+
+func (p *Parser) parse_relational() (Expr, error) {
+	return p.parse_binary(p.parse_additive, "<", "<=", ">", ">=")
+}
+
+func (p *Parser) parse_additive() (Expr, error) {
+	return p.parse_binary(p.parse_multiplicative, "+", "-")
+}
+
+func (p *Parser) parse_multiplicative() (Expr, error) {
+	return p.parse_binary(p.parse_concat, "*", "/", "%")
+}
+
+func (p *Parser) parse_concat() (Expr, error) {
+	return p.parse_binary(p.parse_unary, "||")
+}
+
+// parse_unary parses a signed operand. A minus sign directly before a number
+// makes a negative literal
+func (p *Parser) parse_unary() (Expr, error) {
+	token := p.peek()
+	if token == nil || !token.IsOperator("-", "+") {
+		return p.parse_primary()
+	}
+	p.advance()
+	if number := p.peek(); token.Val == "-" && number != nil && number.Token_type == "Literal" && number.Literal_type != "string" {
+		p.advance()
+		return literal_value(number, true)
+	}
+	operand, err := p.parse_unary()
+	if err != nil {
+		return nil, err
+	}
+	return &UnaryExpr{Op: token.Val, Operand: operand}, nil
+}
+
+// parse_primary parses a literal, NULL, a column, a function call or a
+// parenthesized expression
+func (p *Parser) parse_primary() (Expr, error) {
+	token := p.peek()
+	switch {
+	case token == nil:
+		return nil, p.unexpected("an expression")
+	case token.Token_type == "Literal":
+		p.advance()
+		return literal_value(token, false)
+	case token.IsKeyword("null"):
+		p.advance()
+		return &Literal{Value: nil}, nil
+	case token.IsName():
+		p.advance()
+		if p.accept_operator("(") {
+			return p.parse_call(token.Val)
+		}
+		if !p.accept_operator(".") {
+			return &ColumnRef{Column: token.Val}, nil
+		}
+		column, err := p.expect_name("column name")
+		if err != nil {
+			return nil, err
+		}
+		return &ColumnRef{Table: token.Val, Column: column}, nil
+	case token.IsOperator("("):
+		p.advance()
+		expr, err := p.parse_expression()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect_operator(")")
+	}
+	return nil, p.unexpected("an expression")
+}
+
+// parse_call parses the arguments of a function call after its "(", which
+// may be *, as in count(*), or start with DISTINCT
+func (p *Parser) parse_call(name string) (Expr, error) {
+	call := &FunctionCall{Name: name}
+	if p.accept_operator("*") {
+		call.Star = true
+		return call, p.expect_operator(")")
+	}
+	if p.accept_keyword("distinct") {
+		call.Distinct = true
+		if token := p.peek(); token != nil && token.IsOperator(")") {
+			return nil, p.unexpected("an expression")
+		}
+	}
+	var err error
+	call.Args, err = p.parse_arguments()
+	if err != nil {
+		return nil, err
+	}
+	return call, nil
+}
+
+// parse_arguments parses a list of expressions, which may be empty, up to
+// and including its ")"
+func (p *Parser) parse_arguments() ([]Expr, error) {
+	list := []Expr{}
+	if p.accept_operator(")") {
+		return list, nil
+	}
+	for {
+		expr, err := p.parse_expression()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, expr)
+		if !p.accept_operator(",") {
+			break
+		}
+	}
+	return list, p.expect_operator(")")
+}
+
+// literal_value converts a literal token to its value. Integers too big for
+// an int64 become floats, like they do in SQLite, and hex integers are the
+// bits of an int64, so 0xFFFFFFFFFFFFFFFF is -1
+func literal_value(token *Token, negative bool) (*Literal, error) {
+	text, sign := token.Val, ""
+	if negative {
+		sign = "-"
+	}
+	switch token.Literal_type {
+	case "string":
+		return &Literal{Value: text}, nil
+	case "number":
+		if len(text) > 2 && (text[1] == 'x' || text[1] == 'X') {
+			bits, err := strconv.ParseUint(text[2:], 16, 64)
+			if err != nil {
+				return nil, syntax_error(token, "hex literal "+text+" is too big")
+			}
+			value := int64(bits)
+			if negative {
+				value = -value
+			}
+			return &Literal{Value: value}, nil
+		}
+		if value, err := strconv.ParseInt(sign+text, 10, 64); err == nil {
+			return &Literal{Value: value}, nil
+		}
+	}
+	value, err := strconv.ParseFloat(sign+text, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return nil, syntax_error(token, "malformed number "+token.Val)
+	}
+	return &Literal{Value: value}, nil
+}
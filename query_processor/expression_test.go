@@ -0,0 +1,244 @@
+package query_processor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// group writes an expression with every operator in parentheses, so the
+// tree's shape shows
+func group(expr Expr) string {
+	not := func(not bool) string {
+		if not {
+			return "not "
+		}
+		return ""
+	}
+	switch expr := expr.(type) {
+	case *Literal:
+		if value, ok := expr.Value.(string); ok {
+			return "'" + value + "'"
+		}
+		if expr.Value == nil {
+			return "null"
+		}
+		return fmt.Sprintf("%v:%T", expr.Value, expr.Value)
+	case *ColumnRef:
+		if expr.Table != "" {
+			return expr.Table + "." + expr.Column
+		}
+		return expr.Column
+	case *UnaryExpr:
+		return "(" + expr.Op + " " + group(expr.Operand) + ")"
+	case *BinaryExpr:
+		return "(" + group(expr.Left) + " " + expr.Op + " " + group(expr.Right) + ")"
+	case *IsNull:
+		return "(" + group(expr.Expr) + " is " + not(expr.Not) + "null)"
+	case *InList:
+		var list []string
+		for _, item := range expr.List {
+			list = append(list, group(item))
+		}
+		return "(" + group(expr.Expr) + " " + not(expr.Not) + "in [" + strings.Join(list, ", ") + "])"
+	case *Between:
+		return "(" + group(expr.Expr) + " " + not(expr.Not) + "between " + group(expr.Low) + " and " + group(expr.High) + ")"
+	case *Like:
+		return "(" + group(expr.Expr) + " " + not(expr.Not) + "like " + group(expr.Pattern) + ")"
+	case *FunctionCall:
+		if expr.Star {
+			return expr.Name + "(*)"
+		}
+		var args []string
+		for _, arg := range expr.Args {
+			args = append(args, group(arg))
+		}
+		distinct := ""
+		if expr.Distinct {
+			distinct = "distinct "
+		}
+		return expr.Name + "(" + distinct + strings.Join(args, ", ") + ")"
+	}
+	return fmt.Sprintf("%#v", expr)
+}
+
+// parse_test_expression parses sql as the only column of a SELECT
+func parse_test_expression(t *testing.T, sql string) (Expr, error) {
+	t.Helper()
+	statements, err := ParseString("select " + sql)
+	if err != nil {
+		return nil, err
+	}
+	selected := statements[0].(*Select)
+	if len(selected.Columns) != 1 || selected.Columns[0].Alias != "" {
+		t.Fatalf("Expected %q to be one expression", sql)
+	}
+	return selected.Columns[0].Expr, nil
+}
+
+func check_expressions(t *testing.T, tests [][2]string) {
+	t.Helper()
+	for _, test := range tests {
+		expr, err := parse_test_expression(t, test[0])
+		if err != nil {
+			t.Errorf("%s: %v", test[0], err)
+			continue
+		}
+		if got := group(expr); got != test[1] {
+			t.Errorf("%s:\nexpected %s\ngot      %s", test[0], test[1], got)
+		}
+	}
+}
+
+func TestParseOperands(t *testing.T) {
+	check_expressions(t, [][2]string{
+		{"42", "42:int64"},
+		{"2.5", "2.5:float64"},
+		{"'it''s'", "'it's'"},
+		{"NULL", "null"},
+		{"age", "age"},
+		{"cats.age", "cats.age"},
+		{`"cat names"."cat age"`, "cat names.cat age"},
+		{"(age)", "age"},
+		{"((1))", "1:int64"},
+		{"count(*)", "count(*)"},
+		{"COUNT(distinct cat_names)", "COUNT(distinct cat_names)"},
+		{"random()", "random()"},
+		{"substr(cat_names, 1, age + 1)", "substr(cat_names, 1:int64, (age + 1:int64))"},
+		{"upper(lower(cat_names))", "upper(lower(cat_names))"},
+	})
+}
+
+func TestParseUnaryOperators(t *testing.T) {
+	check_expressions(t, [][2]string{
+		{"-5", "-5:int64"},
+		{"-age", "(- age)"},
+		{"+5", "(+ 5:int64)"},
+		{"- -5", "(- -5:int64)"},
+		{"-(5)", "(- 5:int64)"},
+		{"-'5'", "(- '5')"},
+		{"not 1", "(not 1:int64)"},
+		{"NOT NOT a", "(not (not a))"},
+		{"-2 * 3", "(-2:int64 * 3:int64)"},
+		{"-a * b", "((- a) * b)"},
+		{"2 -1", "(2:int64 - 1:int64)"},
+		{"not a = b", "(not (a = b))"},
+		{"not a and b", "((not a) and b)"},
+	})
+}
+
+func TestParsePrecedence(t *testing.T) {
+	check_expressions(t, [][2]string{
+		{"1 + 2 * 3", "(1:int64 + (2:int64 * 3:int64))"},
+		{"(1 + 2) * 3", "((1:int64 + 2:int64) * 3:int64)"},
+		{"1 - 2 - 3", "((1:int64 - 2:int64) - 3:int64)"},
+		{"8 / 4 % 3 * 2", "(((8:int64 / 4:int64) % 3:int64) * 2:int64)"},
+		{"a || b * 2", "((a || b) * 2:int64)"},
+		{"a || b || c", "((a || b) || c)"},
+		{"a + 1 < b * 2", "((a + 1:int64) < (b * 2:int64))"},
+		{"a < b = c > d", "((a < b) = (c > d))"},
+		{"a = 1 and b = 2 or c = 3", "(((a = 1:int64) and (b = 2:int64)) or (c = 3:int64))"},
+		{"a = 1 or b = 2 and c = 3", "((a = 1:int64) or ((b = 2:int64) and (c = 3:int64)))"},
+		{"a or b or c", "((a or b) or c)"},
+		{"(a or b) and c", "((a or b) and c)"},
+		{"a == b", "(a = b)"},
+		{"a != b", "(a <> b)"},
+		{"a AND b", "(a and b)"},
+		{"a <= b and a >= c", "((a <= b) and (a >= c))"},
+	})
+}
+
+func TestParseTests(t *testing.T) {
+	check_expressions(t, [][2]string{
+		{"a is null", "(a is null)"},
+		{"a IS NOT NULL", "(a is not null)"},
+		{"a + 1 is null", "((a + 1:int64) is null)"},
+		{"not a is null", "(not (a is null))"},
+		{"a in (1, 2, 3)", "(a in [1:int64, 2:int64, 3:int64])"},
+		{"a not in ('x')", "(a not in ['x'])"},
+		{"a in ()", "(a in [])"},
+		{"a in (b + 1, lower(c))", "(a in [(b + 1:int64), lower(c)])"},
+		{"a between 1 and 10", "(a between 1:int64 and 10:int64)"},
+		{"a NOT BETWEEN b - 1 AND b + 1", "(a not between (b - 1:int64) and (b + 1:int64))"},
+		{"a between 1 and 2 and b", "((a between 1:int64 and 2:int64) and b)"},
+		{"a between 1 and 2 or b between 3 and 4", "((a between 1:int64 and 2:int64) or (b between 3:int64 and 4:int64))"},
+		{"cat_names like 'w%'", "(cat_names like 'w%')"},
+		{"cat_names not like 'w' || '%'", "(cat_names not like ('w' || '%'))"},
+		{"a like b = c", "((a like b) = c)"},
+		{"a = 1 and b in (1) or c like 'x'", "(((a = 1:int64) and (b in [1:int64])) or (c like 'x'))"},
+	})
+}
+
+func TestParseExpressionsInStatements(t *testing.T) {
+	check_statements(t, "select cats.cat_names, age * 12 as months from cats where age between 1 and 5 and weight is not null",
+		&Select{
+			Columns: []ResultColumn{
+				{Expr: &ColumnRef{Table: "cats", Column: "cat_names"}},
+				{Expr: &BinaryExpr{Op: "*", Left: column("age"), Right: literal(int64(12))}, Alias: "months"},
+			},
+			From: "cats",
+			Where: &BinaryExpr{
+				Op:    "and",
+				Left:  &Between{Expr: column("age"), Low: literal(int64(1)), High: literal(int64(5))},
+				Right: &IsNull{Expr: column("weight"), Not: true},
+			},
+		})
+	check_statements(t, "update cats set age = age + 1, cat_names = upper(cat_names) where not (age > 10 or cat_names like '%x')",
+		&Update{
+			Table: "cats",
+			Set: []Assignment{
+				{"age", &BinaryExpr{Op: "+", Left: column("age"), Right: literal(int64(1))}},
+				{"cat_names", &FunctionCall{Name: "upper", Args: []Expr{column("cat_names")}}},
+			},
+			Where: &UnaryExpr{Op: "not", Operand: &BinaryExpr{
+				Op:    "or",
+				Left:  &BinaryExpr{Op: ">", Left: column("age"), Right: literal(int64(10))},
+				Right: &Like{Expr: column("cat_names"), Pattern: literal("%x")},
+			}},
+		})
+	check_statements(t, "insert into cats values (1 + 2, -(3), 'a' || 'b')",
+		&Insert{Table: "cats", Rows: [][]Expr{{
+			&BinaryExpr{Op: "+", Left: literal(int64(1)), Right: literal(int64(2))},
+			&UnaryExpr{Op: "-", Operand: literal(int64(3))},
+			&BinaryExpr{Op: "||", Left: literal("a"), Right: literal("b")},
+		}}})
+	check_statements(t, "create table cats (age integer default (1 + 1), weight real default -1.5)",
+		&CreateTable{Name: "cats", Columns: []ColumnDef{
+			{Name: "age", Type: "integer", Default: &BinaryExpr{Op: "+", Left: literal(int64(1)), Right: literal(int64(1))}},
+			{Name: "weight", Type: "real", Default: literal(-1.5)},
+		}})
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	tests := []struct {
+		sql     string
+		message string
+	}{
+		{"(1 + 2", "syntax error: expected \")\", found end of input"},
+		{"1 +", "syntax error: expected an expression, found end of input"},
+		{"1 + * 2", `syntax error: expected an expression, found "*" at line 1, column 12`},
+		{"a is 1", `syntax error: expected NULL, found "1" at line 1, column 13`},
+		{"a in 1", `syntax error: expected "(", found "1" at line 1, column 13`},
+		{"a in (1, )", `syntax error: expected an expression, found ")" at line 1, column 17`},
+		{"a between 1 or 2", `syntax error: expected AND, found "or" at line 1, column 20`},
+		{"a not null", `syntax error: expected ";", found "not" at line 1, column 10`},
+		{"cats.", "syntax error: expected column name, found end of input"},
+		{"cats.*", `syntax error: expected column name, found "*" at line 1, column 13`},
+		{"count(distinct)", `syntax error: expected an expression, found ")" at line 1, column 22`},
+		{"count(*, a)", `syntax error: expected ")", found "," at line 1, column 15`},
+		{"lower(a b)", `syntax error: expected ")", found "b" at line 1, column 16`},
+		{"not", "syntax error: expected an expression, found end of input"},
+		{"(select 1)", `syntax error: expected an expression, found "select" at line 1, column 9`},
+	}
+	for _, test := range tests {
+		_, err := parse_test_expression(t, test.sql)
+		if !errors.Is(err, ErrSyntax) {
+			t.Errorf("%s: expected ErrSyntax, got %v", test.sql, err)
+			continue
+		}
+		if err.Error() != test.message {
+			t.Errorf("%s:\nexpected %s\ngot      %s", test.sql, test.message, err)
+		}
+	}
+}
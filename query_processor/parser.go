@@ -0,0 +1,512 @@
+/*
+Parser:
+
+A recursive-descent parser over the Scanner's Tokens, one function per rule
+of the grammar in ast.go. Statements are separated by ";", which may be left
+off after the last one, and empty statements are skipped.
+
+The parser stops at the first token that doesn't fit and reports what it
+expected, what it found and where, like
+syntax error: expected table name, found "from" at line 3, column 8
+*/
+package query_processor
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrSyntax = errors.New("syntax error")
+
+type Parser struct {
+	tokens []*Token
+	index  int // Position of the next token to parse
+}
+
+func NewParser(tokens []*Token) *Parser {
+	return &Parser{tokens: tokens}
+}
+
+// ParseString scans and parses SQL held in memory
+func ParseString(sql string) ([]Statement, error) {
+	scanner := NewStringScanner(sql)
+	if err := scanner.Scan(); err != nil {
+		return nil, err
+	}
+	return NewParser(scanner.Tokens).Parse()
+}
+
+// Parse parses every statement in the tokens
+func (p *Parser) Parse() ([]Statement, error) {
+	var statements []Statement
+	for {
+		for p.accept_operator(";") {
+		}
+		if p.peek() == nil {
+			return statements, nil
+		}
+		statement, err := p.parse_statement()
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, statement)
+		if p.peek() != nil && !p.accept_operator(";") {
+			return nil, p.unexpected(`";"`)
+		}
+	}
+}
+
+// peek returns the next token without consuming it, or nil at the end
+func (p *Parser) peek() *Token {
+	if p.index >= len(p.tokens) {
+		return nil
+	}
+	return p.tokens[p.index]
+}
+
+func (p *Parser) advance() *Token {
+	token := p.peek()
+	if token != nil {
+		p.index += 1
+	}
+	return token
+}
+
+// accept_keyword consumes the next token if it's one of the keywords
+func (p *Parser) accept_keyword(words ...string) bool {
+	if token := p.peek(); token != nil && token.IsKeyword(words...) {
+		p.index += 1
+		return true
+	}
+	return false
+}
+
+// accept_operator consumes the next token if it's one of the operators
+func (p *Parser) accept_operator(operators ...string) bool {
+	if token := p.peek(); token != nil && token.IsOperator(operators...) {
+		p.index += 1
+		return true
+	}
+	return false
+}
+
+func (p *Parser) expect_keyword(word string) error {
+	if !p.accept_keyword(word) {
+		return p.unexpected(strings.ToUpper(word))
+	}
+	return nil
+}
+
+func (p *Parser) expect_operator(operator string) error {
+	if !p.accept_operator(operator) {
+		return p.unexpected(strconv.Quote(operator))
+	}
+	return nil
+}
+
+// expect_name consumes a name, what says what it names
+func (p *Parser) expect_name(what string) (string, error) {
+	token := p.peek()
+	if token == nil || !token.IsName() {
+		return "", p.unexpected(what)
+	}
+	p.index += 1
+	return token.Val, nil
+}
+
+// expect_names parses a parenthesized list of names
+func (p *Parser) expect_names(what string) ([]string, error) {
+	if err := p.expect_operator("("); err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		name, err := p.expect_name(what)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.accept_operator(",") {
+			break
+		}
+	}
+	return names, p.expect_operator(")")
+}
+
+// unexpected reports that the next token isn't what the grammar expected
+func (p *Parser) unexpected(expected string) error {
+	token := p.peek()
+	if token == nil {
+		return syntax_error(nil, "expected "+expected+", found end of input")
+	}
+	return syntax_error(token, "expected "+expected+", found "+describe(token))
+}
+
+// syntax_error adds the position of token to message, a nil token is the end
+// of the input
+func syntax_error(token *Token, message string) error {
+	if token == nil {
+		return fmt.Errorf("%w: %s", ErrSyntax, message)
+	}
+	return fmt.Errorf("%w: %s at line %d, column %d", ErrSyntax, message, token.Line, token.Column)
+}
+
+// describe writes a token the way it appeared in the SQL
+func describe(token *Token) string {
+	if token.Token_type == "Literal" && token.Literal_type == "string" {
+		return "'" + strings.ReplaceAll(token.Val, "'", "''") + "'"
+	}
+	return strconv.Quote(token.Val)
+}
+
+func (p *Parser) parse_statement() (Statement, error) {
+	token := p.peek()
+	switch {
+	case token.IsKeyword("create"):
+		return p.parse_create()
+	case token.IsKeyword("insert"):
+		return p.parse_insert()
+	case token.IsKeyword("select"):
+		return p.parse_select()
+	case token.IsKeyword("update"):
+		return p.parse_update()
+	case token.IsKeyword("delete"):
+		return p.parse_delete()
+	case token.IsKeyword("drop"):
+		return p.parse_drop()
+	case token.IsKeyword("begin", "commit", "rollback", "savepoint", "release"):
+		return p.parse_transaction()
+	}
+	return nil, p.unexpected("a statement")
+}
+
+// parse_if_exists parses IF EXISTS, or IF NOT EXISTS when not_exists is set
+func (p *Parser) parse_if_exists(not_exists bool) (bool, error) {
+	if !p.accept_keyword("if") {
+		return false, nil
+	}
+	if not_exists {
+		if err := p.expect_keyword("not"); err != nil {
+			return false, err
+		}
+	}
+	return true, p.expect_keyword("exists")
+}
+
+func (p *Parser) parse_create() (Statement, error) {
+	p.advance()
+	if p.accept_keyword("table") {
+		return p.parse_create_table()
+	}
+	unique := p.accept_keyword("unique")
+	if p.accept_keyword("index") {
+		return p.parse_create_index(unique)
+	}
+	if unique {
+		return nil, p.unexpected("INDEX")
+	}
+	return nil, p.unexpected("TABLE or INDEX")
+}
+
+func (p *Parser) parse_create_table() (*CreateTable, error) {
+	var err error
+	statement := &CreateTable{}
+	if statement.IfNotExists, err = p.parse_if_exists(true); err != nil {
+		return nil, err
+	}
+	if statement.Name, err = p.expect_name("table name"); err != nil {
+		return nil, err
+	}
+	if err := p.expect_operator("("); err != nil {
+		return nil, err
+	}
+	for {
+		column, err := p.parse_column_def()
+		if err != nil {
+			return nil, err
+		}
+		statement.Columns = append(statement.Columns, column)
+		if !p.accept_operator(",") {
+			break
+		}
+	}
+	return statement, p.expect_operator(")")
+}
+
+// parse_column_def parses a column's name, its optional type and any
+// constraints, in any order
+func (p *Parser) parse_column_def() (ColumnDef, error) {
+	var err error
+	column := ColumnDef{}
+	if column.Name, err = p.expect_name("column name"); err != nil {
+		return column, err
+	}
+	if token := p.peek(); token != nil && token.IsKeyword("integer", "text", "real", "blob") {
+		column.Type = strings.ToLower(p.advance().Val)
+	}
+	for {
+		switch {
+		case p.accept_keyword("primary"):
+			if err := p.expect_keyword("key"); err != nil {
+				return column, err
+			}
+			column.PrimaryKey = true
+		case p.accept_keyword("not"):
+			if err := p.expect_keyword("null"); err != nil {
+				return column, err
+			}
+			column.NotNull = true
+		case p.accept_keyword("null"):
+		case p.accept_keyword("unique"):
+			column.Unique = true
+		case p.accept_keyword("default"):
+			if column.Default, err = p.parse_unary(); err != nil {
+				return column, err
+			}
+		default:
+			return column, nil
+		}
+	}
+}
+
+func (p *Parser) parse_create_index(unique bool) (*CreateIndex, error) {
+	var err error
+	statement := &CreateIndex{Unique: unique}
+	if statement.IfNotExists, err = p.parse_if_exists(true); err != nil {
+		return nil, err
+	}
+	if statement.Name, err = p.expect_name("index name"); err != nil {
+		return nil, err
+	}
+	if err := p.expect_keyword("on"); err != nil {
+		return nil, err
+	}
+	if statement.Table, err = p.expect_name("table name"); err != nil {
+		return nil, err
+	}
+	if statement.Columns, err = p.expect_names("column name"); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+func (p *Parser) parse_insert() (*Insert, error) {
+	var err error
+	p.advance()
+	if err := p.expect_keyword("into"); err != nil {
+		return nil, err
+	}
+	statement := &Insert{}
+	if statement.Table, err = p.expect_name("table name"); err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token != nil && token.IsOperator("(") {
+		if statement.Columns, err = p.expect_names("column name"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect_keyword("values"); err != nil {
+		return nil, err
+	}
+	for {
+		start := p.peek()
+		row, err := p.parse_expression_list()
+		if err != nil {
+			return nil, err
+		}
+		// Every row needs a value for each column, named or not
+		want := len(row)
+		if statement.Columns != nil {
+			want = len(statement.Columns)
+		} else if len(statement.Rows) > 0 {
+			want = len(statement.Rows[0])
+		}
+		if len(row) != want {
+			return nil, syntax_error(start, fmt.Sprintf("expected %d values, found %d", want, len(row)))
+		}
+		statement.Rows = append(statement.Rows, row)
+		if !p.accept_operator(",") {
+			return statement, nil
+		}
+	}
+}
+
+// parse_expression_list parses a parenthesized list of expressions
+func (p *Parser) parse_expression_list() ([]Expr, error) {
+	if err := p.expect_operator("("); err != nil {
+		return nil, err
+	}
+	var list []Expr
+	for {
+		expr, err := p.parse_expression()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, expr)
+		if !p.accept_operator(",") {
+			break
+		}
+	}
+	return list, p.expect_operator(")")
+}
+
+func (p *Parser) parse_select() (*Select, error) {
+	var err error
+	p.advance()
+	statement := &Select{Distinct: p.accept_keyword("distinct")}
+	for {
+		column, err := p.parse_result_column()
+		if err != nil {
+			return nil, err
+		}
+		statement.Columns = append(statement.Columns, column)
+		if !p.accept_operator(",") {
+			break
+		}
+	}
+	if p.accept_keyword("from") {
+		if statement.From, err = p.expect_name("table name"); err != nil {
+			return nil, err
+		}
+	}
+	if statement.Where, err = p.parse_where(); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// parse_result_column parses *, or an expression with an optional alias
+// that may leave out AS
+func (p *Parser) parse_result_column() (ResultColumn, error) {
+	var err error
+	column := ResultColumn{}
+	if p.accept_operator("*") {
+		column.Star = true
+		return column, nil
+	}
+	if column.Expr, err = p.parse_expression(); err != nil {
+		return column, err
+	}
+	if p.accept_keyword("as") {
+		column.Alias, err = p.expect_name("column alias")
+	} else if token := p.peek(); token != nil && token.IsName() {
+		column.Alias = p.advance().Val
+	}
+	return column, err
+}
+
+// parse_where parses an optional WHERE clause, nil when there isn't one
+func (p *Parser) parse_where() (Expr, error) {
+	if !p.accept_keyword("where") {
+		return nil, nil
+	}
+	return p.parse_expression()
+}
+
+func (p *Parser) parse_update() (*Update, error) {
+	var err error
+	p.advance()
+	statement := &Update{}
+	if statement.Table, err = p.expect_name("table name"); err != nil {
+		return nil, err
+	}
+	if err := p.expect_keyword("set"); err != nil {
+		return nil, err
+	}
+	for {
+		assignment := Assignment{}
+		if assignment.Column, err = p.expect_name("column name"); err != nil {
+			return nil, err
+		}
+		if err := p.expect_operator("="); err != nil {
+			return nil, err
+		}
+		if assignment.Value, err = p.parse_expression(); err != nil {
+			return nil, err
+		}
+		statement.Set = append(statement.Set, assignment)
+		if !p.accept_operator(",") {
+			break
+		}
+	}
+	if statement.Where, err = p.parse_where(); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+func (p *Parser) parse_delete() (*Delete, error) {
+	var err error
+	p.advance()
+	if err := p.expect_keyword("from"); err != nil {
+		return nil, err
+	}
+	statement := &Delete{}
+	if statement.Table, err = p.expect_name("table name"); err != nil {
+		return nil, err
+	}
+	if statement.Where, err = p.parse_where(); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+func (p *Parser) parse_drop() (*Drop, error) {
+	var err error
+	p.advance()
+	statement := &Drop{}
+	switch {
+	case p.accept_keyword("table"):
+		statement.Kind = "table"
+	case p.accept_keyword("index"):
+		statement.Kind = "index"
+	default:
+		return nil, p.unexpected("TABLE or INDEX")
+	}
+	if statement.IfExists, err = p.parse_if_exists(false); err != nil {
+		return nil, err
+	}
+	if statement.Name, err = p.expect_name(statement.Kind + " name"); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// parse_transaction parses BEGIN, COMMIT, ROLLBACK, SAVEPOINT and RELEASE
+func (p *Parser) parse_transaction() (Statement, error) {
+	var err error
+	token := p.advance()
+	switch {
+	case token.IsKeyword("begin"):
+		p.accept_keyword("transaction")
+		return &Begin{}, nil
+	case token.IsKeyword("commit"):
+		p.accept_keyword("transaction")
+		return &Commit{}, nil
+	case token.IsKeyword("rollback"):
+		p.accept_keyword("transaction")
+		statement := &Rollback{}
+		if p.accept_keyword("to") {
+			p.accept_keyword("savepoint")
+			if statement.Savepoint, err = p.expect_name("savepoint name"); err != nil {
+				return nil, err
+			}
+		}
+		return statement, nil
+	case token.IsKeyword("savepoint"):
+		statement := &Savepoint{}
+		if statement.Name, err = p.expect_name("savepoint name"); err != nil {
+			return nil, err
+		}
+		return statement, nil
+	default:
+		p.accept_keyword("savepoint")
+		statement := &Release{}
+		if statement.Name, err = p.expect_name("savepoint name"); err != nil {
+			return nil, err
+		}
+		return statement, nil
+	}
+}
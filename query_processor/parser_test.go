@@ -0,0 +1,247 @@
+package query_processor
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parse_test_sql(t *testing.T, sql string) []Statement {
+	t.Helper()
+	statements, err := ParseString(sql)
+	if err != nil {
+		t.Fatalf("ParseString(%q): %v", sql, err)
+	}
+	return statements
+}
+
+func check_statements(t *testing.T, sql string, expected ...Statement) {
+	t.Helper()
+	statements := parse_test_sql(t, sql)
+	if !reflect.DeepEqual(statements, expected) {
+		t.Errorf("ParseString(%q):\nexpected %s\ngot      %s", sql, dump(expected), dump(statements))
+	}
+}
+
+// dump prints statements with their pointers followed, so a mismatch shows
+func dump(statements []Statement) string {
+	var parts []string
+	for _, statement := range statements {
+		parts = append(parts, dump_value(reflect.ValueOf(statement)))
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+func dump_value(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if value.IsNil() {
+			return "nil"
+		}
+		return dump_value(value.Elem())
+	case reflect.Struct:
+		var fields []string
+		for i := 0; i < value.NumField(); i++ {
+			fields = append(fields, value.Type().Field(i).Name+":"+dump_value(value.Field(i)))
+		}
+		return value.Type().Name() + "{" + strings.Join(fields, " ") + "}"
+	case reflect.Slice:
+		var items []string
+		for i := 0; i < value.Len(); i++ {
+			items = append(items, dump_value(value.Index(i)))
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	return fmt.Sprintf("%#v", value.Interface())
+}
+
+func column(name string) *ColumnRef {
+	return &ColumnRef{Column: name}
+}
+
+func literal(value any) *Literal {
+	return &Literal{Value: value}
+}
+
+func TestParseCreateTable(t *testing.T) {
+	check_statements(t, `create table cats (
+		id integer PRIMARY KEY,
+		cat_names text not null unique,
+		age INTEGER default 1,
+		weight real DEFAULT -0.5 null,
+		photo blob,
+		"notes" default 'none'
+	)`, &CreateTable{Name: "cats", Columns: []ColumnDef{
+		{Name: "id", Type: "integer", PrimaryKey: true},
+		{Name: "cat_names", Type: "text", NotNull: true, Unique: true},
+		{Name: "age", Type: "integer", Default: literal(int64(1))},
+		{Name: "weight", Type: "real", Default: literal(-0.5)},
+		{Name: "photo", Type: "blob"},
+		{Name: "notes", Default: literal("none")},
+	}})
+	check_statements(t, "CREATE TABLE IF NOT EXISTS dogs (name)",
+		&CreateTable{Name: "dogs", IfNotExists: true, Columns: []ColumnDef{{Name: "name"}}})
+	check_statements(t, "create unique index if not exists cats_by_name on cats (cat_names, age); create index i on cats (age)",
+		&CreateIndex{Name: "cats_by_name", Table: "cats", Columns: []string{"cat_names", "age"}, Unique: true, IfNotExists: true},
+		&CreateIndex{Name: "i", Table: "cats", Columns: []string{"age"}})
+}
+
+func TestParseInsert(t *testing.T) {
+	check_statements(t, "INSERT INTO cats (cat_names, age, weight) values ('luna', 5, 5.5), ('milo', -2, null)",
+		&Insert{Table: "cats", Columns: []string{"cat_names", "age", "weight"}, Rows: [][]Expr{
+			{literal("luna"), literal(int64(5)), literal(5.5)},
+			{literal("milo"), literal(int64(-2)), literal(nil)},
+		}})
+	check_statements(t, "insert into cats values ('whiskers', 3)",
+		&Insert{Table: "cats", Rows: [][]Expr{{literal("whiskers"), literal(int64(3))}}})
+}
+
+func TestParseSelect(t *testing.T) {
+	check_statements(t, "select * from cats",
+		&Select{Columns: []ResultColumn{{Star: true}}, From: "cats"})
+	check_statements(t, "SELECT DISTINCT cat_names AS name, age years, 1 FROM cats WHERE age >= 3",
+		&Select{
+			Distinct: true,
+			Columns: []ResultColumn{
+				{Expr: column("cat_names"), Alias: "name"},
+				{Expr: column("age"), Alias: "years"},
+				{Expr: literal(int64(1))},
+			},
+			From:  "cats",
+			Where: &BinaryExpr{Op: ">=", Left: column("age"), Right: literal(int64(3))},
+		})
+	check_statements(t, "select 'hi'",
+		&Select{Columns: []ResultColumn{{Expr: literal("hi")}}})
+	// == and != are the same comparisons as = and <>
+	check_statements(t, "select * from cats where age == 3; select * from cats where age != 3",
+		&Select{Columns: []ResultColumn{{Star: true}}, From: "cats",
+			Where: &BinaryExpr{Op: "=", Left: column("age"), Right: literal(int64(3))}},
+		&Select{Columns: []ResultColumn{{Star: true}}, From: "cats",
+			Where: &BinaryExpr{Op: "<>", Left: column("age"), Right: literal(int64(3))}})
+}
+
+func TestParseUpdateDeleteAndDrop(t *testing.T) {
+	check_statements(t, "update cats set age = 4, weight = 4.5 where cat_names = 'whiskers'",
+		&Update{
+			Table: "cats",
+			Set:   []Assignment{{"age", literal(int64(4))}, {"weight", literal(4.5)}},
+			Where: &BinaryExpr{Op: "=", Left: column("cat_names"), Right: literal("whiskers")},
+		})
+	check_statements(t, "delete from cats; DELETE FROM cats WHERE age < 1",
+		&Delete{Table: "cats"},
+		&Delete{Table: "cats", Where: &BinaryExpr{Op: "<", Left: column("age"), Right: literal(int64(1))}})
+	check_statements(t, "drop table cats; DROP TABLE IF EXISTS cats; drop index cats_by_name",
+		&Drop{Kind: "table", Name: "cats"},
+		&Drop{Kind: "table", Name: "cats", IfExists: true},
+		&Drop{Kind: "index", Name: "cats_by_name"})
+}
+
+func TestParseTransactions(t *testing.T) {
+	check_statements(t, `BEGIN; begin transaction; COMMIT; commit transaction; rollback;
+		savepoint one; rollback to one; ROLLBACK TRANSACTION TO SAVEPOINT one;
+		release one; release savepoint one`,
+		&Begin{}, &Begin{}, &Commit{}, &Commit{}, &Rollback{},
+		&Savepoint{Name: "one"}, &Rollback{Savepoint: "one"}, &Rollback{Savepoint: "one"},
+		&Release{Name: "one"}, &Release{Name: "one"})
+}
+
+func TestParseKeywordsAsNames(t *testing.T) {
+	check_statements(t, "create table set (key text primary key, index integer default 0, text blob, left real)",
+		&CreateTable{Name: "set", Columns: []ColumnDef{
+			{Name: "key", Type: "text", PrimaryKey: true},
+			{Name: "index", Type: "integer", Default: literal(int64(0))},
+			{Name: "text", Type: "blob"},
+			{Name: "left", Type: "real"},
+		}})
+	check_statements(t, "create index index on set (key, offset)",
+		&CreateIndex{Name: "index", Table: "set", Columns: []string{"key", "offset"}})
+	check_statements(t, "insert into set (key, default) values (1, 2)",
+		&Insert{Table: "set", Columns: []string{"key", "default"}, Rows: [][]Expr{{literal(int64(1)), literal(int64(2))}}})
+	check_statements(t, "select key, set.index desc, offset + 1 as to, left(text, 2) from set where key in (index)",
+		&Select{
+			Columns: []ResultColumn{
+				{Expr: column("key")},
+				{Expr: &ColumnRef{Table: "set", Column: "index"}, Alias: "desc"},
+				{Expr: &BinaryExpr{Op: "+", Left: column("offset"), Right: literal(int64(1))}, Alias: "to"},
+				{Expr: &FunctionCall{Name: "left", Args: []Expr{column("text"), literal(int64(2))}}},
+			},
+			From:  "set",
+			Where: &InList{Expr: column("key"), List: []Expr{column("index")}},
+		})
+	check_statements(t, "update set set set = 1 where default is null",
+		&Update{Table: "set", Set: []Assignment{{"set", literal(int64(1))}},
+			Where: &IsNull{Expr: column("default")}})
+	check_statements(t, "savepoint to; rollback to to; release savepoint asc; drop table by",
+		&Savepoint{Name: "to"}, &Rollback{Savepoint: "to"}, &Release{Name: "asc"},
+		&Drop{Kind: "table", Name: "by"})
+}
+
+func TestParseSeparators(t *testing.T) {
+	// The last ; is optional and empty statements are skipped
+	check_statements(t, ";; begin;; commit", &Begin{}, &Commit{})
+	if statements := parse_test_sql(t, " -- nothing\n"); len(statements) != 0 {
+		t.Errorf("Expected no statements, got %d", len(statements))
+	}
+}
+
+func TestParseNumbers(t *testing.T) {
+	check_statements(t, "select 42, -42, 0x1F, -0x10, 0xFFFFFFFFFFFFFFFF, 2.5, -.5, 1e3, 9223372036854775808, -9223372036854775808",
+		&Select{Columns: []ResultColumn{
+			{Expr: literal(int64(42))},
+			{Expr: literal(int64(-42))},
+			{Expr: literal(int64(31))},
+			{Expr: literal(int64(-16))},
+			{Expr: literal(int64(-1))},
+			{Expr: literal(2.5)},
+			{Expr: literal(-0.5)},
+			{Expr: literal(1000.0)},
+			{Expr: literal(9223372036854775808.0)},
+			{Expr: literal(int64(-9223372036854775808))},
+		}})
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		sql     string
+		message string
+	}{
+		{"selec * from cats", `syntax error: expected a statement, found "selec" at line 1, column 1`},
+		{"select * from", "syntax error: expected table name, found end of input"},
+		{"select * from cats\nwhere", "syntax error: expected an expression, found end of input"},
+		{"select *\nfrom 'cats'", `syntax error: expected table name, found 'cats' at line 2, column 6`},
+		{"select * from cats where age = = 3", `syntax error: expected an expression, found "=" at line 1, column 32`},
+		{"select * from cats dogs", `syntax error: expected ";", found "dogs" at line 1, column 20`},
+		{"insert cats values (1)", `syntax error: expected INTO, found "cats" at line 1, column 8`},
+		{"insert into cats (a, b) values (1, 2),\n  (3)", "syntax error: expected 2 values, found 1 at line 2, column 3"},
+		{"insert into cats values (1, 2), (3)", "syntax error: expected 2 values, found 1 at line 1, column 33"},
+		{"insert into cats (a, b values (1, 2)", `syntax error: expected ")", found "values" at line 1, column 24`},
+		{"create table cats (id integer primary)", `syntax error: expected KEY, found ")" at line 1, column 38`},
+		{"create table cats (id varchar)", `syntax error: expected ")", found "varchar" at line 1, column 23`},
+		{"create view v", `syntax error: expected TABLE or INDEX, found "view" at line 1, column 8`},
+		{"create table if exists cats (id)", `syntax error: expected NOT, found "exists" at line 1, column 17`},
+		{"drop cats", `syntax error: expected TABLE or INDEX, found "cats" at line 1, column 6`},
+		{"update cats set age 4", `syntax error: expected "=", found "4" at line 1, column 21`},
+		{"select 0xFFFFFFFFFFFFFFFFF", "syntax error: hex literal 0xFFFFFFFFFFFFFFFFF is too big at line 1, column 8"},
+		{"release", "syntax error: expected savepoint name, found end of input"},
+		{"create table from (id)", `syntax error: expected table name, found "from" at line 1, column 14`},
+		{"select where from cats", `syntax error: expected an expression, found "where" at line 1, column 8`},
+		{"select age from cats order", `syntax error: expected ";", found "order" at line 1, column 22`},
+	}
+	for _, test := range tests {
+		_, err := ParseString(test.sql)
+		if !errors.Is(err, ErrSyntax) {
+			t.Errorf("ParseString(%q): expected ErrSyntax, got %v", test.sql, err)
+			continue
+		}
+		if err.Error() != test.message {
+			t.Errorf("ParseString(%q):\nexpected %s\ngot      %s", test.sql, test.message, err)
+		}
+	}
+
+	// Scanner errors come through as they are
+	if _, err := ParseString("select 'cats"); !errors.Is(err, ErrUnterminatedString) {
+		t.Errorf("Expected ErrUnterminatedString, got %v", err)
+	}
+}
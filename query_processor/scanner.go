@@ -2,67 +2,246 @@
 Token Types:
 
 	"select": Keyword - Represents the SQL SELECT statement for querying data
+	"distinct": Keyword - Keeps only one of each selected row
+	"as": Keyword - Gives a column or table another name
 	"from": Keyword - Specifies the table to query from
+	"join": Keyword - Combines rows of two tables
+	"inner", "left", "outer", "cross": Keyword - Say which kind of join
+	"on": Keyword - Gives the condition rows are joined on
 	"where": Keyword - Defines conditions for filtering data
-	"insert": Keyword - Adds new data to a table
+	"group", "by": Keyword - GROUP BY collects rows into groups
+	"having": Keyword - Filters groups like WHERE filters rows
+	"order": Keyword - ORDER BY sorts the result
+	"asc", "desc": Keyword - Sort direction in ORDER BY
+	"limit": Keyword - Caps the number of rows returned
+	"offset": Keyword - Skips rows before LIMIT counts
+	"insert", "into": Keyword - INSERT INTO adds new data to a table
+	"values": Keyword - Lists the rows INSERT adds
 	"update": Keyword - Modifies existing data in a table
+	"set": Keyword - Lists the columns UPDATE changes
 	"delete": Keyword - Removes data from a table
 	"create": Keyword - Defines a new table or structure
 	"table": Keyword - Specifies a table in a creation or query
+	"index": Keyword - Specifies an index in a creation or drop
 	"drop": Keyword - Deletes a table or structure
+	"if", "exists": Keyword - IF EXISTS and IF NOT EXISTS make CREATE and DROP
+	    quietly do nothing
 	"integer": Keyword - Indicates an integer data type
 	"text": Keyword - Indicates a text data type
 	"real": Keyword - Indicates a floating-point data type
-	"primary_key": Keyword - Defines a primary key constraint
-	"": Identifier - Represents a variable or table name (non-keyword)
-	"=": Operator - Equality comparison
+	"blob": Keyword - Indicates a raw bytes data type
+	"primary", "key": Keyword - PRIMARY KEY defines a primary key constraint
+	"unique": Keyword - Defines a uniqueness constraint
+	"default": Keyword - Gives a column's value when an INSERT leaves it out
+	"null": Keyword - The missing value, also NOT NULL as a constraint
+	"and", "or", "not": Keyword - Logical operators
+	"is": Keyword - IS NULL and IS NOT NULL tests
+	"in": Keyword - Tests membership in a list
+	"between": Keyword - Tests a value lies in a range
+	"like": Keyword - Matches a string against a pattern
+	"begin": Keyword - Starts an explicit transaction
+	"commit": Keyword - Makes a transaction's changes permanent
+	"rollback": Keyword - Discards a transaction's changes
+	"transaction": Keyword - Optional noise word after BEGIN, COMMIT or ROLLBACK
+	"savepoint": Keyword - Marks a point a transaction can roll back to
+	"release": Keyword - Forgets a savepoint, keeping its changes
+	"to": Keyword - Names the savepoint in ROLLBACK TO
+	"": Identifier - Represents a variable or table name (non-keyword), or any
+	    name in double quotes ("my table", with "" for a quote inside)
+	"": Literal - A string in single quotes ('it''s', with '' for a quote
+	    inside), an integer (42, or 0x2A in hex) or a float (4.5, .5, 1e10).
+	    Literal_type tells them apart as "string", "number" or "float"
+	"=", "==": Operator - Equality comparison
+	"<>", "!=": Operator - Inequality comparison
+	"<", "<=", ">", ">=": Operator - Ordering comparisons
+	"+", "-", "*", "/", "%": Operator - Arithmetic, "*" is also the wildcard for
+	    selecting all columns
+	"||": Operator - String concatenation
+	".": Operator - Separates a table name from a column name
 	";": Operator - Statement terminator
 	",": Operator - Item separator
-	"*": Operator - Wildcard, often for selecting all columns
-	"'": Operator - Delimiter for string literals
 	"(": Operator - Opens a grouped expression
 	")": Operator - Closes a grouped expression
+
+Comments run from "--" to the end of the line, or from "/*" to the next star
+followed by a slash, and are skipped like whitespace. Keywords match in any
+case, SELECT, Select and select are the same keyword, and keep the case they
+were written in as their Val. Every token records the
+line and column it starts at, counting columns in characters so 'Zoë' is
+three columns wide. Names may use letters from any script.
+
+Keywords that mark no part of a statement's structure fall back to being
+names, as they do in SQLite. ASC, BY, DESC, KEY, OFFSET, TO, INDEX, LEFT, SET,
+DEFAULT and the type names INTEGER, TEXT, REAL and BLOB scan as keywords, but
+the parser takes them for a name wherever it expects a table, column or
+other name, so "create table t (key text, index integer)" works. Every other
+keyword has to be double quoted to be used as a name.
 */
 package query_processor
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"slices"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 var TokenMap = map[string]string{
 	"select":      "Keyword",
+	"distinct":    "Keyword",
+	"as":          "Keyword",
 	"from":        "Keyword",
+	"join":        "Keyword",
+	"inner":       "Keyword",
+	"left":        "Keyword",
+	"outer":       "Keyword",
+	"cross":       "Keyword",
+	"on":          "Keyword",
 	"where":       "Keyword",
-	"insert_into": "Keyword",
+	"group":       "Keyword",
+	"by":          "Keyword",
+	"having":      "Keyword",
+	"order":       "Keyword",
+	"asc":         "Keyword",
+	"desc":        "Keyword",
+	"limit":       "Keyword",
+	"offset":      "Keyword",
+	"insert":      "Keyword",
+	"into":        "Keyword",
+	"values":      "Keyword",
 	"update":      "Keyword",
+	"set":         "Keyword",
 	"delete":      "Keyword",
 	"create":      "Keyword",
 	"table":       "Keyword",
+	"index":       "Keyword",
 	"drop":        "Keyword",
-	"values":      "Keyword",
+	"if":          "Keyword",
+	"exists":      "Keyword",
 	"integer":     "Keyword",
 	"text":        "Keyword",
 	"real":        "Keyword",
-	"primary_key": "Keyword",
-	"string":      "Literal",
-	"number":      "Literal",
-	"float":       "Literal",
+	"blob":        "Keyword",
+	"primary":     "Keyword",
+	"key":         "Keyword",
+	"unique":      "Keyword",
+	"default":     "Keyword",
+	"null":        "Keyword",
+	"and":         "Keyword",
+	"or":          "Keyword",
+	"not":         "Keyword",
+	"is":          "Keyword",
+	"in":          "Keyword",
+	"between":     "Keyword",
+	"like":        "Keyword",
+	"begin":       "Keyword",
+	"commit":      "Keyword",
+	"rollback":    "Keyword",
+	"transaction": "Keyword",
+	"savepoint":   "Keyword",
+	"release":     "Keyword",
+	"to":          "Keyword",
 	"=":           "Operator",
+	"==":          "Operator",
+	"<>":          "Operator",
+	"!=":          "Operator",
+	"<":           "Operator",
+	"<=":          "Operator",
+	">":           "Operator",
+	">=":          "Operator",
+	"+":           "Operator",
+	"-":           "Operator",
+	"*":           "Operator",
+	"/":           "Operator",
+	"%":           "Operator",
+	"||":          "Operator",
+	".":           "Operator",
 	";":           "Operator",
 	",":           "Operator",
-	"*":           "Operator",
-	"'":           "Operator",
 	"(":           "Operator",
 	")":           "Operator",
 }
 
+// fallback_keywords can also be names, see the top of the file
+var fallback_keywords = map[string]bool{
+	"asc":     true,
+	"by":      true,
+	"desc":    true,
+	"key":     true,
+	"offset":  true,
+	"to":      true,
+	"index":   true,
+	"left":    true,
+	"set":     true,
+	"default": true,
+	"integer": true,
+	"text":    true,
+	"real":    true,
+	"blob":    true,
+}
+
+var (
+	ErrUnterminatedString     = errors.New("unterminated string literal")
+	ErrUnterminatedIdentifier = errors.New("unterminated quoted identifier")
+	ErrUnterminatedComment    = errors.New("unterminated comment")
+	ErrMalformedNumber        = errors.New("malformed number")
+	ErrUnexpectedCharacter    = errors.New("unexpected character")
+)
+
 type Token struct {
-	Token_type string
-	Val        string
-	is_int     bool
-	line       int
+	Token_type   string
+	Val          string // The text of the token, strings and quoted identifiers without their quotes
+	Literal_type string // "string", "number" or "float" for literals, empty otherwise
+	Line         int    // Line of the token's first character
+	Column       int    // Column of the token's first character
+}
+
+// IsKeyword reports whether word is a keyword in any case. Anything else is
+// an identifier, as is any word in double quotes
+func IsKeyword(word string) bool {
+	return TokenMap[strings.ToLower(word)] == "Keyword"
+}
+
+// IsKeyword reports whether the token is a keyword, and if any words are
+// given, whether it's one of them. Words compare in any case
+func (token *Token) IsKeyword(words ...string) bool {
+	if token.Token_type != "Keyword" {
+		return false
+	}
+	if len(words) == 0 {
+		return true
+	}
+	for _, word := range words {
+		if strings.EqualFold(token.Val, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIdentifier reports whether the token names something, like a table or
+// a column, rather than being a keyword
+func (token *Token) IsIdentifier() bool {
+	return token.Token_type == "Identifier"
+}
+
+// IsName reports whether the token can name something where the grammar
+// expects a name, either an identifier or a keyword that falls back to one
+func (token *Token) IsName() bool {
+	return token.IsIdentifier() || (token.IsKeyword() && fallback_keywords[strings.ToLower(token.Val)])
+}
+
+// IsOperator reports whether the token is an operator, and if any operators
+// are given, whether it's one of them
+func (token *Token) IsOperator(operators ...string) bool {
+	if token.Token_type != "Operator" {
+		return false
+	}
+	return len(operators) == 0 || slices.Contains(operators, token.Val)
 }
 
 type Scanner struct {
@@ -78,36 +257,6 @@ type Scanner struct {
 	column        int    // Next column position
 }
 
-func (s *Scanner) AddToken(text string, is_int bool) {
-	if is_int {
-		token := &Token{
-			Token_type: "Literal",
-			Val:        text,
-			line:       s.CurrentLine,
-			is_int:     is_int,
-		}
-		s.Tokens = append(s.Tokens, token)
-		return
-	}
-	token_type := TokenMap[text]
-	if text == "'" {
-		s.Next()
-		text = s.GetWord()
-		s.Next()
-		token_type = "Literal"
-	}
-	if token_type == "" {
-		token_type = "Identifier"
-	}
-	token := &Token{
-		Token_type: string(token_type),
-		Val:        text,
-		line:       s.CurrentLine,
-		is_int:     is_int,
-	}
-	s.Tokens = append(s.Tokens, token)
-}
-
 // NewScanner creates a new Scanner by reading the entire file into memory
 func NewScanner(filePath string) (*Scanner, error) {
 	// Read the entire file into a byte slice and convert it to a string
@@ -115,11 +264,17 @@ func NewScanner(filePath string) (*Scanner, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewStringScanner(string(content)), nil
+}
+
+// NewStringScanner creates a new Scanner over SQL held in memory, such as a
+// line typed at the prompt
+func NewStringScanner(content string) *Scanner {
 	return &Scanner{
-		content: string(content),
+		content: content,
 		line:    1, // Start at line 1
 		column:  1, // Start at column 1
-	}, nil
+	}
 }
 
 // Next reads the next character from the in-memory content and updates the scanner's state
@@ -134,8 +289,9 @@ func (s *Scanner) Next() error {
 		return io.EOF
 	}
 
-	// Get the current character and update the scanner's state
-	r := rune(s.content[s.index])
+	// Decode the current character and update the scanner's state. Bytes
+	// that aren't valid UTF-8 come back one at a time as utf8.RuneError
+	r, size := utf8.DecodeRuneInString(s.content[s.index:])
 	s.CurrentRune = r
 	s.CurrentLine = s.line
 	s.CurrentColumn = s.column
@@ -145,16 +301,17 @@ func (s *Scanner) Next() error {
 		s.line += 1  // Move to the next line
 		s.column = 1 // Reset column to the start
 	} else {
-		s.column += 1 // Move to the next column
+		s.column += 1 // Move to the next column, columns count characters not bytes
 	}
 
 	// Move to the next character
-	s.index += 1
+	s.index += size
 	return nil
 }
 
 func (s *Scanner) Prev() error {
-	if s.Err != nil {
+	// Reaching the end doesn't stop the scanner from stepping back
+	if s.Err != nil && s.Err != io.EOF {
 		return s.Err
 	}
 
@@ -164,11 +321,11 @@ func (s *Scanner) Prev() error {
 		return io.EOF
 	}
 
-	// Move back one character
-	s.index -= 1
+	// Move back one character, however many bytes it takes
+	r, size := utf8.DecodeLastRuneInString(s.content[:s.index])
+	s.index -= size
 
-	// Get the previous character and update the scanner's state
-	r := rune(s.content[s.index])
+	// Update the scanner's state with the previous character
 	s.CurrentRune = r
 
 	// Update line and column numbers based on the character
@@ -177,11 +334,8 @@ func (s *Scanner) Prev() error {
 		// To set the column correctly, we need to find the last column of the previous line
 		if s.index > 0 {
 			// Look back to find the previous newline or start of content
-			prevLineStart := s.index - 1
-			for prevLineStart >= 0 && rune(s.content[prevLineStart]) != '\n' {
-				prevLineStart--
-			}
-			s.column = s.index - prevLineStart // Length from last newline (or start) to current pos
+			prevLineStart := strings.LastIndexByte(s.content[:s.index], '\n')
+			s.column = utf8.RuneCountInString(s.content[prevLineStart+1:s.index]) + 1 // Characters from last newline (or start) to current pos
 		} else {
 			s.column = 1 // At the start of the content
 		}
@@ -200,17 +354,204 @@ func (s *Scanner) Prev() error {
 	return nil
 }
 
-func (s *Scanner) IsChar() bool {
-	return !unicode.IsSpace(s.CurrentRune) && s.CurrentRune != 0 && s.CurrentRune != ',' && s.CurrentRune != '\'' && s.CurrentRune != ')' && s.CurrentRune != ';'
+// peek returns the character Next would read without reading it, or 0 at the
+// end of the content
+func (s *Scanner) peek() rune {
+	if s.index >= len(s.content) {
+		return 0
+	}
+	r, _ := utf8.DecodeRuneInString(s.content[s.index:])
+	return r
+}
+
+// Scan reads the rest of the content into Tokens, skipping whitespace and
+// comments. It stops at the first thing that isn't a valid token and
+// reports where it is
+func (s *Scanner) Scan() error {
+	for {
+		err := s.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line, column := s.CurrentLine, s.CurrentColumn
+		current := s.CurrentRune
+		switch {
+		case unicode.IsSpace(current):
+			continue
+		case current == '-' && s.peek() == '-':
+			for s.peek() != '\n' && s.Next() == nil {
+			}
+		case current == '/' && s.peek() == '*':
+			err = s.skip_block_comment()
+		case current == '\'':
+			err = s.scan_quoted('\'', "Literal", ErrUnterminatedString)
+		case current == '"':
+			err = s.scan_quoted('"', "Identifier", ErrUnterminatedIdentifier)
+		case is_digit(current) || (current == '.' && is_digit(s.peek())):
+			err = s.scan_number()
+		case is_word_start(current):
+			s.scan_word()
+		default:
+			err = s.scan_operator()
+		}
+		if err != nil {
+			return fmt.Errorf("%w at line %d, column %d", err, line, column)
+		}
+	}
+}
+
+func (s *Scanner) add_token(token_type string, literal_type string, text string, line int, column int) {
+	s.Tokens = append(s.Tokens, &Token{
+		Token_type:   token_type,
+		Val:          text,
+		Literal_type: literal_type,
+		Line:         line,
+		Column:       column,
+	})
+}
+
+// skip_block_comment skips a /* */ comment, the scanner is on its '/'
+func (s *Scanner) skip_block_comment() error {
+	s.Next()
+	for {
+		if s.Next() != nil {
+			return ErrUnterminatedComment
+		}
+		if s.CurrentRune == '*' && s.peek() == '/' {
+			s.Next()
+			return nil
+		}
+	}
+}
+
+// scan_quoted reads a string or identifier up to the closing quote, where a
+// doubled quote stands for one quote inside
+func (s *Scanner) scan_quoted(quote rune, token_type string, unterminated error) error {
+	line, column := s.CurrentLine, s.CurrentColumn
+	var text strings.Builder
+	for {
+		if s.Next() != nil {
+			return unterminated
+		}
+		if s.CurrentRune == quote {
+			if s.peek() != quote {
+				break
+			}
+			s.Next()
+		}
+		text.WriteRune(s.CurrentRune)
+	}
+	literal_type := ""
+	if token_type == "Literal" {
+		literal_type = "string"
+	}
+	s.add_token(token_type, literal_type, text.String(), line, column)
+	return nil
+}
+
+// scan_number reads an integer, a hex integer or a float. A number has to
+// end where a word could not go on, so 3abc is an error and not 3 and abc
+func (s *Scanner) scan_number() error {
+	line, column := s.CurrentLine, s.CurrentColumn
+	var text strings.Builder
+	text.WriteRune(s.CurrentRune)
+	literal_type := "number"
+
+	if s.CurrentRune == '0' && (s.peek() == 'x' || s.peek() == 'X') {
+		s.Next()
+		text.WriteRune(s.CurrentRune)
+		if !is_hex_digit(s.peek()) {
+			return ErrMalformedNumber
+		}
+		for is_hex_digit(s.peek()) {
+			s.Next()
+			text.WriteRune(s.CurrentRune)
+		}
+	} else {
+		seen_point := s.CurrentRune == '.'
+		if seen_point {
+			literal_type = "float"
+		}
+		for is_digit(s.peek()) || (s.peek() == '.' && !seen_point) {
+			s.Next()
+			text.WriteRune(s.CurrentRune)
+			if s.CurrentRune == '.' {
+				seen_point = true
+				literal_type = "float"
+			}
+		}
+		if s.peek() == 'e' || s.peek() == 'E' {
+			s.Next()
+			text.WriteRune(s.CurrentRune)
+			if s.peek() == '+' || s.peek() == '-' {
+				s.Next()
+				text.WriteRune(s.CurrentRune)
+			}
+			if !is_digit(s.peek()) {
+				return ErrMalformedNumber
+			}
+			for is_digit(s.peek()) {
+				s.Next()
+				text.WriteRune(s.CurrentRune)
+			}
+			literal_type = "float"
+		}
+	}
+	if is_word_part(s.peek()) {
+		return ErrMalformedNumber
+	}
+	s.add_token("Literal", literal_type, text.String(), line, column)
+	return nil
+}
+
+// scan_word reads a keyword or an unquoted identifier
+func (s *Scanner) scan_word() {
+	line, column := s.CurrentLine, s.CurrentColumn
+	var text strings.Builder
+	text.WriteRune(s.CurrentRune)
+	for is_word_part(s.peek()) {
+		s.Next()
+		text.WriteRune(s.CurrentRune)
+	}
+	word := text.String()
+	token_type := "Identifier"
+	if IsKeyword(word) {
+		token_type = "Keyword"
+	}
+	s.add_token(token_type, "", word, line, column)
 }
 
-func (s *Scanner) GetWord() string {
-	text := ""
-	for s.IsChar() {
-		text += string(s.CurrentRune)
+// scan_operator reads the longest operator starting at the current character
+func (s *Scanner) scan_operator() error {
+	line, column := s.CurrentLine, s.CurrentColumn
+	text := string(s.CurrentRune)
+	if pair := text + string(s.peek()); TokenMap[pair] == "Operator" {
 		s.Next()
+		text = pair
 	}
-	s.Prev()
+	if TokenMap[text] != "Operator" {
+		return fmt.Errorf("%w %q", ErrUnexpectedCharacter, text)
+	}
+	s.add_token("Operator", "", text, line, column)
+	return nil
+}
+
+func is_digit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func is_hex_digit(r rune) bool {
+	return is_digit(r) || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
+
+func is_word_start(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
 
-	return text
+func is_word_part(r rune) bool {
+	return is_word_start(r) || unicode.IsDigit(r)
 }
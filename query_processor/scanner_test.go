@@ -0,0 +1,314 @@
+package query_processor
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+type test_token struct {
+	token_type   string
+	val          string
+	literal_type string
+}
+
+func scan_test_tokens(t *testing.T, sql string) []*Token {
+	t.Helper()
+	scanner := NewStringScanner(sql)
+	if err := scanner.Scan(); err != nil {
+		t.Fatalf("Scan(%q): %v", sql, err)
+	}
+	return scanner.Tokens
+}
+
+func check_tokens(t *testing.T, sql string, expected []test_token) {
+	t.Helper()
+	tokens := scan_test_tokens(t, sql)
+	if len(tokens) != len(expected) {
+		t.Fatalf("Scan(%q): expected %d tokens, got %d", sql, len(expected), len(tokens))
+	}
+	for i, want := range expected {
+		got := tokens[i]
+		if got.Token_type != want.token_type || got.Val != want.val || got.Literal_type != want.literal_type {
+			t.Errorf("Scan(%q) token %d: expected {%s %q %s}, got {%s %q %s}", sql, i,
+				want.token_type, want.val, want.literal_type, got.Token_type, got.Val, got.Literal_type)
+		}
+	}
+}
+
+func TestScanNumbers(t *testing.T) {
+	check_tokens(t, "42 3.25 .5 7. 1e10 2.5E-3 0x1F 0XAB", []test_token{
+		{"Literal", "42", "number"},
+		{"Literal", "3.25", "float"},
+		{"Literal", ".5", "float"},
+		{"Literal", "7.", "float"},
+		{"Literal", "1e10", "float"},
+		{"Literal", "2.5E-3", "float"},
+		{"Literal", "0x1F", "number"},
+		{"Literal", "0XAB", "number"},
+	})
+	check_tokens(t, "age>=10", []test_token{
+		{"Identifier", "age", ""},
+		{"Operator", ">=", ""},
+		{"Literal", "10", "number"},
+	})
+	for _, sql := range []string{"3abc", "0x", "0xZZ", "1e", "1e+"} {
+		scanner := NewStringScanner(sql)
+		if err := scanner.Scan(); !errors.Is(err, ErrMalformedNumber) {
+			t.Errorf("Scan(%q): expected ErrMalformedNumber, got %v", sql, err)
+		}
+	}
+}
+
+func TestScanStringsAndQuotedIdentifiers(t *testing.T) {
+	check_tokens(t, `'it''s a cat' '' "cat names" "say ""hi"""`, []test_token{
+		{"Literal", "it's a cat", "string"},
+		{"Literal", "", "string"},
+		{"Identifier", "cat names", ""},
+		{"Identifier", `say "hi"`, ""},
+	})
+	// Quoted, a keyword is just a name
+	check_tokens(t, `"select"`, []test_token{{"Identifier", "select", ""}})
+
+	scanner := NewStringScanner("select 'whiskers")
+	if err := scanner.Scan(); !errors.Is(err, ErrUnterminatedString) {
+		t.Errorf("Expected ErrUnterminatedString, got %v", err)
+	}
+	scanner = NewStringScanner(`select "cats`)
+	if err := scanner.Scan(); !errors.Is(err, ErrUnterminatedIdentifier) {
+		t.Errorf("Expected ErrUnterminatedIdentifier, got %v", err)
+	}
+}
+
+func TestScanOperators(t *testing.T) {
+	sql := "= == <> != < <= > >= + - * / % || . ; , ( )"
+	var expected []test_token
+	for _, operator := range []string{"=", "==", "<>", "!=", "<", "<=", ">", ">=", "+", "-", "*", "/", "%", "||", ".", ";", ",", "(", ")"} {
+		expected = append(expected, test_token{"Operator", operator, ""})
+	}
+	check_tokens(t, sql, expected)
+	check_tokens(t, "cats.age<-1", []test_token{
+		{"Identifier", "cats", ""},
+		{"Operator", ".", ""},
+		{"Identifier", "age", ""},
+		{"Operator", "<", ""},
+		{"Operator", "-", ""},
+		{"Literal", "1", "number"},
+	})
+
+	for _, sql := range []string{"age ! 3", "a | b", "#", "?"} {
+		scanner := NewStringScanner(sql)
+		if err := scanner.Scan(); !errors.Is(err, ErrUnexpectedCharacter) {
+			t.Errorf("Scan(%q): expected ErrUnexpectedCharacter, got %v", sql, err)
+		}
+	}
+}
+
+func TestScanSkipsComments(t *testing.T) {
+	check_tokens(t, "select -- every cat\n* /* all of them,\n even 'luna' */ from cats -- done", []test_token{
+		{"Keyword", "select", ""},
+		{"Operator", "*", ""},
+		{"Keyword", "from", ""},
+		{"Identifier", "cats", ""},
+	})
+	check_tokens(t, "10-2 10/2", []test_token{
+		{"Literal", "10", "number"},
+		{"Operator", "-", ""},
+		{"Literal", "2", "number"},
+		{"Literal", "10", "number"},
+		{"Operator", "/", ""},
+		{"Literal", "2", "number"},
+	})
+
+	scanner := NewStringScanner("select /* never closed")
+	if err := scanner.Scan(); !errors.Is(err, ErrUnterminatedComment) {
+		t.Errorf("Expected ErrUnterminatedComment, got %v", err)
+	}
+}
+
+func TestScanPositions(t *testing.T) {
+	tokens := scan_test_tokens(t, "select *\n  from cats\n\twhere name = 'tom cat';")
+	expected := [][2]int{{1, 1}, {1, 8}, {2, 3}, {2, 8}, {3, 2}, {3, 8}, {3, 13}, {3, 15}, {3, 24}}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %d", len(expected), len(tokens))
+	}
+	for i, token := range tokens {
+		if token.Line != expected[i][0] || token.Column != expected[i][1] {
+			t.Errorf("Token %q: expected line %d, column %d, got line %d, column %d",
+				token.Val, expected[i][0], expected[i][1], token.Line, token.Column)
+		}
+	}
+
+	scanner := NewStringScanner("select\n  'whiskers")
+	err := scanner.Scan()
+	if err == nil || err.Error() != "unterminated string literal at line 2, column 3" {
+		t.Errorf("Expected the error to cite line 2, column 3, got %v", err)
+	}
+}
+
+func TestScanMultibyteText(t *testing.T) {
+	check_tokens(t, "insert into 猫 (名前, café) values ('Zoë', 'Ω and 🐈', \"naïve col\");", []test_token{
+		{"Keyword", "insert", ""},
+		{"Keyword", "into", ""},
+		{"Identifier", "猫", ""},
+		{"Operator", "(", ""},
+		{"Identifier", "名前", ""},
+		{"Operator", ",", ""},
+		{"Identifier", "café", ""},
+		{"Operator", ")", ""},
+		{"Keyword", "values", ""},
+		{"Operator", "(", ""},
+		{"Literal", "Zoë", "string"},
+		{"Operator", ",", ""},
+		{"Literal", "Ω and 🐈", "string"},
+		{"Operator", ",", ""},
+		{"Identifier", "naïve col", ""},
+		{"Operator", ")", ""},
+		{"Operator", ";", ""},
+	})
+
+	// Columns count characters, so multibyte ones take one column each
+	tokens := scan_test_tokens(t, "'Zoë' = 名前\n  'ü🐈' ,x")
+	expected := [][2]int{{1, 1}, {1, 7}, {1, 9}, {2, 3}, {2, 8}, {2, 9}}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %d", len(expected), len(tokens))
+	}
+	for i, token := range tokens {
+		if token.Line != expected[i][0] || token.Column != expected[i][1] {
+			t.Errorf("Token %q: expected line %d, column %d, got line %d, column %d",
+				token.Val, expected[i][0], expected[i][1], token.Line, token.Column)
+		}
+	}
+
+	scanner := NewStringScanner("'Zoë' ¿")
+	if err := scanner.Scan(); err == nil || err.Error() != `unexpected character "¿" at line 1, column 7` {
+		t.Errorf("Expected the error to cite column 7, got %v", err)
+	}
+}
+
+func TestNextAndPrevDecodeUTF8(t *testing.T) {
+	scanner := NewStringScanner("aé\n猫🐈b")
+	expected := []struct {
+		r            rune
+		line, column int
+	}{{'a', 1, 1}, {'é', 1, 2}, {'\n', 1, 3}, {'猫', 2, 1}, {'🐈', 2, 2}, {'b', 2, 3}}
+	for _, want := range expected {
+		if err := scanner.Next(); err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if scanner.CurrentRune != want.r || scanner.CurrentLine != want.line || scanner.CurrentColumn != want.column {
+			t.Errorf("Next: expected %q at %d:%d, got %q at %d:%d", want.r, want.line, want.column,
+				scanner.CurrentRune, scanner.CurrentLine, scanner.CurrentColumn)
+		}
+	}
+
+	// Stepping back goes over whole characters, and across the newline
+	for i := len(expected) - 1; i >= 2; i-- {
+		want := expected[i]
+		if err := scanner.Prev(); err != nil {
+			t.Fatalf("Prev: %v", err)
+		}
+		if scanner.CurrentRune != want.r || scanner.CurrentLine != want.line || scanner.CurrentColumn != want.column {
+			t.Errorf("Prev: expected %q at %d:%d, got %q at %d:%d", want.r, want.line, want.column,
+				scanner.CurrentRune, scanner.CurrentLine, scanner.CurrentColumn)
+		}
+	}
+	if err := scanner.Next(); err != nil || scanner.CurrentRune != '\n' {
+		t.Errorf("Expected Next to read the newline again, got %q, %v", scanner.CurrentRune, err)
+	}
+	if err := scanner.Next(); err != nil || scanner.CurrentRune != '猫' || scanner.CurrentColumn != 1 {
+		t.Errorf("Expected Next to read 猫 at column 1, got %q at column %d, %v", scanner.CurrentRune, scanner.CurrentColumn, err)
+	}
+}
+
+func TestPrevStepsBackFromTheEnd(t *testing.T) {
+	scanner := NewStringScanner("ab")
+	scanner.Next()
+	scanner.Next()
+	if err := scanner.Next(); err != io.EOF {
+		t.Fatalf("Expected io.EOF past the end, got %v", err)
+	}
+	if err := scanner.Prev(); err != nil || scanner.CurrentRune != 'b' || scanner.Err != nil {
+		t.Fatalf("Expected Prev to step back onto b, got %q, %v", scanner.CurrentRune, err)
+	}
+	if err := scanner.Next(); err != nil || scanner.CurrentRune != 'b' {
+		t.Errorf("Expected Next to read b again, got %q, %v", scanner.CurrentRune, err)
+	}
+	if err := scanner.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF past the end again, got %v", err)
+	}
+}
+
+func TestKeywordsMatchInAnyCase(t *testing.T) {
+	check_tokens(t, "SELECT Select select sElEcT \"SELECT\" selected", []test_token{
+		{"Keyword", "SELECT", ""},
+		{"Keyword", "Select", ""},
+		{"Keyword", "select", ""},
+		{"Keyword", "sElEcT", ""},
+		{"Identifier", "SELECT", ""},
+		{"Identifier", "selected", ""},
+	})
+	check_tokens(t, "Insert Into cats (id) Values (1); id INTEGER Primary Key", []test_token{
+		{"Keyword", "Insert", ""},
+		{"Keyword", "Into", ""},
+		{"Identifier", "cats", ""},
+		{"Operator", "(", ""},
+		{"Identifier", "id", ""},
+		{"Operator", ")", ""},
+		{"Keyword", "Values", ""},
+		{"Operator", "(", ""},
+		{"Literal", "1", "number"},
+		{"Operator", ")", ""},
+		{"Operator", ";", ""},
+		{"Identifier", "id", ""},
+		{"Keyword", "INTEGER", ""},
+		{"Keyword", "Primary", ""},
+		{"Keyword", "Key", ""},
+	})
+	// The old single-word spellings are just names now
+	check_tokens(t, "insert_into primary_key", []test_token{
+		{"Identifier", "insert_into", ""},
+		{"Identifier", "primary_key", ""},
+	})
+}
+
+func TestKeywordClassification(t *testing.T) {
+	for _, word := range []string{
+		"and", "OR", "Not", "NULL", "order", "BY", "group", "having", "limit", "offset",
+		"join", "on", "as", "index", "unique", "default", "is", "in", "between", "like",
+	} {
+		if !IsKeyword(word) {
+			t.Errorf("Expected %q to be a keyword", word)
+		}
+	}
+	for _, word := range []string{"cats", "age", "Zoë", "selected", "", "="} {
+		if IsKeyword(word) {
+			t.Errorf("Expected %q not to be a keyword", word)
+		}
+	}
+
+	tokens := scan_test_tokens(t, `Order BY "order" >= 3`)
+	if !tokens[0].IsKeyword() || !tokens[0].IsKeyword("group", "ORDER") || tokens[0].IsKeyword("by") || tokens[0].IsIdentifier() {
+		t.Errorf("Expected Order to be the keyword ORDER")
+	}
+	if !tokens[1].IsKeyword("by") {
+		t.Errorf("Expected BY to be the keyword BY")
+	}
+	if tokens[2].IsKeyword() || !tokens[2].IsIdentifier() {
+		t.Errorf("Expected a quoted order to be an identifier")
+	}
+	if !tokens[3].IsOperator() || !tokens[3].IsOperator("<=", ">=") || tokens[3].IsOperator("=") || tokens[3].IsKeyword() {
+		t.Errorf("Expected >= to be the operator >=")
+	}
+	if tokens[4].IsOperator() || tokens[4].IsKeyword() || tokens[4].IsIdentifier() {
+		t.Errorf("Expected 3 to be a literal")
+	}
+
+	// Only keywords that mark no structure can stand for names
+	tokens = scan_test_tokens(t, `cats "from" Key INDEX text from where 'cats' 3 ,`)
+	for i, is_name := range []bool{true, true, true, true, true, false, false, false, false, false} {
+		if tokens[i].IsName() != is_name {
+			t.Errorf("Expected IsName of %q to be %v", tokens[i].Val, is_name)
+		}
+	}
+}
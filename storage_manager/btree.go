@@ -1,12 +1,12 @@
 /**
  * B+ Tree Node Structure for SQLite Variant with Doubly Linked Nodes
- * Page size: 4096 bytes (configurable in database header)
+ * Page size: 512-65536 bytes, 4096 by default (fixed per database, see header.go)
  *
  * **Database Metadata Header (100 bytes, file start):**
- * - 0-15: Magic string (16 bytes, "SQLite format 3\0")
- * - 16-17: Page size (uint16_t, 512-65536, e.g., 4096)
- * - 18-19: File format write version (uint16_t, typically 1 or 2)
- * - 20-21: File format read version (uint16_t, typically 1 or 2)
+ * - 0-15: Magic string (16 bytes, "BootsDB format 4", no terminator)
+ * - 16-17: Page size (uint16_t, power of two from 512 to 32768, 1 for 65536)
+ * - 18: File format write version (uint8_t, 1 or 2)
+ * - 19: File format read version (uint8_t, 1 or 2)
  * - 22: Reserved space (uint8_t, usually 0)
  * - 23: Max payload fraction (uint8_t, default 64)
  * - 24: Min payload fraction (uint8_t, default 32)
@@ -27,12 +27,13 @@
  * - 92-95: Version valid for (uint32_t)
  * - 96-99: SQLite version number (uint32_t, e.g., 9999999 for this variant)
  *
- * **Common Node Header (20 bytes):**
- * - 0-3: Page number (uint32_t, unique ID, root init 1)
+ * **Common Node Header (21 bytes):**
+ * - 0-3: Page number (uint32_t, unique ID, root is page 0)
  * - 4: Flags (uint8_t, 0x01 leaf, 0x00 internal)
  * - 5-6: Cell count (uint16_t)
  * - **Leaf Only:**
- *   - 7-8: Cell content offset (uint16_t, init 20)
+ *   - 7-8: Cell content offset (uint16_t, page size when empty, stored mod
+ *     65536 so an empty 64 KiB page records 0)
  *   - 9-10: Free bytes (uint16_t)
  *   - 11-12: Total cell content bytes (uint16_t)
  * - **Internal Only:**
@@ -44,183 +45,783 @@
  *
  * **Leaf Node:**
  * - Flags: 0x01
- * - Cells: Data records (variable size, e.g., key-value tuples)
+ * - Cells: 4-byte key, 4-byte payload size, 2-byte local size, local payload,
+ *   then a 4-byte first overflow page if the payload spilled (see record.go
+ *   and overflow.go)
  * - Sibling Pointers: Next (13-16), Previous (17-20)
  *
  * **Internal Node:**
  * - Flags: 0x00
- * - Cells: (pointer, key) pairs (variable size, e.g., 4-byte child pointer, key)
- * - Rightmost Child: 7-10 (leftmost child in B+-tree convention)
+ * - Cells: (pointer, key) pairs, 4-byte child pointer then 4-byte key
+ * - A cell's child holds keys < its key, the rightmost child holds the rest
+ * - Rightmost Child: 7-10
  * - Sibling Pointers: Next (13-16), Previous (17-20)
  *
  * **Root Node:**
  * - Leaf or internal, per tree height
- * - On page 1, starts at byte 100 after metadata
+ * - Always on page 0, starts at byte 100 after metadata
+ * - A root split moves its cells into two new pages so the root never moves
  *
  * **Slotted Array:**
- * - Pointers: 2-byte offsets from byte 20 (or 100 for root on page 1) up
- * - Data: Cells from cell content offset down, sorted by key
- * - Overflow: Pointers and data meet
+ * - Pointers: 2-byte offsets in key order, from byte 21 (121 on page 0) up
+ * - Data: Cells packed from the end of the page down to the cell content offset
+ * - Overflow: Pointers and data meet, the node splits in half
  */
 
 package storage_manager
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"strings"
+	"math"
+	"slices"
+)
+
+var (
+	ErrDuplicateKey   = errors.New("duplicate key")
+	ErrKeyNotFound    = errors.New("key not found")
+	ErrRecordTooLarge = errors.New("record too large")
 )
 
 type BTree struct {
-	pager *Pager
-	order int
+	pager       *Pager
+	pinned      []*Page      // Pages the running operation holds, released when it returns
+	transaction *Transaction // The open explicit transaction, nil if none
+}
+
+// get_page fetches a page and keeps it pinned until release so the cache
+// can't evict it while the operation still holds a pointer to it
+func (btree *BTree) get_page(page_number int) (*Page, error) {
+	page, err := btree.pager.GetPage(page_number)
+	if err != nil {
+		return nil, err
+	}
+	btree.pinned = append(btree.pinned, page)
+	return page, nil
+}
+
+func (btree *BTree) allocate_page() (*Page, error) {
+	page, err := btree.pager.AllocatePage()
+	if err != nil {
+		return nil, err
+	}
+	btree.pinned = append(btree.pinned, page)
+	return page, nil
+}
+
+// write tells the pager the running operation is about to change pages
+func (btree *BTree) write(pages ...*Page) error {
+	for _, page := range pages {
+		if page == nil {
+			continue
+		}
+		if err := btree.pager.Write(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// begin starts a public operation. Goroutines sharing the connection take
+// turns, and the operation gets the file lock it needs, Shared to read and
+// Reserved to write
+func (btree *BTree) begin(write bool) error {
+	btree.pager.mutex.Lock()
+	var err error
+	if write {
+		err = btree.pager.begin_write()
+	} else {
+		err = btree.pager.begin_read()
+	}
+	if err != nil {
+		btree.pager.unlock()
+		btree.pager.mutex.Unlock()
+	}
+	return err
+}
+
+// end finishes a public operation, unpinning its pages and giving up as much
+// of the file lock as the connection no longer needs. Unlocking only fails if
+// the database file was closed underneath the connection
+func (btree *BTree) end() {
+	btree.release()
+	btree.pager.unlock()
+	btree.pager.mutex.Unlock()
+}
+
+// autocommit ends a write operation made outside a transaction, which is a
+// statement of its own the way it is in SQLite. It commits if the operation
+// succeeded and rolls back if the operation or its commit failed, so the
+// connection never keeps its Reserved lock between statements
+func (btree *BTree) autocommit(err error) error {
+	if btree.transaction != nil {
+		return err
+	}
+	btree.release()
+	if err == nil {
+		err = btree.pager.FlushCache()
+	}
+	if err != nil {
+		if rollback_err := btree.pager.Rollback(); rollback_err != nil {
+			return rollback_err
+		}
+	}
+	return err
+}
+
+// release unpins every page fetched since the last release
+func (btree *BTree) release() {
+	for _, page := range btree.pinned {
+		btree.pager.Unpin(page)
+	}
+	btree.pinned = btree.pinned[:0]
+}
+
+// binary_search returns the first slot in node whose key is >= key, walking
+// the slotted array pointers which are kept in key order, and whether that
+// slot holds key exactly
+func binary_search(node *Page, key uint32) (int, bool, error) {
+	low, high := 0, node.cell_count()
+	for low < high {
+		mid := int(uint(low+high) >> 1)
+		mid_key, err := node.cell_key(mid)
+		if err != nil {
+			return 0, false, err
+		}
+		if mid_key < key {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	if low == node.cell_count() {
+		return low, false, nil
+	}
+	low_key, err := node.cell_key(low)
+	return low, low_key == key, err
+}
+
+// child_index returns the position of the child that owns key, where
+// cell_count means the rightmost child
+func child_index(node *Page, key uint32) (int, error) {
+	i, found, err := binary_search(node, key)
+	if found {
+		// A cell's child only holds keys strictly below the cell's key
+		i += 1
+	}
+	return i, err
+}
+
+func child_at(node *Page, i int) (int, error) {
+	if i == node.cell_count() {
+		return node.rightmost_child(), nil
+	}
+	cell, err := node.cell(i)
+	if err != nil {
+		return 0, err
+	}
+	return internal_cell_child(cell), nil
+}
+
+// find_leaf_node descends from root to the leaf that owns key, returning the
+// pages visited along the way with the leaf last
+func (btree *BTree) find_leaf_node(root *Page, key uint32) ([]*Page, error) {
+	path := []*Page{root}
+	node := root
+	for !node.is_leaf() {
+		i, err := child_index(node, key)
+		if err != nil {
+			return nil, err
+		}
+		child_number, err := child_at(node, i)
+		if err != nil {
+			return nil, err
+		}
+		child, err := btree.get_page(child_number)
+		if err != nil {
+			return nil, err
+		}
+		node = child
+		path = append(path, node)
+	}
+	return path, nil
+}
+
+// find_key returns the path to the leaf owning key and the slot key has, or
+// would have, in that leaf. A nil path means the database is still empty
+func (btree *BTree) find_key(key uint32) ([]*Page, int, bool, error) {
+	root, err := btree.get_page(0)
+	if err != nil || !is_initialized(root) {
+		return nil, 0, false, err
+	}
+	path, err := btree.find_leaf_node(root, key)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	index, found, err := binary_search(path[len(path)-1], key)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return path, index, found, nil
+}
+
+func initialize_database(root *Page) {
+	// Initialize database metadata header (bytes 0-99)
+	header := make([]byte, 100)
+	copy(header[0:16], dbMagic)
+	set_header_page_size(header, len(root.slotted_array)) // Page size
+	header[18] = 1                                        // Write version
+	header[19] = 1                                        // Read version
+	header[22] = 0                                        // Reserved
+	header[23] = 64                                       // Max payload fraction
+	header[24] = 32                                       // Min payload fraction
+	header[25] = 32                                       // Leaf payload fraction
+	binary.BigEndian.PutUint32(header[26:30], 0)          // File change counter
+	binary.BigEndian.PutUint32(header[30:34], 1)          // Database size in pages
+	binary.BigEndian.PutUint32(header[34:38], 0)          // First freelist trunk page
+	binary.BigEndian.PutUint32(header[38:42], 0)          // Freelist page count
+	binary.BigEndian.PutUint32(header[42:46], 0)          // Schema cookie
+	binary.BigEndian.PutUint32(header[46:50], 4)          // Schema format number
+	binary.BigEndian.PutUint32(header[50:54], 0)          // Default cache size
+	binary.BigEndian.PutUint32(header[54:58], 0)          // Largest root page
+	binary.BigEndian.PutUint32(header[58:62], 1)          // Text encoding (UTF-8)
+	binary.BigEndian.PutUint32(header[62:66], 0)          // User version
+	binary.BigEndian.PutUint32(header[66:70], 0)          // Incremental vacuum mode
+	binary.BigEndian.PutUint32(header[70:74], 0)          // Application ID
+	// Reserved bytes 74-91 are zeros
+	binary.BigEndian.PutUint32(header[92:96], 0)        // Version valid for
+	binary.BigEndian.PutUint32(header[96:100], 9999999) // SQLite version number
+	copy(root.slotted_array[0:100], header)
+
+	// Initialize node header (bytes 100-120) as an empty leaf
+	root.init_node(leafFlag)
+}
+
+// new_leaf_cell encodes values into a cell, spilling large payloads into
+// overflow pages
+func (btree *BTree) new_leaf_cell(key uint32, values []any) ([]byte, error) {
+	payload, err := encode_record(values)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(payload)) > math.MaxUint32 {
+		return nil, ErrRecordTooLarge
+	}
+	return btree.build_leaf_cell(key, payload)
+}
+
+func (btree *BTree) Insert(key uint32, values []any) error {
+	if err := btree.begin(true); err != nil {
+		return err
+	}
+	defer btree.end()
+	return btree.autocommit(btree.insert(key, values))
+}
+
+func (btree *BTree) insert(key uint32, values []any) error {
+	root, err := btree.get_page(0)
+	if err != nil {
+		return err
+	}
+	if err := btree.initialize_root(root); err != nil {
+		return err
+	}
+
+	path, index, found, err := btree.find_key(key)
+	if err != nil {
+		return err
+	}
+	if found {
+		return ErrDuplicateKey
+	}
+	cell, err := btree.new_leaf_cell(key, values)
+	if err != nil {
+		return err
+	}
+
+	cells, err := path[len(path)-1].cells()
+	if err != nil {
+		return err
+	}
+	return btree.store_cells(path, slices.Insert(cells, index, cell))
+}
+
+// Get returns the record stored under key
+func (btree *BTree) Get(key uint32) (*Record, error) {
+	if err := btree.begin(false); err != nil {
+		return nil, err
+	}
+	defer btree.end()
+
+	path, index, found, err := btree.find_key(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+	cell, err := path[len(path)-1].cell(index)
+	if err != nil {
+		return nil, err
+	}
+	return btree.decode_record(cell)
+}
+
+// store_cells writes cells into the last node of path, splitting it and
+// promoting a separator into its parent when they no longer fit
+func (btree *BTree) store_cells(path []*Page, cells [][]byte) error {
+	node := path[len(path)-1]
+	if err := btree.write(node); err != nil {
+		return err
+	}
+	if node.cells_fit(cells) {
+		node.write_cells(cells)
+		return nil
+	}
+	if len(path) == 1 {
+		return btree.split_root(node, cells)
+	}
+	return btree.split_and_insert(path, cells)
+}
+
+// split_point picks the index that divides cells into two halves of roughly
+// equal byte size, leaving at least one cell on each side
+func split_point(cells [][]byte) int {
+	half := cells_size(cells) / 2
+	size := 0
+	for i, cell := range cells {
+		size += len(cell) + 2
+		if size >= half {
+			return min(max(i, 1), len(cells)-2)
+		}
+	}
+	return len(cells) / 2
+}
+
+// divide splits cells of a node into its left and right halves along with
+// the separator key to promote. For leaves the separator is copied up from
+// the first right cell, for internal nodes the middle cell moves up and its
+// child becomes the left half's rightmost child
+func divide(node *Page, cells [][]byte) (left [][]byte, right [][]byte, separator uint32, left_rightmost int) {
+	mid := split_point(cells)
+	if node.is_leaf() {
+		mid = max(mid, 1)
+		return cells[:mid], cells[mid:], leaf_cell_key(cells[mid]), 0
+	}
+	return cells[:mid], cells[mid+1:], internal_cell_key(cells[mid]), internal_cell_child(cells[mid])
+}
+
+func (btree *BTree) split_and_insert(path []*Page, cells [][]byte) error {
+	node := path[len(path)-1]
+	parent := path[len(path)-2]
+	flags := node.slotted_array[node.header_offset()+4]
+	left, right_cells, separator, left_rightmost := divide(node, cells)
+
+	right, err := btree.allocate_page()
+	if err != nil {
+		return err
+	}
+	var next *Page
+	if node.next_sibling() != 0 {
+		if next, err = btree.get_page(node.next_sibling()); err != nil {
+			return err
+		}
+	}
+
+	if err := btree.write(node, next, parent); err != nil {
+		return err
+	}
+
+	right.init_node(flags)
+	right.write_cells(right_cells)
+	node.write_cells(left)
+	if !node.is_leaf() {
+		right.set_rightmost_child(node.rightmost_child())
+		node.set_rightmost_child(left_rightmost)
+	}
+
+	// Splice the new node into the sibling list right after node
+	right.set_next_sibling(node.next_sibling())
+	right.set_prev_sibling(node.page_number)
+	if next != nil {
+		next.set_prev_sibling(right.page_number)
+	}
+	node.set_next_sibling(right.page_number)
+
+	// node keeps the keys below separator, right takes over node's old slot
+	parent_cells, err := parent.cells()
+	if err != nil {
+		return err
+	}
+	N := len(parent_cells)
+	i := slices.IndexFunc(parent_cells, func(cell []byte) bool {
+		return internal_cell_child(cell) == node.page_number
+	})
+	if i == -1 {
+		i = N
+		parent.set_rightmost_child(right.page_number)
+	} else {
+		binary.BigEndian.PutUint32(parent_cells[i][0:4], uint32(right.page_number))
+	}
+	parent_cells = slices.Insert(parent_cells, i, internal_cell(node.page_number, separator))
+	return btree.store_cells(path[:len(path)-1], parent_cells)
+}
+
+// split_root moves the root's cells into two new children and turns the root
+// into an internal node pointing at them, growing the tree by one level
+func (btree *BTree) split_root(root *Page, cells [][]byte) error {
+	flags := root.slotted_array[root.header_offset()+4]
+	left_cells, right_cells, separator, left_rightmost := divide(root, cells)
+
+	left, err := btree.allocate_page()
+	if err != nil {
+		return err
+	}
+	right, err := btree.allocate_page()
+	if err != nil {
+		return err
+	}
+	if err := btree.write(root); err != nil {
+		return err
+	}
+	left.init_node(flags)
+	right.init_node(flags)
+	left.write_cells(left_cells)
+	right.write_cells(right_cells)
+	if flags == internalFlag {
+		left.set_rightmost_child(left_rightmost)
+		right.set_rightmost_child(root.rightmost_child())
+	}
+	left.set_next_sibling(right.page_number)
+	right.set_prev_sibling(left.page_number)
+
+	root.init_node(internalFlag)
+	root.write_cells([][]byte{internal_cell(left.page_number, separator)})
+	root.set_rightmost_child(right.page_number)
+	return nil
+}
+
+// Update replaces the record stored under key. A new cell no larger than the
+// existing one always fits back into its leaf, anything bigger goes back
+// through store_cells so the leaf can split if it must
+func (btree *BTree) Update(key uint32, values []any) error {
+	if err := btree.begin(true); err != nil {
+		return err
+	}
+	defer btree.end()
+	return btree.autocommit(btree.update(key, values))
+}
+
+func (btree *BTree) update(key uint32, values []any) error {
+	path, index, found, err := btree.find_key(key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrKeyNotFound
+	}
+
+	new_cell, err := btree.new_leaf_cell(key, values)
+	if err != nil {
+		return err
+	}
+
+	leaf := path[len(path)-1]
+	cell, err := leaf.cell(index)
+	if err != nil {
+		return err
+	}
+	if err := btree.free_overflow(cell); err != nil {
+		return err
+	}
+	cells, err := leaf.cells()
+	if err != nil {
+		return err
+	}
+	cells[index] = new_cell
+	if len(new_cell) <= len(cell) {
+		// Rewriting the whole leaf keeps its free and content byte counts right
+		if err := btree.write(leaf); err != nil {
+			return err
+		}
+		leaf.write_cells(cells)
+		return nil
+	}
+	return btree.store_cells(path, cells)
+}
+
+// Delete removes the record stored under key
+func (btree *BTree) Delete(key uint32) error {
+	if err := btree.begin(true); err != nil {
+		return err
+	}
+	defer btree.end()
+	return btree.autocommit(btree.delete(key))
+}
+
+func (btree *BTree) delete(key uint32) error {
+	path, index, found, err := btree.find_key(key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrKeyNotFound
+	}
+
+	leaf := path[len(path)-1]
+	cells, err := leaf.cells()
+	if err != nil {
+		return err
+	}
+	if err := btree.free_overflow(cells[index]); err != nil {
+		return err
+	}
+	if err := btree.write(leaf); err != nil {
+		return err
+	}
+	leaf.write_cells(slices.Delete(cells, index, index+1))
+	return btree.rebalance(path)
+}
+
+// Clear deletes every record at once and puts every page but the root on
+// the freelist. With a single tree in the database this is what dropping its
+// table comes down to
+func (btree *BTree) Clear() error {
+	if err := btree.begin(true); err != nil {
+		return err
+	}
+	defer btree.end()
+	return btree.autocommit(btree.clear())
 }
 
-func (btree *BTree) binary_search(page *Pager) {
+func (btree *BTree) clear() error {
+	root, err := btree.get_page(0)
+	if err != nil {
+		return err
+	}
+	if err := btree.free_subtree(root); err != nil {
+		return err
+	}
+	if err := btree.write(root); err != nil {
+		return err
+	}
+	root.init_node(leafFlag)
+	return nil
+}
 
+// free_subtree puts every page below node and every overflow chain its
+// leaves reach on the freelist. Pages are let go of as soon as they're freed
+// so dropping a big tree doesn't pin all of it
+func (btree *BTree) free_subtree(node *Page) error {
+	if node.is_leaf() {
+		for i := 0; i < node.cell_count(); i++ {
+			cell, err := node.cell(i)
+			if err != nil {
+				return err
+			}
+			if err := btree.free_overflow(cell); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := 0; i <= node.cell_count(); i++ {
+		child_number, err := child_at(node, i)
+		if err != nil {
+			return err
+		}
+		child, err := btree.pager.GetPage(child_number)
+		if err != nil {
+			return err
+		}
+		err = btree.free_subtree(child)
+		if err == nil {
+			err = btree.pager.FreePage(child)
+		}
+		btree.pager.Unpin(child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (btree *BTree) find_leaf_node(root *Page, key uint32) *Page {
+// rebalance fixes up the last node of path after cells were removed from it.
+// A node below a third full borrows from or merges with a sibling under the
+// same parent, and merges ripple up through the parent's separators
+func (btree *BTree) rebalance(path []*Page) error {
+	node := path[len(path)-1]
+	if len(path) == 1 {
+		return btree.collapse_root(node)
+	}
+	if node.used_space() >= node.usable_space()/3 {
+		return nil
+	}
+
+	parent := path[len(path)-2]
+	if parent.cell_count() == 0 {
+		// node is an only child, which only happens right under the root
+		return btree.collapse_root(parent)
+	}
+
+	// Pair node with its left sibling, or its right one when node is first
+	parent_cells, err := parent.cells()
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(parent_cells, func(cell []byte) bool {
+		return internal_cell_child(cell) == node.page_number
+	})
+	if i == -1 {
+		i = len(parent_cells)
+	}
+	separator_index := max(i-1, 0)
+	left_number, err := child_at(parent, separator_index)
+	if err != nil {
+		return err
+	}
+	right_number, err := child_at(parent, separator_index+1)
+	if err != nil {
+		return err
+	}
+	left, err := btree.get_page(left_number)
+	if err != nil {
+		return err
+	}
+	right, err := btree.get_page(right_number)
+	if err != nil {
+		return err
+	}
+	separator := internal_cell_key(parent_cells[separator_index])
+	if err := btree.write(parent, left, right); err != nil {
+		return err
+	}
+
+	cells, err := left.cells()
+	if err != nil {
+		return err
+	}
+	if !left.is_leaf() {
+		// The separator comes down to sit between the two halves
+		cells = append(cells, internal_cell(left.rightmost_child(), separator))
+	}
+	right_cells, err := right.cells()
+	if err != nil {
+		return err
+	}
+	cells = append(cells, right_cells...)
+
+	if left.cells_fit(cells) {
+		if err := btree.merge(parent, parent_cells, separator_index, left, right, cells); err != nil {
+			return err
+		}
+		return btree.rebalance(path[:len(path)-1])
+	}
 
+	// Redistribute the pair evenly and refresh the separator between them
+	left_cells, right_cells, new_separator, left_rightmost := divide(left, cells)
+	left.write_cells(left_cells)
+	right.write_cells(right_cells)
+	if !left.is_leaf() {
+		left.set_rightmost_child(left_rightmost)
+	}
+	binary.BigEndian.PutUint32(parent_cells[separator_index][4:8], new_separator)
+	parent.write_cells(parent_cells)
+	return nil
 }
 
-func (btree *BTree) Insert(username string, email string) {
-	root := btree.pager.get_root()
-	key := binary.BigEndian.Uint32(root.slotted_array[16:20])
-	leafNode := btree.find_leaf_node(root, key)             // Traverse to leaf using the key
-	N := binary.BigEndian.Uint16(leafNode.slotted_array[6:8]) // Number of cells in the leaf
-	pageFull := N >= uint16(btree.order-1)                    // Max keys = order - 1
-	if pageFull {
-		btree.split_and_insert(leafNode, username, email)
+// merge folds right into left and drops the separator between them from
+// parent, unlinking right from the sibling list
+func (btree *BTree) merge(parent *Page, parent_cells [][]byte, separator_index int, left *Page, right *Page, cells [][]byte) error {
+	var next *Page
+	if right.next_sibling() != 0 {
+		var err error
+		if next, err = btree.get_page(right.next_sibling()); err != nil {
+			return err
+		}
+	}
+	if err := btree.write(next); err != nil {
+		return err
+	}
+
+	left.write_cells(cells)
+	if !left.is_leaf() {
+		left.set_rightmost_child(right.rightmost_child())
+	}
+
+	left.set_next_sibling(right.next_sibling())
+	if next != nil {
+		next.set_prev_sibling(left.page_number)
+	}
+
+	// Whatever pointed at right now points at left
+	if separator_index+1 < len(parent_cells) {
+		binary.BigEndian.PutUint32(parent_cells[separator_index+1][0:4], uint32(left.page_number))
 	} else {
-		btree.insert_into_page_slot(leafNode, username, email)
-	}
-}
-
-func (btree *BTree) Insert(username string, email string) {
-    root := btree.pager.get_root()
-
-    // Check if this is an initialized page by looking for SQLite header
-    isInitialized := string(root.slotted_array[0:16]) == "BootsDB format 3"
-
-    node_header_offset := 100 // For root page
-	common_node_header := 20
-	var free_bytes int
-    
-    if !isInitialized {
-        // Initialize database metadata header (bytes 0-99)
-        header := make([]byte, 100)
-        copy(header[0:16], []byte("BootsDB format 3\000"))
-        binary.BigEndian.PutUint16(header[16:18], 4096) // Page size
-        header[18] = 1 // Write version
-        header[19] = 1 // Read version
-        header[22] = 0 // Reserved
-        header[23] = 64 // Max payload fraction
-        header[24] = 32 // Min payload fraction
-        header[25] = 32 // Leaf payload fraction
-        binary.BigEndian.PutUint32(header[26:30], 0) // File change counter
-        binary.BigEndian.PutUint32(header[30:34], 1) // Database size in pages
-        binary.BigEndian.PutUint32(header[34:38], 0) // First freelist trunk page
-        binary.BigEndian.PutUint32(header[38:42], 0) // Freelist page count
-        binary.BigEndian.PutUint32(header[42:46], 0) // Schema cookie
-        binary.BigEndian.PutUint32(header[46:50], 4) // Schema format number
-        binary.BigEndian.PutUint32(header[50:54], 0) // Default cache size
-        binary.BigEndian.PutUint32(header[54:58], 0) // Largest root page
-        binary.BigEndian.PutUint32(header[58:62], 1) // Text encoding (UTF-8)
-        binary.BigEndian.PutUint32(header[62:66], 0) // User version
-        binary.BigEndian.PutUint32(header[66:70], 0) // Incremental vacuum mode
-        binary.BigEndian.PutUint32(header[70:74], 0) // Application ID
-        // Reserved bytes 74-91 are zeros
-        binary.BigEndian.PutUint32(header[92:96], 0) // Version valid for
-        binary.BigEndian.PutUint32(header[96:100], 9999999) // SQLite version number
-        copy(root.slotted_array[0:100], header)
-
-        // Initialize node header (bytes 100-120)
-        node_header := make([]byte, 21)
-        binary.BigEndian.PutUint32(node_header[0:4], 1) // Page number = 1 for root
-        node_header[4] = 0x01 // Flags: leaf node
-        binary.BigEndian.PutUint16(node_header[5:7], 0) // Cell count
-        binary.BigEndian.PutUint16(node_header[7:9], 4096) // Cell content offset
-        free_bytes = 4096 - 120 // 100 metadata + 20 node header
-        binary.BigEndian.PutUint16(node_header[9:11], uint16(free_bytes))
-        binary.BigEndian.PutUint16(node_header[11:13], 0) // Total cell content bytes
-        binary.BigEndian.PutUint32(node_header[13:17], 0) // Next sibling
-        binary.BigEndian.PutUint32(node_header[17:21], 0) // Previous sibling
-        copy(root.slotted_array[100:121], node_header)
-    }    
-    // Get current number of cells
-    N := binary.BigEndian.Uint16(root.slotted_array[node_header_offset+5:node_header_offset+7])
-    
-    // Get current cell content offset
-    C := binary.BigEndian.Uint16(root.slotted_array[node_header_offset+7:node_header_offset+9])
-
-    payloadSize := uint16(32 + 255)      // 287 bytes
-    tupleSize := uint32(2 + payloadSize) // 289 bytes
-
-    // Calculate tuple offset
-    tupleOffset := uint32(C) - tupleSize
-
-    // Calculate pointer offset for the new cell
-    pointerOffset := uint32(node_header_offset + common_node_header + 2*int(N))
-
-    // Check if page is full
-    if tupleOffset < pointerOffset+2 {
-        fmt.Println("Page Overflow")
-        return
-    }
-
-    // Build tuple
-    tuple := make([]byte, tupleSize)
-    binary.BigEndian.PutUint16(tuple[0:2], payloadSize)
-    username32 := make([]byte, 32)
-    email255 := make([]byte, 255)
-    copy(username32, []byte(username))
-    copy(email255, []byte(email))
-    copy(tuple[2:34], username32)
-    copy(tuple[34:], email255)
-
-	order := free_bytes / (2 + 255 + 32)
-	btree.order = order
-
-    // Set pointer
-    binary.BigEndian.PutUint16(root.slotted_array[pointerOffset:pointerOffset+2], uint16(tupleOffset))
-
-    // Copy tuple
-    copy(root.slotted_array[tupleOffset:tupleOffset+tupleSize], tuple)
-
-    // Update header
-    binary.BigEndian.PutUint16(root.slotted_array[node_header_offset+5:node_header_offset+7], N+1)
-    binary.BigEndian.PutUint16(root.slotted_array[node_header_offset+7:node_header_offset+9], uint16(tupleOffset))
-    
-    // Calculate new free bytes
-    newFreeBytes := tupleOffset - (uint32(node_header_offset+20) + 2*uint32(N+1))
-    binary.BigEndian.PutUint16(root.slotted_array[node_header_offset+9:node_header_offset+11], uint16(newFreeBytes))
-    
-    // Update total cell content bytes
-    totalCellContent := binary.BigEndian.Uint16(root.slotted_array[node_header_offset+11:node_header_offset+13]) + uint16(tupleSize)
-    binary.BigEndian.PutUint16(root.slotted_array[node_header_offset+11:node_header_offset+13], totalCellContent)
-
-    // Mark page as dirty
-    root.dirty = true
-}
-
-func (btree *BTree) Select() {
-    root := btree.pager.get_root()
-    node_header_offset := 100
-    pageNumber := binary.BigEndian.Uint32(root.slotted_array[node_header_offset:node_header_offset+4])
-    fmt.Println("Reading from page number:", pageNumber)
-    N := binary.BigEndian.Uint16(root.slotted_array[node_header_offset+5:node_header_offset+7])
-    tupleSize := 289
-
-    // Iterate through cells with proper bounds checking
-    for i := 0; i < int(N); i++ {
-        pointerOffset := uint32(node_header_offset + 20 + 2*i)
-        pointerOffsetValue := binary.BigEndian.Uint16(root.slotted_array[pointerOffset:pointerOffset+2])
-        disk_tuple := root.slotted_array[int(pointerOffsetValue):int(pointerOffsetValue)+tupleSize]
-        username := strings.TrimRight(string(disk_tuple[2:34]), "\x00")
-        email := strings.TrimRight(string(disk_tuple[34:34+255]), "\x00")
-        fmt.Printf("Key: %d, Username: %s, Email: %s\n", i, username, email)
-    }
+		parent.set_rightmost_child(left.page_number)
+	}
+	parent.write_cells(slices.Delete(parent_cells, separator_index, separator_index+1))
+	return btree.pager.FreePage(right)
+}
+
+// collapse_root pulls the only child of an emptied internal root up into the
+// root page, shrinking the tree by a level. The child is left alone if its
+// cells don't fit next to the metadata header on page 0
+func (btree *BTree) collapse_root(root *Page) error {
+	for !root.is_leaf() && root.cell_count() == 0 {
+		child, err := btree.get_page(root.rightmost_child())
+		if err != nil {
+			return err
+		}
+		cells, err := child.cells()
+		if err != nil {
+			return err
+		}
+		if !root.cells_fit(cells) {
+			return nil
+		}
+		if err := btree.write(root); err != nil {
+			return err
+		}
+		flags := child.slotted_array[child.header_offset()+4]
+		rightmost := child.rightmost_child()
+		root.init_node(flags)
+		root.write_cells(cells)
+		if flags == internalFlag {
+			root.set_rightmost_child(rightmost)
+		}
+		if err := btree.pager.FreePage(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (btree *BTree) Select() error {
+	cursor := btree.NewCursor()
+	defer cursor.Close()
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		record, err := cursor.Record()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Key: %d, Values: %v\n", record.Key, record.Values)
+	}
+	return cursor.Err
+}
+
+// Close writes out everything the tree changed and closes the database. An
+// explicit transaction that is still open is rolled back instead
+func (btree *BTree) Close() error {
+	if btree.transaction != nil {
+		if err := btree.transaction.Rollback(); err != nil {
+			return err
+		}
+	}
+	btree.pager.mutex.Lock()
+	defer btree.pager.mutex.Unlock()
+	return btree.pager.Close()
 }
 
 func InitializeBtree(pager_struct *Pager) *BTree {
@@ -0,0 +1,402 @@
+package storage_manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func open_test_btree(t *testing.T, file_name string) *BTree {
+	t.Helper()
+	return open_test_btree_in_mode(t, file_name, JournalModeWAL)
+}
+
+func open_test_btree_in_mode(t *testing.T, file_name string, mode JournalMode) *BTree {
+	t.Helper()
+	storage, err := InitializeStorage(file_name, mode)
+	if err != nil {
+		t.Fatalf("InitializeStorage: %v", err)
+	}
+	t.Cleanup(func() {
+		close_files(storage)
+	})
+	return InitializeBtree(InitializePager(storage))
+}
+
+// close_files drops a connection without flushing, checkpointing or rolling
+// anything back, giving up its locks the way a killed process would
+func close_files(storage *Storage) {
+	if storage.inode == nil {
+		return
+	}
+	switch journal := storage.journal.(type) {
+	case *wal:
+		journal.file.Close()
+	case *rollback_journal:
+		if journal.file != nil {
+			journal.file.Close()
+		}
+	}
+	storage.unlock(noLock)
+	storage.inode.close()
+	storage.inode = nil
+}
+
+func get_test_page(t *testing.T, btree *BTree, page_number int) *Page {
+	t.Helper()
+	page, err := btree.pager.GetPage(page_number)
+	if err != nil {
+		t.Fatalf("GetPage(%d): %v", page_number, err)
+	}
+	return page
+}
+
+func test_cell(t *testing.T, node *Page, i int) []byte {
+	t.Helper()
+	cell, err := node.cell(i)
+	if err != nil {
+		t.Fatalf("Page %d cell %d: %v", node.page_number, i, err)
+	}
+	return cell
+}
+
+func test_cell_key(t *testing.T, node *Page, i int) uint32 {
+	t.Helper()
+	key, err := node.cell_key(i)
+	if err != nil {
+		t.Fatalf("Page %d cell %d: %v", node.page_number, i, err)
+	}
+	return key
+}
+
+func test_child_at(t *testing.T, node *Page, i int) int {
+	t.Helper()
+	child, err := child_at(node, i)
+	if err != nil {
+		t.Fatalf("Page %d child %d: %v", node.page_number, i, err)
+	}
+	return child
+}
+
+// leftmost_leaf follows the first child of every internal node down to the
+// leaf holding the smallest keys
+func leftmost_leaf(t *testing.T, btree *BTree) *Page {
+	t.Helper()
+	node := get_test_page(t, btree, 0)
+	for !node.is_leaf() {
+		node = get_test_page(t, btree, test_child_at(t, node, 0))
+	}
+	return node
+}
+
+// collect_keys walks the leaf level through the sibling pointers
+func collect_keys(t *testing.T, btree *BTree) []uint32 {
+	var keys []uint32
+	for leaf := leftmost_leaf(t, btree); ; leaf = get_test_page(t, btree, leaf.next_sibling()) {
+		for i := 0; i < leaf.cell_count(); i++ {
+			keys = append(keys, test_cell_key(t, leaf, i))
+		}
+		if leaf.next_sibling() == 0 {
+			return keys
+		}
+	}
+}
+
+func tree_height(t *testing.T, btree *BTree) int {
+	height := 1
+	for node := get_test_page(t, btree, 0); !node.is_leaf(); node = get_test_page(t, btree, test_child_at(t, node, 0)) {
+		height += 1
+	}
+	return height
+}
+
+func TestInsertSplitsLeavesAndRoot(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+
+	// Wide rows keep leaves small so the root has to split a second time
+	const N = 20000
+	padding := strings.Repeat("x", 250)
+	transaction, _ := btree.Begin()
+	for _, key := range rand.New(rand.NewSource(1)).Perm(N) {
+		if err := transaction.Insert(uint32(key), []any{fmt.Sprintf("user%d", key), padding}); err != nil {
+			t.Fatalf("Insert(%d): %v", key, err)
+		}
+	}
+	if err := transaction.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	keys := collect_keys(t, btree)
+	if len(keys) != N {
+		t.Fatalf("Expected %d keys, got %d", N, len(keys))
+	}
+	for i, key := range keys {
+		if key != uint32(i) {
+			t.Fatalf("Key %d out of order: got %d", i, key)
+		}
+	}
+	if height := tree_height(t, btree); height < 3 {
+		t.Errorf("Expected the root to split more than once, got height %d", height)
+	}
+
+	if err := btree.Insert(7, []any{"dup", "dup@example.com"}); err != ErrDuplicateKey {
+		t.Errorf("Expected ErrDuplicateKey, got %v", err)
+	}
+}
+
+func TestSiblingPointersAreDoublyLinked(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	for key := 500; key > 0; key-- {
+		btree.Insert(uint32(key), []any{"user", "user@example.com"})
+	}
+
+	prev := 0
+	for leaf := leftmost_leaf(t, btree); ; leaf = get_test_page(t, btree, leaf.next_sibling()) {
+		if leaf.prev_sibling() != prev {
+			t.Fatalf("Page %d has previous sibling %d, expected %d", leaf.page_number, leaf.prev_sibling(), prev)
+		}
+		prev = leaf.page_number
+		if leaf.next_sibling() == 0 {
+			break
+		}
+	}
+}
+
+func TestMultiLevelTreePersists(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	for key := 0; key < 300; key++ {
+		btree.Insert(uint32(key), []any{"user", "user@example.com"})
+	}
+	btree.pager.FlushCache()
+
+	reopened := open_test_btree(t, file_name)
+	if keys := collect_keys(t, reopened); len(keys) != 300 {
+		t.Fatalf("Expected 300 keys after reopening, got %d", len(keys))
+	}
+	if err := reopened.Insert(300, []any{"user", "user@example.com"}); err != nil {
+		t.Fatalf("Insert after reopening: %v", err)
+	}
+	if keys := collect_keys(t, reopened); len(keys) != 301 {
+		t.Errorf("Expected 301 keys, got %d", len(keys))
+	}
+}
+
+func TestGetDescendsToKey(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	if _, err := btree.Get(1); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound on an empty database, got %v", err)
+	}
+
+	for _, key := range rand.New(rand.NewSource(2)).Perm(5000) {
+		btree.Insert(uint32(key*2), []any{fmt.Sprintf("user%d", key*2), fmt.Sprintf("user%d@example.com", key*2)})
+	}
+
+	for key := 0; key < 10000; key++ {
+		record, err := btree.Get(uint32(key))
+		if key%2 == 1 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("Get(%d): expected ErrKeyNotFound, got %v", key, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Get(%d): %v", key, err)
+		}
+		want := Record{Key: uint32(key), Values: []any{fmt.Sprintf("user%d", key), fmt.Sprintf("user%d@example.com", key)}}
+		if !reflect.DeepEqual(*record, want) {
+			t.Fatalf("Get(%d) = %+v, expected %+v", key, *record, want)
+		}
+	}
+}
+
+// check_node verifies every key under node falls in [low, high) and returns
+// the depth of its leaves, failing if they sit at different depths
+func check_node(t *testing.T, btree *BTree, node *Page, low uint64, high uint64) int {
+	t.Helper()
+	N := node.cell_count()
+	if node.page_number != 0 && N == 0 {
+		t.Fatalf("Non-root page %d is empty", node.page_number)
+	}
+	for i := 0; i < N; i++ {
+		key := uint64(test_cell_key(t, node, i))
+		if key < low || key >= high || (i > 0 && uint64(test_cell_key(t, node, i-1)) >= key) {
+			t.Fatalf("Page %d key %d out of range [%d, %d)", node.page_number, key, low, high)
+		}
+	}
+	if node.is_leaf() {
+		return 1
+	}
+
+	depth := 0
+	for i := 0; i <= N; i++ {
+		child_low, child_high := low, high
+		if i > 0 {
+			child_low = uint64(test_cell_key(t, node, i-1))
+		}
+		if i < N {
+			child_high = uint64(test_cell_key(t, node, i))
+		}
+		child_depth := check_node(t, btree, get_test_page(t, btree, test_child_at(t, node, i)), child_low, child_high)
+		if depth != 0 && child_depth != depth {
+			t.Fatalf("Page %d has leaves at depths %d and %d", node.page_number, depth, child_depth)
+		}
+		depth = child_depth
+	}
+	return depth + 1
+}
+
+func TestDeleteRebalancesAndCollapsesRoot(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	if err := btree.Delete(1); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound on an empty database, got %v", err)
+	}
+
+	const N = 8000
+	random := rand.New(rand.NewSource(3))
+	transaction, _ := btree.Begin()
+	for _, key := range random.Perm(N) {
+		transaction.Insert(uint32(key), []any{fmt.Sprintf("user%d", key), "user@example.com"})
+	}
+	transaction.Commit()
+
+	order := random.Perm(N)
+	for n, key := range order {
+		if err := btree.Delete(uint32(key)); err != nil {
+			t.Fatalf("Delete(%d): %v", key, err)
+		}
+		if n%1000 == 0 {
+			check_node(t, btree, get_test_page(t, btree, 0), 0, 1<<32)
+		}
+		if n == N/2 {
+			remaining := collect_keys(t, btree)
+			if len(remaining) != N/2-1 {
+				t.Fatalf("Expected %d keys halfway through, got %d", N/2-1, len(remaining))
+			}
+			cursor, backward := btree.NewCursor(), 0
+			for ok := cursor.Last(); ok; ok = cursor.Prev() {
+				backward += 1
+			}
+			if backward != len(remaining) {
+				t.Fatalf("Backward scan saw %d keys, forward scan saw %d", backward, len(remaining))
+			}
+			for _, key := range order[n+1:] {
+				if _, err := btree.Get(uint32(key)); err != nil {
+					t.Fatalf("Get(%d) after deletes: %v", key, err)
+				}
+			}
+		}
+	}
+
+	if err := btree.Delete(uint32(order[0])); err != ErrKeyNotFound {
+		t.Errorf("Deleting twice should return ErrKeyNotFound, got %v", err)
+	}
+	root := get_test_page(t, btree, 0)
+	if !root.is_leaf() || root.cell_count() != 0 {
+		t.Errorf("Expected an empty leaf root after deleting everything")
+	}
+
+	// The emptied tree is still usable
+	if err := btree.Insert(42, []any{"user", "user@example.com"}); err != nil {
+		t.Fatalf("Insert after emptying: %v", err)
+	}
+	if record, err := btree.Get(42); err != nil || record.Key != 42 {
+		t.Errorf("Get(42) = %v, %v", record, err)
+	}
+}
+
+func TestUpdateRewritesRecord(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	if err := btree.Update(1, []any{"user", "user@example.com"}); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound on an empty database, got %v", err)
+	}
+
+	for key := 0; key < 500; key++ {
+		btree.Insert(uint32(key), []any{fmt.Sprintf("user%d", key), "user@example.com"})
+	}
+	for key := 0; key < 500; key += 3 {
+		if err := btree.Update(uint32(key), []any{fmt.Sprintf("renamed%d", key), "new@example.com"}); err != nil {
+			t.Fatalf("Update(%d): %v", key, err)
+		}
+	}
+	if err := btree.Update(500, []any{"user", "user@example.com"}); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for a missing key, got %v", err)
+	}
+	btree.pager.FlushCache()
+
+	reopened := open_test_btree(t, file_name)
+	for key := 0; key < 500; key++ {
+		record, err := reopened.Get(uint32(key))
+		if err != nil {
+			t.Fatalf("Get(%d): %v", key, err)
+		}
+		want := Record{Key: uint32(key), Values: []any{fmt.Sprintf("user%d", key), "user@example.com"}}
+		if key%3 == 0 {
+			want = Record{Key: uint32(key), Values: []any{fmt.Sprintf("renamed%d", key), "new@example.com"}}
+		}
+		if !reflect.DeepEqual(*record, want) {
+			t.Fatalf("Get(%d) = %+v, expected %+v", key, *record, want)
+		}
+	}
+}
+
+func TestShrinkingUpdateFreesSpace(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	for key := 0; key < 10; key++ {
+		btree.Insert(uint32(key), []any{strings.Repeat("long name ", 20)})
+	}
+	if err := btree.Update(5, []any{"short"}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	root := get_test_page(t, btree, 0)
+	defer btree.pager.Unpin(root)
+	cells, err := root.cells()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free := root.usable_space() - cells_size(cells); root.free_bytes() != free {
+		t.Errorf("Expected %d free bytes after the update, the header records %d", free, root.free_bytes())
+	}
+	if content := cells_size(cells) - 2*len(cells); root.field16(11) != content {
+		t.Errorf("Expected %d bytes of cell content, the header records %d", content, root.field16(11))
+	}
+}
+
+func TestDamagedCellsAreCorrupt(t *testing.T) {
+	for name, damage := range map[string]func(root *Page){
+		"pointer": func(root *Page) { binary.BigEndian.PutUint16(root.slotted_array[121+2*3:], 0xFFFF) },
+		"cell header": func(root *Page) {
+			binary.BigEndian.PutUint16(root.slotted_array[121+2*3:], uint16(len(root.slotted_array)-4))
+		},
+		"local size": func(root *Page) { binary.BigEndian.PutUint16(test_cell(t, root, 3)[8:10], 60000) },
+		"cell count": func(root *Page) { root.set_field16(5, 60000) },
+		"flags":      func(root *Page) { root.slotted_array[104] = 7 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+			for key := 0; key < 10; key++ {
+				if err := btree.Insert(uint32(key), []any{fmt.Sprintf("user%d", key)}); err != nil {
+					t.Fatalf("Insert(%d): %v", key, err)
+				}
+			}
+			root := get_test_page(t, btree, 0)
+			damage(root)
+			btree.pager.Unpin(root)
+
+			if _, err := btree.Range(0, 100); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Range: expected ErrCorrupt, got %v", err)
+			}
+			if err := btree.Insert(100, []any{"user100"}); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Insert: expected ErrCorrupt, got %v", err)
+			}
+		})
+	}
+}
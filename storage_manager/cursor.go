@@ -0,0 +1,295 @@
+// A cursor walks the leaf level of the B+ tree in key order using the
+// next/previous sibling pointers kept in every leaf header. The current leaf
+// stays pinned in the page cache, and the connection keeps its Shared lock,
+// until the cursor moves off the tree or is closed. Writes on the connection
+// can split, merge or free that leaf, so like SQLite's saveCursorPosition the
+// cursor remembers its key and seeks back to it once the tree has changed
+package storage_manager
+
+import "math"
+
+type Cursor struct {
+	Err error // First error hit while moving, the cursor stays invalid after it
+
+	btree *BTree
+	leaf  *Page // nil once the cursor runs off either end of the tree
+	index int   // Slot of the current cell within leaf
+
+	key     uint32 // Key of the current cell, to seek back to after a change
+	changes uint64 // The pager's change count when the cursor last moved
+
+	lower uint32 // Smallest key the cursor will return
+	upper uint32 // Largest key the cursor will return
+}
+
+// NewCursor returns an unpositioned cursor over the whole key range
+func (btree *BTree) NewCursor() *Cursor {
+	return &Cursor{
+		btree: btree,
+		lower: 0,
+		upper: math.MaxUint32,
+	}
+}
+
+// SetBounds limits the cursor to keys between lower and upper inclusive
+func (cursor *Cursor) SetBounds(lower uint32, upper uint32) {
+	cursor.lower = lower
+	cursor.upper = upper
+}
+
+// Valid reports whether the cursor points at a cell within its bounds. If the
+// cell it pointed at was deleted the cursor moves on to the key after it
+func (cursor *Cursor) Valid() bool {
+	cursor.lock()
+	defer cursor.unlock()
+	cursor.refresh()
+	return cursor.valid()
+}
+
+func (cursor *Cursor) valid() bool {
+	if cursor.Err != nil || cursor.leaf == nil || cursor.index < 0 || cursor.index >= cursor.leaf.cell_count() {
+		return false
+	}
+	key, err := cursor.leaf.cell_key(cursor.index)
+	if err != nil {
+		cursor.Err = err
+		return false
+	}
+	return key >= cursor.lower && key <= cursor.upper
+}
+
+// Key returns the key the cursor points at, which must be Valid
+func (cursor *Cursor) Key() uint32 {
+	cursor.lock()
+	defer cursor.unlock()
+	cursor.refresh()
+	key, err := cursor.leaf.cell_key(cursor.index)
+	if err != nil {
+		cursor.Err = err
+	}
+	return key
+}
+
+func (cursor *Cursor) Record() (*Record, error) {
+	cursor.lock()
+	defer cursor.unlock()
+	defer cursor.btree.release()
+	cursor.refresh()
+	cell, err := cursor.leaf.cell(cursor.index)
+	if err != nil {
+		return nil, err
+	}
+	return cursor.btree.decode_record(cell)
+}
+
+// lock keeps other goroutines sharing the connection out while the cursor moves
+func (cursor *Cursor) lock() {
+	cursor.btree.pager.mutex.Lock()
+}
+
+func (cursor *Cursor) unlock() {
+	cursor.btree.pager.mutex.Unlock()
+}
+
+// move_to switches the pinned leaf over to leaf, which may be nil. A cursor
+// on the tree holds the connection's Shared lock
+func (cursor *Cursor) move_to(leaf *Page) {
+	pager := cursor.btree.pager
+	if leaf != nil {
+		pager.Pin(leaf)
+		if cursor.leaf == nil {
+			pager.holds += 1
+		}
+	}
+	if cursor.leaf != nil {
+		pager.Unpin(cursor.leaf)
+		if leaf == nil {
+			pager.holds -= 1
+			pager.unlock()
+		}
+	}
+	cursor.leaf = leaf
+}
+
+// Close unpins the cursor's leaf, leaving the cursor unpositioned
+func (cursor *Cursor) Close() {
+	cursor.lock()
+	defer cursor.unlock()
+	cursor.move_to(nil)
+}
+
+// save remembers where a cursor that just moved is, so it can find its way
+// back after the tree changes
+func (cursor *Cursor) save() {
+	cursor.changes = cursor.btree.pager.changes
+	if cursor.leaf == nil {
+		return
+	}
+	key, err := cursor.leaf.cell_key(cursor.index)
+	if err != nil {
+		cursor.fail(err)
+		return
+	}
+	cursor.key = key
+}
+
+// restore seeks back to the cursor's key if the tree changed since the cursor
+// last moved, as its leaf may have been split, merged or freed and reused in
+// the meantime. It reports false if the key is gone, leaving the cursor on
+// the slot where it would be
+func (cursor *Cursor) restore() bool {
+	if cursor.leaf == nil || cursor.changes == cursor.btree.pager.changes {
+		return true
+	}
+	found := cursor.position(cursor.key)
+	cursor.changes = cursor.btree.pager.changes
+	return found
+}
+
+// refresh restores the cursor before its cell is read, moving on to the
+// following key if its own was deleted
+func (cursor *Cursor) refresh() {
+	if !cursor.restore() {
+		cursor.skip_forward()
+		cursor.save()
+	}
+}
+
+func (cursor *Cursor) fail(err error) {
+	cursor.Err = err
+	cursor.move_to(nil)
+}
+
+// position moves the cursor onto the leaf owning key and returns whether
+// key itself is there
+func (cursor *Cursor) position(key uint32) bool {
+	defer cursor.btree.release()
+
+	cursor.Err = nil
+	if err := cursor.btree.pager.begin_read(); err != nil {
+		cursor.fail(err)
+		return false
+	}
+	path, index, found, err := cursor.btree.find_key(key)
+	if err != nil || path == nil {
+		cursor.fail(err)
+		cursor.btree.pager.unlock()
+		return false
+	}
+	cursor.move_to(path[len(path)-1])
+	cursor.index = index
+	return found
+}
+
+// Seek positions the cursor on the first key >= key
+func (cursor *Cursor) Seek(key uint32) bool {
+	cursor.lock()
+	defer cursor.unlock()
+	cursor.position(max(key, cursor.lower))
+	cursor.skip_forward()
+	cursor.save()
+	return cursor.valid()
+}
+
+// SeekBackward positions the cursor on the last key <= key
+func (cursor *Cursor) SeekBackward(key uint32) bool {
+	cursor.lock()
+	defer cursor.unlock()
+	if !cursor.position(min(key, cursor.upper)) {
+		cursor.index -= 1
+	}
+	cursor.skip_backward()
+	cursor.save()
+	return cursor.valid()
+}
+
+func (cursor *Cursor) First() bool {
+	return cursor.Seek(cursor.lower)
+}
+
+func (cursor *Cursor) Last() bool {
+	return cursor.SeekBackward(cursor.upper)
+}
+
+// Next advances to the following key, crossing into the next leaf as needed
+func (cursor *Cursor) Next() bool {
+	cursor.lock()
+	defer cursor.unlock()
+	// A cursor whose key was deleted already sits on the key after it
+	if cursor.restore() {
+		if !cursor.valid() {
+			return false
+		}
+		cursor.index += 1
+	}
+	cursor.skip_forward()
+	cursor.save()
+	return cursor.valid()
+}
+
+// Prev steps back to the preceding key, crossing into the previous leaf as needed
+func (cursor *Cursor) Prev() bool {
+	cursor.lock()
+	defer cursor.unlock()
+	if cursor.restore() && !cursor.valid() {
+		return false
+	}
+	cursor.index -= 1
+	cursor.skip_backward()
+	cursor.save()
+	return cursor.valid()
+}
+
+func (cursor *Cursor) skip_forward() {
+	for cursor.leaf != nil && cursor.index >= cursor.leaf.cell_count() {
+		next := cursor.leaf.next_sibling()
+		if next == 0 {
+			cursor.move_to(nil)
+			return
+		}
+		leaf, err := cursor.btree.pager.GetPage(next)
+		if err != nil {
+			cursor.fail(err)
+			return
+		}
+		// GetPage already pinned the new leaf
+		cursor.btree.pager.Unpin(cursor.leaf)
+		cursor.leaf = leaf
+		cursor.index = 0
+	}
+}
+
+func (cursor *Cursor) skip_backward() {
+	for cursor.leaf != nil && cursor.index < 0 {
+		prev := cursor.leaf.prev_sibling()
+		if prev == 0 {
+			cursor.move_to(nil)
+			return
+		}
+		leaf, err := cursor.btree.pager.GetPage(prev)
+		if err != nil {
+			cursor.fail(err)
+			return
+		}
+		// GetPage already pinned the new leaf
+		cursor.btree.pager.Unpin(cursor.leaf)
+		cursor.leaf = leaf
+		cursor.index = cursor.leaf.cell_count() - 1
+	}
+}
+
+// Range returns every record with a key between lower and upper inclusive
+func (btree *BTree) Range(lower uint32, upper uint32) ([]*Record, error) {
+	var records []*Record
+	cursor := btree.NewCursor()
+	defer cursor.Close()
+	cursor.SetBounds(lower, upper)
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		record, err := cursor.Record()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, cursor.Err
+}
@@ -0,0 +1,140 @@
+package storage_manager
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCursorIteratesAcrossLeaves(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	for key := 1; key <= 1000; key++ {
+		btree.Insert(uint32(key*10), []any{"user", "user@example.com"})
+	}
+
+	cursor := btree.NewCursor()
+	count := 0
+	want := uint32(10)
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		if cursor.Key() != want {
+			t.Fatalf("Expected key %d, got %d", want, cursor.Key())
+		}
+		want += 10
+		count += 1
+	}
+	if count != 1000 {
+		t.Errorf("Forward scan returned %d keys, expected 1000", count)
+	}
+
+	count = 0
+	want = 10000
+	for ok := cursor.Last(); ok; ok = cursor.Prev() {
+		if cursor.Key() != want {
+			t.Fatalf("Expected key %d, got %d", want, cursor.Key())
+		}
+		want -= 10
+		count += 1
+	}
+	if count != 1000 {
+		t.Errorf("Backward scan returned %d keys, expected 1000", count)
+	}
+}
+
+func TestCursorSeekAndBounds(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	if btree.NewCursor().First() {
+		t.Fatal("Cursor on an empty database should not be valid")
+	}
+	for key := 1; key <= 1000; key++ {
+		btree.Insert(uint32(key*10), []any{"user", "user@example.com"})
+	}
+
+	cursor := btree.NewCursor()
+	if !cursor.Seek(255) || cursor.Key() != 260 {
+		t.Errorf("Seek(255) should land on 260")
+	}
+	if !cursor.SeekBackward(255) || cursor.Key() != 250 {
+		t.Errorf("SeekBackward(255) should land on 250")
+	}
+	if cursor.Seek(10001) {
+		t.Errorf("Seek past the last key should not be valid")
+	}
+	if cursor.SeekBackward(5) {
+		t.Errorf("SeekBackward before the first key should not be valid")
+	}
+
+	records, err := btree.Range(995, 2005)
+	if err != nil {
+		t.Fatalf("Range(995, 2005): %v", err)
+	}
+	if len(records) != 101 || records[0].Key != 1000 || records[100].Key != 2000 {
+		t.Fatalf("Range(995, 2005) returned %d records", len(records))
+	}
+
+	cursor.SetBounds(500, 600)
+	count := 0
+	for ok := cursor.Last(); ok; ok = cursor.Prev() {
+		count += 1
+	}
+	if count != 11 {
+		t.Errorf("Bounded backward scan returned %d keys, expected 11", count)
+	}
+}
+
+func TestCursorSurvivesChangesToTheTree(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	transaction, _ := btree.Begin()
+	for key := 1; key <= 2000; key++ {
+		transaction.Insert(uint32(key), []any{"user", "user@example.com"})
+	}
+	transaction.Commit()
+
+	cursor := btree.NewCursor()
+	defer cursor.Close()
+	if !cursor.Seek(1000) {
+		t.Fatal("Seek(1000) should be valid")
+	}
+
+	// The cursor's leaf gets merged away and freed, then reused by the inserts
+	transaction, _ = btree.Begin()
+	for key := 1; key <= 1500; key++ {
+		if key == 1000 {
+			continue
+		}
+		if err := transaction.Delete(uint32(key)); err != nil {
+			t.Fatalf("Delete(%d): %v", key, err)
+		}
+	}
+	for key := 5001; key <= 5300; key++ {
+		transaction.Insert(uint32(key), []any{"user", "user@example.com"})
+	}
+	transaction.Commit()
+
+	want := []uint32{1000}
+	for key := 1501; key <= 2000; key++ {
+		want = append(want, uint32(key))
+	}
+	for key := 5001; key <= 5300; key++ {
+		want = append(want, uint32(key))
+	}
+	count := 0
+	for ok := cursor.Valid(); ok; ok = cursor.Next() {
+		if count >= len(want) || cursor.Key() != want[count] {
+			t.Fatalf("Expected key %d at position %d, got %d", want[min(count, len(want)-1)], count, cursor.Key())
+		}
+		count += 1
+	}
+	if cursor.Err != nil || count != len(want) {
+		t.Fatalf("Scan returned %d keys, expected %d, err %v", count, len(want), cursor.Err)
+	}
+
+	// Deleting the cursor's own key leaves it between its neighbours
+	cursor.Seek(1600)
+	btree.Delete(1600)
+	if !cursor.Prev() || cursor.Key() != 1599 {
+		t.Errorf("Prev after deleting the cursor's key should land on 1599")
+	}
+	btree.Delete(1599)
+	if !cursor.Next() || cursor.Key() != 1601 {
+		t.Errorf("Next after deleting the cursor's key should land on 1601")
+	}
+}
@@ -0,0 +1,219 @@
+/**
+ * Freelist (pages no longer in use, modeled on SQLite's freelist)
+ *
+ * Pages a merge, a collapsed root or a dropped overflow chain leaves behind
+ * go onto the freelist, and page allocation takes them back before the
+ * database grows. The free pages form a list of trunk pages, each naming a
+ * batch of leaf pages.
+ *
+ * **Header Fields (page 0):**
+ * - 34-37: First trunk page (uint32_t, 0 if the freelist is empty)
+ * - 38-41: Free pages, trunks included (uint32_t)
+ *
+ * **Trunk Page:**
+ * - 0-3: Next trunk page (uint32_t, 0 on the last trunk)
+ * - 4-7: Leaf count (uint32_t)
+ * - 8 to the end of the page: Leaf page numbers (uint32_t each)
+ *
+ * Leaf pages hold nothing worth keeping. A page is freed onto the first trunk
+ * while it has room, otherwise it becomes the new first trunk. Allocation
+ * takes the first trunk's last leaf, or the trunk itself once it's empty.
+ */
+
+package storage_manager
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const freelistTrunkHeaderSize = 8
+
+// trunk_capacity is how many leaf page numbers fit on a trunk page
+func trunk_capacity(page_size int) int {
+	return (page_size - freelistTrunkHeaderSize) / 4
+}
+
+func first_trunk(root *Page) int {
+	return int(binary.BigEndian.Uint32(root.slotted_array[34:38]))
+}
+
+func free_page_count(root *Page) int {
+	return int(binary.BigEndian.Uint32(root.slotted_array[38:42]))
+}
+
+func set_freelist(root *Page, first_trunk int, count int) {
+	binary.BigEndian.PutUint32(root.slotted_array[34:38], uint32(first_trunk))
+	binary.BigEndian.PutUint32(root.slotted_array[38:42], uint32(count))
+}
+
+// check_free_page returns ErrCorrupt for a page the freelist can't hold,
+// page 0 or one past the end of the database
+func (pager *Pager) check_free_page(page_number int) error {
+	if page_number <= 0 || page_number >= pager.num_pages {
+		return fmt.Errorf("%w: freelist holds page %d of %d", ErrCorrupt, page_number, pager.num_pages)
+	}
+	return nil
+}
+
+// trunk_next returns the trunk after trunk, 0 on the last one
+func (pager *Pager) trunk_next(trunk *Page) (int, error) {
+	next := int(binary.BigEndian.Uint32(trunk.slotted_array[0:4]))
+	if next == 0 {
+		return 0, nil
+	}
+	return next, pager.check_free_page(next)
+}
+
+// trunk_leaf_count returns how many leaves trunk names, a count that wouldn't
+// fit on the page is ErrCorrupt
+func trunk_leaf_count(trunk *Page) (int, error) {
+	count := int(binary.BigEndian.Uint32(trunk.slotted_array[4:8]))
+	if count > trunk_capacity(len(trunk.slotted_array)) {
+		return 0, fmt.Errorf("%w: freelist trunk %d has %d leaves", ErrCorrupt, trunk.page_number, count)
+	}
+	return count, nil
+}
+
+// trunk_leaf returns the page number of trunk's leaf i, which must be below
+// trunk_leaf_count
+func (pager *Pager) trunk_leaf(trunk *Page, i int) (int, error) {
+	offset := freelistTrunkHeaderSize + 4*i
+	leaf := int(binary.BigEndian.Uint32(trunk.slotted_array[offset : offset+4]))
+	return leaf, pager.check_free_page(leaf)
+}
+
+// trunk_leaves returns the page numbers of every leaf trunk names
+func (pager *Pager) trunk_leaves(trunk *Page) ([]int, error) {
+	count, err := trunk_leaf_count(trunk)
+	if err != nil {
+		return nil, err
+	}
+	leaves := make([]int, count)
+	for i := range leaves {
+		if leaves[i], err = pager.trunk_leaf(trunk, i); err != nil {
+			return nil, err
+		}
+	}
+	return leaves, nil
+}
+
+// FreePage puts a page the database no longer uses on the freelist. The
+// caller keeps its pin and must not change the page afterwards
+func (pager *Pager) FreePage(page *Page) error {
+	if page.page_number == 0 {
+		return fmt.Errorf("%w: page 0 can't be freed", ErrPageOutOfRange)
+	}
+	root, err := pager.get_root()
+	if err != nil {
+		return err
+	}
+	defer pager.Unpin(root)
+	if err := pager.Write(root); err != nil {
+		return err
+	}
+
+	first, count := first_trunk(root), free_page_count(root)
+	if first != 0 {
+		trunk, err := pager.GetPage(first)
+		if err != nil {
+			return err
+		}
+		defer pager.Unpin(trunk)
+		leaves, err := trunk_leaf_count(trunk)
+		if err != nil {
+			return err
+		}
+		if leaves < trunk_capacity(len(trunk.slotted_array)) {
+			if err := pager.Write(trunk); err != nil {
+				return err
+			}
+			offset := freelistTrunkHeaderSize + 4*leaves
+			binary.BigEndian.PutUint32(trunk.slotted_array[offset:offset+4], uint32(page.page_number))
+			binary.BigEndian.PutUint32(trunk.slotted_array[4:8], uint32(leaves+1))
+			set_freelist(root, first, count+1)
+			return nil
+		}
+	}
+
+	// The first trunk is full, or there is none, so page starts a new one
+	if err := pager.Write(page); err != nil {
+		return err
+	}
+	clear(page.slotted_array[:])
+	binary.BigEndian.PutUint32(page.slotted_array[0:4], uint32(first))
+	set_freelist(root, page.page_number, count+1)
+	return nil
+}
+
+// reuse_free_page takes a page off the freelist and hands it back zeroed and
+// pinned like a newly allocated one, or returns nil if the freelist is empty
+func (pager *Pager) reuse_free_page(root *Page) (*Page, error) {
+	first, count := first_trunk(root), free_page_count(root)
+	if first == 0 {
+		return nil, nil
+	}
+	if err := pager.check_free_page(first); err != nil {
+		return nil, err
+	}
+	trunk, err := pager.GetPage(first)
+	if err != nil {
+		return nil, err
+	}
+	leaves, err := trunk_leaf_count(trunk)
+	if err != nil {
+		pager.Unpin(trunk)
+		return nil, err
+	}
+	if err := pager.Write(root); err != nil {
+		pager.Unpin(trunk)
+		return nil, err
+	}
+	if err := pager.Write(trunk); err != nil {
+		pager.Unpin(trunk)
+		return nil, err
+	}
+
+	page := trunk
+	if leaves > 0 {
+		// The trunk only lets go of the leaf once the leaf is ready to hand out
+		leaf_number, err := pager.trunk_leaf(trunk, leaves-1)
+		if err != nil {
+			pager.Unpin(trunk)
+			return nil, err
+		}
+		leaf, err := pager.GetPage(leaf_number)
+		if err != nil {
+			pager.Unpin(trunk)
+			return nil, err
+		}
+		if err := pager.Write(leaf); err != nil {
+			pager.Unpin(leaf)
+			pager.Unpin(trunk)
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(trunk.slotted_array[4:8], uint32(leaves-1))
+		set_freelist(root, first, count-1)
+		pager.Unpin(trunk)
+		page = leaf
+	} else {
+		next, err := pager.trunk_next(trunk)
+		if err != nil {
+			pager.Unpin(trunk)
+			return nil, err
+		}
+		set_freelist(root, next, count-1)
+	}
+	clear(page.slotted_array[:])
+	return page, nil
+}
+
+// FreePageCount returns how many pages are waiting on the freelist
+func (pager *Pager) FreePageCount() (int, error) {
+	root, err := pager.get_root()
+	if err != nil {
+		return 0, err
+	}
+	defer pager.Unpin(root)
+	return free_page_count(root), nil
+}
@@ -0,0 +1,327 @@
+package storage_manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// free_pages walks the freelist, checking it against the header and returning
+// every page on it
+func free_pages(t *testing.T, btree *BTree) map[int]bool {
+	t.Helper()
+	pager := btree.pager
+	root := get_test_page(t, btree, 0)
+	defer pager.Unpin(root)
+	pages := make(map[int]bool)
+	add := func(page_number int) {
+		if page_number <= 0 || page_number >= pager.num_pages || pages[page_number] {
+			t.Fatalf("Freelist holds bad or repeated page %d", page_number)
+		}
+		pages[page_number] = true
+	}
+	for next := first_trunk(root); next != 0; {
+		trunk := get_test_page(t, btree, next)
+		add(next)
+		leaves, err := pager.trunk_leaves(trunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, leaf := range leaves {
+			add(leaf)
+		}
+		if next, err = pager.trunk_next(trunk); err != nil {
+			t.Fatal(err)
+		}
+		pager.Unpin(trunk)
+	}
+	if count := free_page_count(root); count != len(pages) {
+		t.Fatalf("Header counts %d free pages, the freelist holds %d", count, len(pages))
+	}
+	return pages
+}
+
+func TestFreedPagesAreReused(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	for key := 0; key < 2000; key++ {
+		btree.Insert(uint32(key), []any{"whiskers", int64(key)})
+	}
+	num_pages := btree.pager.num_pages
+	for key := 0; key < 2000; key++ {
+		if err := btree.Delete(uint32(key)); err != nil {
+			t.Fatalf("Delete(%d): %v", key, err)
+		}
+	}
+	if free := len(free_pages(t, btree)); free != num_pages-1 {
+		t.Errorf("Expected every page but the root to be free, got %d of %d", free, num_pages)
+	}
+
+	for key := 0; key < 2000; key++ {
+		btree.Insert(uint32(key), []any{"whiskers", int64(key)})
+	}
+	if btree.pager.num_pages != num_pages {
+		t.Errorf("Expected the database to stay at %d pages, got %d", num_pages, btree.pager.num_pages)
+	}
+	if err := btree.pager.FlushCache(); err != nil {
+		t.Fatal(err)
+	}
+	crash(btree)
+
+	reopened := open_test_btree(t, file_name)
+	if n := count_records(t, reopened); n != 2000 {
+		t.Errorf("Expected 2000 records, got %d", n)
+	}
+	free_pages(t, reopened)
+}
+
+func TestOverflowChainsAreFreed(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	big := strings.Repeat("whiskers", 3000)
+	btree.Insert(0, []any{big})
+	num_pages := btree.pager.num_pages
+
+	if err := btree.Update(0, []any{"cat"}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if free := len(free_pages(t, btree)); free != num_pages-1 {
+		t.Errorf("Expected the overflow chain on the freelist, %d of %d pages are free", free, num_pages)
+	}
+	if err := btree.Update(0, []any{big}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	btree.Insert(1, []any{"cat"})
+	if err := btree.Delete(0); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	btree.Insert(2, []any{big})
+	if btree.pager.num_pages != num_pages {
+		t.Errorf("Expected overflow pages to be reused, database grew from %d to %d pages", num_pages, btree.pager.num_pages)
+	}
+	record, err := btree.Get(2)
+	if err != nil || record.Values[0] != big {
+		t.Errorf("Get(2) read back wrong: %v", err)
+	}
+}
+
+func TestUnreadableFreeLeafStaysOnFreelist(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	pager := btree.pager
+	btree.Insert(0, []any{"cat"})
+	var pages []*Page
+	for i := 0; i < 3; i++ {
+		page, err := pager.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, page)
+	}
+	for _, page := range pages {
+		if err := pager.FreePage(page); err != nil {
+			t.Fatal(err)
+		}
+		pager.Unpin(page)
+	}
+
+	// Point the trunk's last leaf past the end of the database
+	root := get_test_page(t, btree, 0)
+	trunk := get_test_page(t, btree, first_trunk(root))
+	leaves, _ := trunk_leaf_count(trunk)
+	binary.BigEndian.PutUint32(trunk.slotted_array[freelistTrunkHeaderSize+4*(leaves-1):], uint32(pager.num_pages))
+	if _, err := pager.AllocatePage(); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt, got %v", err)
+	}
+	if count, _ := trunk_leaf_count(trunk); count != leaves || free_page_count(root) != 3 {
+		t.Errorf("Expected the freelist to keep its 3 pages, trunk has %d leaves and the header counts %d", count, free_page_count(root))
+	}
+	if trunk.pin_count != 1 || root.pin_count != 1 {
+		t.Errorf("Expected only the test's own pins left, trunk has %d and root %d", trunk.pin_count, root.pin_count)
+	}
+	pager.Unpin(trunk)
+	pager.Unpin(root)
+}
+
+func TestFreelistGrowsTrunks(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	pager := btree.pager
+	btree.Insert(0, []any{"cat"})
+
+	allocated := 2*trunk_capacity(pager.storage.page_size) + 10
+	for i := 0; i < allocated; i++ {
+		page, err := pager.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pager.FreePage(page); err != nil {
+			t.Fatal(err)
+		}
+		pager.Unpin(page)
+	}
+	num_pages := pager.num_pages
+	if num_pages != 2 {
+		t.Fatalf("Expected every allocation to reuse the page just freed, got %d pages", num_pages)
+	}
+
+	var pages []*Page
+	for i := 0; i < allocated; i++ {
+		page, err := pager.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, page)
+	}
+	for _, page := range pages {
+		if err := pager.FreePage(page); err != nil {
+			t.Fatal(err)
+		}
+		pager.Unpin(page)
+	}
+	free := free_pages(t, btree)
+	if len(free) != allocated {
+		t.Fatalf("Expected %d free pages, got %d", allocated, len(free))
+	}
+	trunks := 0
+	root := get_test_page(t, btree, 0)
+	for next := first_trunk(root); next != 0; next, _ = pager.trunk_next(get_test_page(t, btree, next)) {
+		trunks += 1
+	}
+	if trunks != 3 {
+		t.Errorf("Expected 3 trunks, got %d", trunks)
+	}
+
+	for i := 0; i < allocated; i++ {
+		page, err := pager.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !free[page.page_number] {
+			t.Fatalf("Allocated page %d, which wasn't free", page.page_number)
+		}
+		delete(free, page.page_number)
+		pager.Unpin(page)
+	}
+	if count, _ := pager.FreePageCount(); count != 0 {
+		t.Errorf("Expected an empty freelist, got %d pages", count)
+	}
+	if page, _ := pager.AllocatePage(); page.page_number != pager.num_pages-1 {
+		t.Errorf("Expected the database to grow once the freelist ran out, got page %d", page.page_number)
+	}
+}
+
+func TestClearFreesEveryPage(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeWAL, JournalModeDelete} {
+		t.Run(mode.String(), func(t *testing.T) {
+			file_name := filepath.Join(t.TempDir(), "Boots.db")
+			btree := open_test_btree_in_mode(t, file_name, mode)
+			payload := strings.Repeat("x", 1500)
+			transaction, _ := btree.Begin()
+			for key := 0; key < 3000; key++ {
+				transaction.Insert(uint32(key), []any{payload})
+			}
+			transaction.Commit()
+			num_pages := btree.pager.num_pages
+
+			// Rolled back, the freelist is as empty as it was
+			transaction, _ = btree.Begin()
+			btree.Clear()
+			if err := transaction.Rollback(); err != nil {
+				t.Fatalf("Rollback: %v", err)
+			}
+			if free := len(free_pages(t, btree)); free != 0 {
+				t.Errorf("Expected rollback to empty the freelist, got %d pages", free)
+			}
+
+			if err := btree.Clear(); err != nil {
+				t.Fatalf("Clear: %v", err)
+			}
+			if n := count_records(t, btree); n != 0 {
+				t.Errorf("Expected no records, got %d", n)
+			}
+			if free := len(free_pages(t, btree)); free != num_pages-1 {
+				t.Errorf("Expected %d free pages, got %d", num_pages-1, free)
+			}
+			if err := btree.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened := open_test_btree_in_mode(t, file_name, mode)
+			for key := 0; key < 3000; key++ {
+				reopened.Insert(uint32(key), []any{payload})
+			}
+			if reopened.pager.num_pages != num_pages {
+				t.Errorf("Expected the database to stay at %d pages, got %d", num_pages, reopened.pager.num_pages)
+			}
+			if n := count_records(t, reopened); n != 3000 {
+				t.Errorf("Expected 3000 records, got %d", n)
+			}
+		})
+	}
+}
+
+func TestCorruptFreelistIsReported(t *testing.T) {
+	corruptions := map[string]func(trunk *Page){
+		"leaf count past the page": func(trunk *Page) {
+			binary.BigEndian.PutUint32(trunk.slotted_array[4:8], uint32(trunk_capacity(len(trunk.slotted_array))+1))
+		},
+		"leaf past the end": func(trunk *Page) {
+			binary.BigEndian.PutUint32(trunk.slotted_array[freelistTrunkHeaderSize:], 1<<20)
+		},
+		"leaf on page 0": func(trunk *Page) {
+			binary.BigEndian.PutUint32(trunk.slotted_array[freelistTrunkHeaderSize+4:], 0)
+		},
+		"next trunk past the end": func(trunk *Page) {
+			binary.BigEndian.PutUint32(trunk.slotted_array[4:8], 0)
+			binary.BigEndian.PutUint32(trunk.slotted_array[0:4], 1<<20)
+		},
+		"trunk pointing at itself": func(trunk *Page) {
+			binary.BigEndian.PutUint32(trunk.slotted_array[0:4], uint32(trunk.page_number))
+		},
+	}
+	for name, corrupt := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+			pager := btree.pager
+			btree.Insert(0, []any{"cat"})
+			var pages []*Page
+			for i := 0; i < 3; i++ {
+				page, err := pager.AllocatePage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				pages = append(pages, page)
+			}
+			for _, page := range pages {
+				if err := pager.FreePage(page); err != nil {
+					t.Fatal(err)
+				}
+				pager.Unpin(page)
+			}
+
+			root := get_test_page(t, btree, 0)
+			trunk := get_test_page(t, btree, first_trunk(root))
+			corrupt(trunk)
+			if _, err := pager.free_page_set(root); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("free_page_set: expected ErrCorrupt, got %v", err)
+			}
+			if name == "trunk pointing at itself" {
+				// Allocation only reads the first trunk, which is fine apart from its link
+				return
+			}
+			for i := 0; i < 3; i++ {
+				page, err := pager.AllocatePage()
+				if errors.Is(err, ErrCorrupt) {
+					return
+				}
+				if err != nil {
+					t.Fatalf("AllocatePage: expected ErrCorrupt, got %v", err)
+				}
+				pager.Unpin(page)
+			}
+			t.Errorf("AllocatePage never reported the corrupt freelist")
+		})
+	}
+}
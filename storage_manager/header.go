@@ -0,0 +1,230 @@
+/**
+ * Opening a Database (header validation, modeled on SQLite's sqlite3BtreeOpen)
+ *
+ * The 100-byte header on page 0 (laid out at the top of btree.go) is checked
+ * when a database is opened, so a file that isn't a BootsDB database, or one
+ * that has been damaged, is refused before anything is written to it.
+ *
+ * **Checks:**
+ * - 0-15: Magic string, exactly "BootsDB format 4" with no terminator
+ * - 16-17: Page size, a power of two from 512 to 65536 (65536 is stored as 1)
+ * - 18, 19: Write and read versions, 1 or 2
+ * - 23, 24: Payload fractions, min <= max <= 64
+ * - 30-33: Database size, which must match the pages actually there
+ * - 34-41: Freelist, which must lie inside the database
+ * - 58-61: Text encoding, which must be UTF-8
+ *
+ * A file that doesn't start with the magic string is ErrNotADatabase, a
+ * database whose header doesn't add up is ErrCorrupt. The format number in
+ * the magic string changes whenever the layout of pages does, so a database
+ * from another version, like format 3 with its fixed 289-byte rows, is also
+ * ErrNotADatabase rather than misread. An empty or missing
+ * file is a new database and gets its header on the first write, with the
+ * page size SetPageSize chose or 4096 bytes. After that the page size is
+ * fixed, every connection reads it back from the header.
+ */
+
+package storage_manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	dbMagic       = "BootsDB format 4"
+	dbMagicPrefix = "BootsDB format "
+
+	minPageSize     = 512
+	maxPageSize     = 65536
+	defaultPageSize = 4096
+)
+
+var (
+	ErrNotADatabase    = errors.New("file is not a database")
+	ErrCorrupt         = errors.New("database disk image is malformed")
+	ErrInvalidPageSize = errors.New("page size must be a power of two from 512 to 65536")
+	ErrPageSizeFixed   = errors.New("page size can't change once the database exists")
+)
+
+func valid_page_size(size int) bool {
+	return size >= minPageSize && size <= maxPageSize && size&(size-1) == 0
+}
+
+// header_page_size decodes header bytes 16-17, which hold 1 for 65536
+func header_page_size(header []byte) int {
+	size := int(binary.BigEndian.Uint16(header[16:18]))
+	if size == 1 {
+		return maxPageSize
+	}
+	return size
+}
+
+func set_header_page_size(header []byte, size int) {
+	binary.BigEndian.PutUint16(header[16:18], uint16(size%maxPageSize|size/maxPageSize))
+}
+
+// Open opens a database file in WAL mode, creating it if it doesn't exist.
+// Every call opens a connection of its own, see the package doc on sharing one
+func Open(file_name string) (*BTree, error) {
+	return OpenInMode(file_name, JournalModeWAL)
+}
+
+// OpenInMode opens a database file in the given journal mode, creating it if
+// it doesn't exist, and validates its header. Reading the header takes a
+// Shared lock, so without a busy timeout opening fails with ErrBusy while
+// another connection commits to a rollback journal
+func OpenInMode(file_name string, mode JournalMode) (*BTree, error) {
+	return OpenWithBusyTimeout(file_name, mode, 0)
+}
+
+// OpenWithBusyTimeout is OpenInMode with the connection's busy timeout set
+// before the header is read, so opening waits for other connections' commits
+// like everything the connection does afterwards
+func OpenWithBusyTimeout(file_name string, mode JournalMode, timeout time.Duration) (*BTree, error) {
+	storage, err := InitializeStorage(file_name, mode)
+	if err != nil {
+		return nil, err
+	}
+	storage.busy_timeout = timeout
+	btree := InitializeBtree(InitializePager(storage))
+	if err := btree.check_header(); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return btree, nil
+}
+
+func is_initialized(root *Page) bool {
+	return string(root.slotted_array[0:len(dbMagic)]) == dbMagic
+}
+
+// SetPageSize chooses the page size of a database that doesn't exist yet.
+// Once the first write has created it, only the size it already has is
+// accepted
+func (btree *BTree) SetPageSize(size int) error {
+	if !valid_page_size(size) {
+		return fmt.Errorf("%w: %d", ErrInvalidPageSize, size)
+	}
+	if err := btree.begin(true); err != nil {
+		return err
+	}
+	defer btree.end()
+
+	pager := btree.pager
+	if size == pager.storage.page_size {
+		return nil
+	}
+	root, err := btree.get_page(0)
+	if err != nil {
+		return err
+	}
+	if !is_blank(root) || pager.num_pages > 1 || len(pager.written) != 0 {
+		return ErrPageSizeFixed
+	}
+	// Only the blank root can be cached, and it's reread at the new size
+	btree.release()
+	for _, page := range pager.cache.content {
+		pager.cache.remove(page)
+	}
+	pager.storage.page_size = size
+	return nil
+}
+
+// PageSize returns the size of the database's pages in bytes
+func (btree *BTree) PageSize() int {
+	btree.pager.mutex.Lock()
+	defer btree.pager.mutex.Unlock()
+	return btree.pager.storage.page_size
+}
+
+// is_blank reports whether page 0 has never been written
+func is_blank(root *Page) bool {
+	for _, b := range root.slotted_array[:dbHeaderSize] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// initialize_root writes the header of a new database the first time the
+// database is written to. A root that isn't blank isn't ours to overwrite
+func (btree *BTree) initialize_root(root *Page) error {
+	if is_initialized(root) {
+		return nil
+	}
+	if !is_blank(root) {
+		return ErrNotADatabase
+	}
+	if err := btree.write(root); err != nil {
+		return err
+	}
+	initialize_database(root)
+	return nil
+}
+
+// check_header reads page 0 under a Shared lock, after any hot journal has
+// been rolled back, and validates the header against the database file
+func (btree *BTree) check_header() error {
+	if err := btree.begin(false); err != nil {
+		return err
+	}
+	defer btree.end()
+
+	storage := btree.pager.storage
+	if storage.fileSize > 0 && storage.fileSize < dbHeaderSize {
+		return ErrNotADatabase
+	}
+	root, err := btree.get_page(0)
+	if err != nil {
+		return err
+	}
+	if is_blank(root) {
+		if btree.pager.num_pages > 1 {
+			return ErrNotADatabase
+		}
+		return nil
+	}
+	if !is_initialized(root) {
+		if magic := string(root.slotted_array[:len(dbMagic)]); strings.HasPrefix(magic, dbMagicPrefix) {
+			return fmt.Errorf("%w: %q isn't this version's file format", ErrNotADatabase, strings.TrimRight(magic, "\x00"))
+		}
+		return ErrNotADatabase
+	}
+	return validate_header(root, storage.fileSize, storage.page_size, btree.pager.num_pages)
+}
+
+// validate_header checks the fields of an initialized header. file_size is the
+// length of the database file, page_size the size pages are read at and
+// num_pages the size of the database as of the last commit, which may still
+// be in the WAL
+func validate_header(root *Page, file_size int64, page_size int, num_pages int) error {
+	header := root.slotted_array[:dbHeaderSize]
+	if size := header_page_size(header); size != page_size {
+		return fmt.Errorf("%w: page size %d", ErrCorrupt, size)
+	}
+	if file_size%int64(page_size) != 0 {
+		return fmt.Errorf("%w: file size %d isn't a whole number of pages", ErrCorrupt, file_size)
+	}
+	if write, read := header[18], header[19]; write < 1 || write > 2 || read < 1 || read > 2 {
+		return fmt.Errorf("%w: unsupported file format versions %d and %d", ErrCorrupt, write, read)
+	}
+	if max_fraction, min_fraction := header[23], header[24]; max_fraction > 64 || min_fraction > max_fraction {
+		return fmt.Errorf("%w: payload fractions %d and %d", ErrCorrupt, max_fraction, min_fraction)
+	}
+	if encoding := binary.BigEndian.Uint32(header[58:62]); encoding != 1 {
+		return fmt.Errorf("%w: unsupported text encoding %d", ErrCorrupt, encoding)
+	}
+	if size := int(binary.BigEndian.Uint32(header[30:34])); size != num_pages {
+		return fmt.Errorf("%w: header records %d pages, the database has %d", ErrCorrupt, size, num_pages)
+	}
+	first, count := first_trunk(root), free_page_count(root)
+	if first >= num_pages || count >= num_pages || (first == 0) != (count == 0) {
+		return fmt.Errorf("%w: freelist of %d pages starting at page %d", ErrCorrupt, count, first)
+	}
+	return nil
+}
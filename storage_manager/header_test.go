@@ -0,0 +1,343 @@
+package storage_manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// damaged_database creates a committed database with a few records and
+// applies damage to its header bytes on disk
+func damaged_database(t *testing.T, damage func(header []byte)) string {
+	t.Helper()
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree, err := OpenInMode(file_name, JournalModeDelete)
+	if err != nil {
+		t.Fatalf("OpenInMode: %v", err)
+	}
+	transaction, _ := btree.Begin()
+	for key := 0; key < 500; key++ {
+		transaction.Insert(uint32(key), []any{"whiskers", int64(key)})
+	}
+	if err := transaction.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := btree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.OpenFile(file_name, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	header := make([]byte, dbHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+	damage(header)
+	if _, err := file.WriteAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+	return file_name
+}
+
+func TestOpenValidDatabase(t *testing.T) {
+	file_name := damaged_database(t, func(header []byte) {})
+	btree, err := OpenInMode(file_name, JournalModeDelete)
+	if err != nil {
+		t.Fatalf("OpenInMode: %v", err)
+	}
+	defer btree.Close()
+	if n := count_records(t, btree); n != 500 {
+		t.Errorf("Expected 500 records, got %d", n)
+	}
+}
+
+func TestOpenNewDatabase(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeWAL, JournalModeDelete} {
+		t.Run(mode.String(), func(t *testing.T) {
+			file_name := filepath.Join(t.TempDir(), "Boots.db")
+			btree, err := OpenInMode(file_name, mode)
+			if err != nil {
+				t.Fatalf("OpenInMode: %v", err)
+			}
+			if err := btree.Insert(1, []any{"cat"}); err != nil {
+				t.Fatalf("Insert: %v", err)
+			}
+			if err := btree.Close(); err != nil {
+				t.Fatal(err)
+			}
+			reopened, err := OpenInMode(file_name, mode)
+			if err != nil {
+				t.Fatalf("Reopening: %v", err)
+			}
+			defer reopened.Close()
+			if record, err := reopened.Get(1); err != nil || record.Values[0] != "cat" {
+				t.Errorf("Get(1) read back wrong: %v", err)
+			}
+		})
+	}
+}
+
+func TestMagicHasNoTerminator(t *testing.T) {
+	file_name := damaged_database(t, func(header []byte) {
+		if string(header[0:16]) != "BootsDB format 4" {
+			t.Errorf("Expected the magic string, got %q", header[0:16])
+		}
+	})
+	_, err := OpenInMode(file_name, JournalModeDelete)
+	if err != nil {
+		t.Fatalf("OpenInMode: %v", err)
+	}
+
+	// A magic string that only matches in its first 15 bytes isn't ours
+	file_name = damaged_database(t, func(header []byte) { header[15] = 0 })
+	if _, err := OpenInMode(file_name, JournalModeDelete); !errors.Is(err, ErrNotADatabase) {
+		t.Errorf("Expected ErrNotADatabase, got %v", err)
+	}
+}
+
+func TestOpenRefusesForeignFiles(t *testing.T) {
+	for name, contents := range map[string]string{
+		"text":      strings.Repeat("Not a database at all.\n", 500),
+		"short":     "BootsDB format 4",
+		"sqlite":    "SQLite format 3\000" + strings.Repeat("\000", 2*defaultPageSize-16),
+		"zero-fill": strings.Repeat("\000", 3*defaultPageSize),
+	} {
+		t.Run(name, func(t *testing.T) {
+			file_name := filepath.Join(t.TempDir(), "foreign")
+			if err := os.WriteFile(file_name, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := OpenInMode(file_name, JournalModeDelete); !errors.Is(err, ErrNotADatabase) {
+				t.Errorf("Expected ErrNotADatabase, got %v", err)
+			}
+			if data, _ := os.ReadFile(file_name); string(data) != contents {
+				t.Errorf("Expected the file to be left alone")
+			}
+		})
+	}
+}
+
+func TestOpenRefusesCorruptHeaders(t *testing.T) {
+	for name, damage := range map[string]func(header []byte){
+		"page size":     func(header []byte) { binary.BigEndian.PutUint16(header[16:18], 1000) },
+		"write version": func(header []byte) { header[18] = 3 },
+		"read version":  func(header []byte) { header[19] = 0 },
+		"fractions":     func(header []byte) { header[23] = 200 },
+		"encoding":      func(header []byte) { binary.BigEndian.PutUint32(header[58:62], 2) },
+		"size":          func(header []byte) { binary.BigEndian.PutUint32(header[30:34], 1000) },
+		"freelist":      func(header []byte) { binary.BigEndian.PutUint32(header[34:38], 1000) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			file_name := damaged_database(t, damage)
+			if _, err := OpenInMode(file_name, JournalModeDelete); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Expected ErrCorrupt, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenRefusesTruncatedDatabase(t *testing.T) {
+	file_name := damaged_database(t, func(header []byte) {})
+	info, _ := os.Stat(file_name)
+	for _, size := range []int64{info.Size() - defaultPageSize, info.Size() - 100} {
+		if err := os.Truncate(file_name, size); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenInMode(file_name, JournalModeDelete); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Truncated to %d bytes, expected ErrCorrupt, got %v", size, err)
+		}
+	}
+}
+
+func TestWritesDontOverwriteForeignPages(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "foreign")
+	contents := strings.Repeat("Not a database at all.\n", 100)
+	os.WriteFile(file_name, []byte(contents), 0644)
+
+	// Skipping Open's check, the write itself still refuses
+	btree := open_test_btree_in_mode(t, file_name, JournalModeDelete)
+	if err := btree.Insert(1, []any{"cat"}); !errors.Is(err, ErrNotADatabase) {
+		t.Errorf("Expected ErrNotADatabase, got %v", err)
+	}
+	if err := btree.SetAutoVacuum(AutoVacuumFull); !errors.Is(err, ErrNotADatabase) {
+		t.Errorf("Expected ErrNotADatabase, got %v", err)
+	}
+	btree.Close()
+	if data, _ := os.ReadFile(file_name); string(data) != contents {
+		t.Errorf("Expected the file to be left alone")
+	}
+}
+
+// testdata/format3.db is the Boots.db this repository used to ship, written
+// with fixed 289-byte rows before records had their own format
+func TestOpenRefusesOldFormats(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "format3.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []JournalMode{JournalModeWAL, JournalModeDelete} {
+		t.Run(mode.String(), func(t *testing.T) {
+			file_name := filepath.Join(t.TempDir(), "Boots.db")
+			os.WriteFile(file_name, data, 0644)
+			_, err := OpenInMode(file_name, mode)
+			if !errors.Is(err, ErrNotADatabase) || !strings.Contains(err.Error(), "format 3") {
+				t.Errorf("Expected ErrNotADatabase naming format 3, got %v", err)
+			}
+
+			// Without Open's check, reads find nothing and writes refuse
+			btree := open_test_btree_in_mode(t, file_name, mode)
+			if _, err := btree.Get(1); err != ErrKeyNotFound {
+				t.Errorf("Get: expected ErrKeyNotFound, got %v", err)
+			}
+			if err := btree.Select(); err != nil {
+				t.Errorf("Select: %v", err)
+			}
+			if err := btree.Insert(1, []any{"cat"}); !errors.Is(err, ErrNotADatabase) {
+				t.Errorf("Insert: expected ErrNotADatabase, got %v", err)
+			}
+			btree.Close()
+			if got, _ := os.ReadFile(file_name); string(got) != string(data) {
+				t.Errorf("Expected the file to be left alone")
+			}
+		})
+	}
+}
+
+func TestPageSizes(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeWAL, JournalModeDelete} {
+		for _, size := range []int{512, 1024, 16384, 65536} {
+			t.Run(fmt.Sprintf("%v/%d", mode, size), func(t *testing.T) {
+				file_name := filepath.Join(t.TempDir(), "Boots.db")
+				btree, err := OpenInMode(file_name, mode)
+				if err != nil {
+					t.Fatalf("OpenInMode: %v", err)
+				}
+				if err := btree.SetPageSize(size); err != nil {
+					t.Fatalf("SetPageSize(%d): %v", size, err)
+				}
+				fill_and_purge(t, btree)
+				check_purged_tree(t, btree)
+				if err := btree.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if info, _ := os.Stat(file_name); info.Size()%int64(size) != 0 {
+					t.Errorf("Expected a whole number of %d byte pages, got %d bytes", size, info.Size())
+				}
+
+				reopened, err := OpenInMode(file_name, mode)
+				if err != nil {
+					t.Fatalf("Reopening: %v", err)
+				}
+				defer reopened.Close()
+				if reopened.PageSize() != size {
+					t.Errorf("Expected page size %d after reopening, got %d", size, reopened.PageSize())
+				}
+				check_purged_tree(t, reopened)
+				if err := reopened.Vacuum(); err != nil {
+					t.Fatalf("Vacuum: %v", err)
+				}
+				check_purged_tree(t, reopened)
+			})
+		}
+	}
+}
+
+func TestPageSizeIsChosenAtCreation(t *testing.T) {
+	btree, err := Open(filepath.Join(t.TempDir(), "Boots.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer btree.Close()
+	for _, size := range []int{0, 256, 1000, 3072, 131072} {
+		if err := btree.SetPageSize(size); !errors.Is(err, ErrInvalidPageSize) {
+			t.Errorf("SetPageSize(%d): expected ErrInvalidPageSize, got %v", size, err)
+		}
+	}
+	if btree.PageSize() != defaultPageSize {
+		t.Errorf("Expected the default page size, got %d", btree.PageSize())
+	}
+	btree.SetPageSize(2048)
+	btree.SetPageSize(8192)
+	btree.Insert(1, []any{"cat"})
+	if err := btree.SetPageSize(2048); !errors.Is(err, ErrPageSizeFixed) {
+		t.Errorf("Expected ErrPageSizeFixed, got %v", err)
+	}
+	if err := btree.SetPageSize(8192); err != nil {
+		t.Errorf("Expected the page size the database has to be accepted, got %v", err)
+	}
+	if btree.PageSize() != 8192 {
+		t.Errorf("Expected page size 8192, got %d", btree.PageSize())
+	}
+}
+
+func TestOtherConnectionsReadThePageSize(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeWAL, JournalModeDelete} {
+		t.Run(mode.String(), func(t *testing.T) {
+			file_name := filepath.Join(t.TempDir(), "Boots.db")
+			writer, err := OpenInMode(file_name, mode)
+			if err != nil {
+				t.Fatalf("OpenInMode: %v", err)
+			}
+			defer writer.Close()
+			reader, err := OpenInMode(file_name, mode)
+			if err != nil {
+				t.Fatalf("OpenInMode: %v", err)
+			}
+			defer reader.Close()
+
+			// In WAL mode the new database only exists in the log
+			writer.SetPageSize(1024)
+			for key := 0; key < 300; key++ {
+				writer.Insert(uint32(key), test_values(key))
+			}
+			if err := writer.pager.FlushCache(); err != nil {
+				t.Fatal(err)
+			}
+			if n := count_records(t, reader); n != 300 {
+				t.Errorf("Expected 300 records, got %d", n)
+			}
+			if reader.PageSize() != 1024 {
+				t.Errorf("Expected page size 1024, got %d", reader.PageSize())
+			}
+			if record, err := reader.Get(250); err != nil || record.Values[1] != test_values(250)[1] {
+				t.Errorf("Get(250) read back wrong: %v", err)
+			}
+		})
+	}
+}
+
+func TestHotJournalWithSmallPages(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree_in_mode(t, file_name, JournalModeDelete)
+	btree.SetPageSize(512)
+	for key := 0; key < 200; key++ {
+		btree.Insert(uint32(key), test_values(key))
+	}
+	if err := btree.pager.FlushCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A small cache spills the next transaction into the database file
+	btree.pager.SetCacheSize(8)
+	transaction, _ := btree.Begin()
+	for key := 200; key < 1000; key++ {
+		transaction.Insert(uint32(key), test_values(key))
+	}
+	crash(btree)
+
+	reopened, err := OpenInMode(file_name, JournalModeDelete)
+	if err != nil {
+		t.Fatalf("OpenInMode: %v", err)
+	}
+	defer reopened.Close()
+	if n := count_records(t, reopened); n != 200 {
+		t.Errorf("Expected the 200 committed records, got %d", n)
+	}
+}
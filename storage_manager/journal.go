@@ -0,0 +1,371 @@
+/**
+ * Rollback Journal (Boots.db-journal, modeled on SQLite's rollback journal)
+ *
+ * Before a transaction first changes a page, the page's original image is
+ * copied into the journal. The journal is fsynced before Boots.db is touched,
+ * so a crash part way through writing Boots.db leaves a "hot" journal behind
+ * that the next open plays back to restore the pre-transaction state.
+ *
+ * **Journal Header (24 bytes):**
+ * - 0-7: Magic string ("BootsJnl")
+ * - 8-11: Database size in pages before the transaction (uint32_t)
+ * - 12-15: Nonce (uint32_t, random per transaction, seeds record checksums)
+ * - 16-19: Page size (uint32_t)
+ * - 20-23: Reserved (zeros)
+ *
+ * **Record (page size + 8 bytes):**
+ * - 0-3: Page number (uint32_t)
+ * - 4 to 4+page size: Original page image
+ * - Last 4 bytes: CRC-32 of the nonce, page number and image
+ *
+ * **Finishing a transaction, per journal mode:**
+ * - DELETE: the journal file is removed
+ * - TRUNCATE: the journal file is truncated to zero bytes
+ * - PERSIST: the journal header is zeroed so it no longer looks hot
+ * - OFF: no journal is written at all and a crash can corrupt the database
+ */
+
+package storage_manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/rand/v2"
+	"os"
+)
+
+type JournalMode int
+
+const (
+	JournalModeWAL JournalMode = iota
+	JournalModeDelete
+	JournalModeTruncate
+	JournalModePersist
+	JournalModeOff
+)
+
+func (mode JournalMode) String() string {
+	switch mode {
+	case JournalModeWAL:
+		return "WAL"
+	case JournalModeDelete:
+		return "DELETE"
+	case JournalModeTruncate:
+		return "TRUNCATE"
+	case JournalModePersist:
+		return "PERSIST"
+	case JournalModeOff:
+		return "OFF"
+	}
+	return "UNKNOWN"
+}
+
+var ErrUnknownJournalMode = errors.New("unknown journal mode")
+
+// A journal decides how a transaction's pages reach the database file and
+// how the database gets back to a consistent state after a crash
+type journal interface {
+	// read_page returns a newer image of a page than the database file
+	// holds, or nil if the database file is current
+	read_page(page_number int) ([]byte, error)
+	// preserve is called before a transaction first changes page
+	preserve(page *Page) error
+	// spill writes a dirty page out ahead of its transaction's commit
+	spill(page *Page) error
+	// commit atomically and durably applies pages, shrinking or growing the
+	// database to db_size pages
+	commit(pages []*Page, db_size int) error
+	// rollback undoes everything spilled by the open transaction
+	rollback() error
+	// has_pending reports whether the open transaction already wrote pages out
+	has_pending() bool
+	// refresh catches up with commits made by other connections and reports
+	// whether there were any
+	refresh() (bool, error)
+	// changed reports whether refresh would find commits from other
+	// connections, without catching up with them
+	changed() (bool, error)
+	checkpoint() error
+	close() error
+}
+
+const (
+	journalMagic      = "BootsJnl"
+	journalHeaderSize = 24
+)
+
+type rollback_journal struct {
+	storage   *Storage
+	mode      JournalMode
+	file_name string
+	file      *os.File // Open while a transaction is writing to it
+
+	nonce         uint32
+	original_size int          // Database size in pages when the transaction started
+	page_size     int          // Page size of the records in the journal
+	journaled     map[int]bool // Pages whose original image is in the journal
+	end           int64        // Offset the next record is written at
+	synced        bool         // Whether every record so far has been fsynced
+	spilled       bool         // Whether the database file was already changed
+}
+
+func open_rollback_journal(storage *Storage, file_name string, mode JournalMode) *rollback_journal {
+	return &rollback_journal{
+		storage:   storage,
+		mode:      mode,
+		file_name: file_name,
+		journaled: make(map[int]bool),
+	}
+}
+
+func (journal *rollback_journal) read_page(page_number int) ([]byte, error) {
+	return nil, nil
+}
+
+// begin opens the journal for a new transaction and writes its header
+func (journal *rollback_journal) begin() error {
+	file, err := os.OpenFile(journal.file_name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	journal.file = file
+	journal.nonce = rand.Uint32()
+	journal.page_size = journal.storage.page_size
+	journal.original_size = int(journal.storage.fileSize / int64(journal.page_size))
+
+	header := make([]byte, journalHeaderSize)
+	copy(header[0:8], journalMagic)
+	binary.BigEndian.PutUint32(header[8:12], uint32(journal.original_size))
+	binary.BigEndian.PutUint32(header[12:16], journal.nonce)
+	binary.BigEndian.PutUint32(header[16:20], uint32(journal.page_size))
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	journal.end = journalHeaderSize
+	journal.synced = false
+	return nil
+}
+
+func (journal *rollback_journal) preserve(page *Page) error {
+	if journal.mode == JournalModeOff {
+		return nil
+	}
+	if journal.file == nil {
+		if err := journal.begin(); err != nil {
+			return err
+		}
+	}
+	// Pages added by this transaction disappear when the file is truncated back
+	if page.page_number >= journal.original_size || journal.journaled[page.page_number] {
+		return nil
+	}
+
+	record := make([]byte, journal.page_size+8)
+	binary.BigEndian.PutUint32(record[0:4], uint32(page.page_number))
+	copy(record[4:4+journal.page_size], page.slotted_array)
+	binary.BigEndian.PutUint32(record[4+journal.page_size:], journal_checksum(journal.nonce, record[:4+journal.page_size]))
+	if _, err := journal.file.WriteAt(record, journal.end); err != nil {
+		return err
+	}
+	journal.end += int64(len(record))
+	journal.journaled[page.page_number] = true
+	journal.synced = false
+	return nil
+}
+
+func journal_checksum(nonce uint32, data []byte) uint32 {
+	var seed [4]byte
+	binary.BigEndian.PutUint32(seed[:], nonce)
+	return crc32.Update(crc32.ChecksumIEEE(seed[:]), crc32.IEEETable, data)
+}
+
+// sync makes sure every original image is on disk before the database file
+// is overwritten
+func (journal *rollback_journal) sync() error {
+	if journal.file == nil || journal.synced {
+		return nil
+	}
+	if err := journal.file.Sync(); err != nil {
+		return err
+	}
+	journal.synced = true
+	return nil
+}
+
+// spill has to overwrite the database file, so it waits for readers to leave
+func (journal *rollback_journal) spill(page *Page) error {
+	if err := journal.storage.lock(exclusiveLock); err != nil {
+		return err
+	}
+	if err := journal.sync(); err != nil {
+		return err
+	}
+	journal.spilled = true
+	return journal.storage.write_page_to_disk(page.page_number, page.slotted_array[:])
+}
+
+func (journal *rollback_journal) commit(pages []*Page, db_size int) error {
+	if err := journal.sync(); err != nil {
+		return err
+	}
+	for _, page := range pages {
+		if err := journal.storage.write_page_to_disk(page.page_number, page.slotted_array[:]); err != nil {
+			return err
+		}
+	}
+	if err := journal.storage.truncate(db_size); err != nil {
+		return err
+	}
+	if err := journal.storage.sync(); err != nil {
+		return err
+	}
+	// The transaction is committed the moment the journal stops being hot
+	return journal.finish()
+}
+
+func (journal *rollback_journal) rollback() error {
+	if journal.file != nil && journal.spilled {
+		if err := journal.sync(); err != nil {
+			return err
+		}
+		if err := play_back_journal(journal.storage, journal.file); err != nil {
+			return err
+		}
+	}
+	return journal.finish()
+}
+
+func (journal *rollback_journal) has_pending() bool {
+	return journal.spilled
+}
+
+// finish ends the transaction, retiring the journal the way mode asks for
+func (journal *rollback_journal) finish() error {
+	clear(journal.journaled)
+	journal.spilled = false
+	if journal.file == nil {
+		return nil
+	}
+
+	var err error
+	switch journal.mode {
+	case JournalModeTruncate:
+		if err = journal.file.Truncate(0); err == nil {
+			err = journal.file.Sync()
+		}
+	case JournalModePersist:
+		if _, err = journal.file.WriteAt(make([]byte, journalHeaderSize), 0); err == nil {
+			err = journal.file.Sync()
+		}
+	}
+	if close_err := journal.file.Close(); err == nil {
+		err = close_err
+	}
+	journal.file = nil
+	if err == nil && journal.mode == JournalModeDelete {
+		err = os.Remove(journal.file_name)
+	}
+	return err
+}
+
+func (journal *rollback_journal) refresh() (bool, error) {
+	return false, nil
+}
+
+// changed has nothing to look for, other connections can only commit to the
+// database file under Exclusive, which never overlaps this connection's Shared
+func (journal *rollback_journal) changed() (bool, error) {
+	return false, nil
+}
+
+func (journal *rollback_journal) checkpoint() error {
+	return nil
+}
+
+func (journal *rollback_journal) close() error {
+	return journal.rollback()
+}
+
+// play_back_journal copies every intact original image in a journal back
+// into the database file and truncates it to its pre-transaction size
+func play_back_journal(storage *Storage, file *os.File) error {
+	header := make([]byte, journalHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	page_size := int(binary.BigEndian.Uint32(header[16:20]))
+	if string(header[0:8]) != journalMagic || !valid_page_size(page_size) {
+		return nil
+	}
+	original_size := int(binary.BigEndian.Uint32(header[8:12]))
+	nonce := binary.BigEndian.Uint32(header[12:16])
+	// The journal's page size is the database's, even if its header page was torn
+	storage.page_size = page_size
+
+	record := make([]byte, page_size+8)
+	for offset := int64(journalHeaderSize); ; offset += int64(len(record)) {
+		if _, err := file.ReadAt(record, offset); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		// A torn record was never synced, so the database page wasn't touched
+		if binary.BigEndian.Uint32(record[4+page_size:]) != journal_checksum(nonce, record[:4+page_size]) {
+			break
+		}
+		page_number := int(binary.BigEndian.Uint32(record[0:4]))
+		if err := storage.write_page_to_disk(page_number, record[4:4+page_size]); err != nil {
+			return err
+		}
+	}
+
+	if size := int64(original_size) * int64(page_size); storage.fileSize > size {
+		if err := storage.file.Truncate(size); err != nil {
+			return err
+		}
+		storage.fileSize = size
+	}
+	return storage.sync()
+}
+
+// journal_is_hot reports whether a journal still holds the original pages
+// of a transaction that never finished
+func journal_is_hot(file_name string) bool {
+	file, err := os.Open(file_name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	header := make([]byte, len(journalMagic))
+	n, _ := file.ReadAt(header, 0)
+	return n == len(header) && string(header) == journalMagic
+}
+
+// recover_hot_journal rolls back whatever transaction a crash interrupted
+// while a rollback journal was in use, then removes the journal
+func recover_hot_journal(storage *Storage, file_name string) error {
+	file, err := os.OpenFile(file_name, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = play_back_journal(storage, file)
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(file_name)
+}
@@ -0,0 +1,149 @@
+package storage_manager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJournalModesFinishTransactions(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeDelete, JournalModeTruncate, JournalModePersist, JournalModeOff} {
+		t.Run(mode.String(), func(t *testing.T) {
+			file_name := filepath.Join(t.TempDir(), "Boots.db")
+			btree := open_test_btree_in_mode(t, file_name, mode)
+			for key := 0; key < 300; key++ {
+				btree.Insert(uint32(key), []any{"cat", int64(key)})
+			}
+			if err := btree.pager.FlushCache(); err != nil {
+				t.Fatalf("FlushCache: %v", err)
+			}
+
+			info, err := os.Stat(file_name + "-journal")
+			switch mode {
+			case JournalModeDelete, JournalModeOff:
+				if !os.IsNotExist(err) {
+					t.Errorf("Expected no journal file, got %v", err)
+				}
+			case JournalModeTruncate:
+				if err != nil || info.Size() != 0 {
+					t.Errorf("Expected an empty journal file, got %v %v", info, err)
+				}
+			case JournalModePersist:
+				header := make([]byte, journalHeaderSize)
+				file, err := os.Open(file_name + "-journal")
+				if err != nil {
+					t.Fatalf("Expected the journal file to persist: %v", err)
+				}
+				file.ReadAt(header, 0)
+				file.Close()
+				if string(header[0:8]) == journalMagic {
+					t.Error("Expected the persisted journal header to be zeroed")
+				}
+			}
+			if _, err := os.Stat(file_name + "-wal"); !os.IsNotExist(err) {
+				t.Errorf("Expected no WAL in %v mode", mode)
+			}
+
+			crash(btree)
+			reopened := open_test_btree_in_mode(t, file_name, mode)
+			if n := count_records(t, reopened); n != 300 {
+				t.Errorf("Expected 300 records after reopening, got %d", n)
+			}
+		})
+	}
+}
+
+func TestHotJournalIsRolledBack(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree_in_mode(t, file_name, JournalModeDelete)
+	for key := 0; key < 200; key++ {
+		btree.Insert(uint32(key), []any{"cat", int64(key)})
+	}
+	if err := btree.pager.FlushCache(); err != nil {
+		t.Fatalf("FlushCache: %v", err)
+	}
+	committed, _ := os.ReadFile(file_name)
+
+	// A tiny cache forces the open transaction to overwrite database pages
+	btree.pager.SetCacheSize(4)
+	payload := strings.Repeat("whiskers", 40)
+	transaction, _ := btree.Begin()
+	for key := 200; key < 1000; key++ {
+		transaction.Insert(uint32(key), []any{payload})
+	}
+	for key := 0; key < 200; key += 2 {
+		transaction.Delete(uint32(key))
+	}
+	if !btree.pager.storage.has_uncommitted() {
+		t.Fatal("Expected pages to be spilled into the database file")
+	}
+	crash(btree)
+
+	reopened := open_test_btree_in_mode(t, file_name, JournalModeDelete)
+	if n := count_records(t, reopened); n != 200 {
+		t.Errorf("Expected the 200 committed records, got %d", n)
+	}
+	if _, err := os.Stat(file_name + "-journal"); !os.IsNotExist(err) {
+		t.Errorf("Expected the hot journal to be removed, got %v", err)
+	}
+	if restored, _ := os.ReadFile(file_name); string(restored) != string(committed) {
+		t.Error("Expected the database file to match its committed image")
+	}
+}
+
+func TestTornJournalRecordIsIgnored(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree_in_mode(t, file_name, JournalModePersist)
+	for key := 0; key < 200; key++ {
+		btree.Insert(uint32(key), []any{"cat", int64(key)})
+	}
+	transaction, _ := btree.Begin()
+	transaction.Insert(200, []any{"cat", int64(200)})
+	journal := btree.pager.storage.journal.(*rollback_journal)
+	journal.sync()
+	crash(btree)
+
+	// Garble the end of the last record, which was never fsynced for real
+	file, _ := os.OpenFile(file_name+"-journal", os.O_RDWR, 0)
+	info, _ := file.Stat()
+	file.WriteAt([]byte{0xff, 0xff}, info.Size()-2)
+	file.Close()
+
+	reopened := open_test_btree_in_mode(t, file_name, JournalModePersist)
+	if n := count_records(t, reopened); n != 200 {
+		t.Errorf("Expected 200 records, got %d", n)
+	}
+}
+
+func TestSwitchingFromWALReplaysIt(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	for key := 0; key < 300; key++ {
+		btree.Insert(uint32(key), []any{"cat", int64(key)})
+	}
+	btree.pager.FlushCache()
+	crash(btree)
+
+	reopened := open_test_btree_in_mode(t, file_name, JournalModeTruncate)
+	if n := count_records(t, reopened); n != 300 {
+		t.Errorf("Expected 300 records, got %d", n)
+	}
+	if _, err := os.Stat(file_name + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("Expected the WAL to be removed after switching modes, got %v", err)
+	}
+}
+
+func TestUnknownJournalMode(t *testing.T) {
+	if _, err := InitializeStorage(filepath.Join(t.TempDir(), "Boots.db"), JournalMode(42)); err == nil {
+		t.Error("Expected an error for an unknown journal mode")
+	}
+}
+
+func TestRollbackJournalSurvivesKilledProcess(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeDelete, JournalModeTruncate, JournalModePersist} {
+		t.Run(mode.String(), func(t *testing.T) {
+			kill_child_mid_commit(t, mode)
+		})
+	}
+}
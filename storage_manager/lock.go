@@ -0,0 +1,408 @@
+/**
+ * File Locking (modeled on SQLite's rollback journal locking)
+ *
+ * **Lock States (per connection):**
+ * - None: nothing is read or written
+ * - Shared: the connection is reading, any number of connections can be
+ * - Reserved: the connection will write at commit, only one at a time, and
+ *   new readers are still let in
+ * - Pending: the writer is waiting for readers to leave, no new ones get in
+ * - Exclusive: the writer is changing the database file, nobody else is in
+ *
+ * **POSIX Advisory Lock Bytes (never read or written, past any real data):**
+ * - 0x40000000: Pending byte, write locked for Pending, briefly read locked
+ *   by readers so they can't sneak in while a writer is pending
+ * - 0x40000001: Reserved byte, write locked for Reserved
+ * - 0x40000002-0x400001ff: Shared range, read locked for Shared and write
+ *   locked for Exclusive
+ *
+ * POSIX locks belong to a process and every one of them is dropped when any
+ * descriptor on the file is closed, so all connections in a process share a
+ * single descriptor and an inode_lock that decides between them before the
+ * process lock is touched.
+ */
+
+package storage_manager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type lock_level int
+
+const (
+	noLock lock_level = iota
+	sharedLock
+	reservedLock
+	pendingLock
+	exclusiveLock
+)
+
+const (
+	pendingByte  = 0x40000000
+	reservedByte = pendingByte + 1
+	sharedFirst  = pendingByte + 2
+	sharedSize   = 510
+)
+
+var (
+	ErrBusy = errors.New("database is locked")
+	// ErrBusySnapshot is an ErrBusy that waiting won't fix, the transaction
+	// read a snapshot another connection has since committed on top of
+	ErrBusySnapshot = fmt.Errorf("%w: snapshot is out of date", ErrBusy)
+)
+
+type inode_lock struct {
+	mutex  sync.Mutex
+	path   string
+	file   *os.File
+	refs   int
+	shared int        // Connections in this process holding Shared or above
+	level  lock_level // Strongest lock this process holds on file
+}
+
+var (
+	inode_locks       = make(map[string]*inode_lock)
+	inode_locks_mutex sync.Mutex
+)
+
+// open_inode_lock returns the process wide lock of a database file, opening
+// the descriptor every connection in the process shares
+func open_inode_lock(file_name string) (*inode_lock, error) {
+	path, err := filepath.Abs(file_name)
+	if err != nil {
+		return nil, err
+	}
+	inode_locks_mutex.Lock()
+	defer inode_locks_mutex.Unlock()
+
+	if inode, found := inode_locks[path]; found {
+		inode.refs += 1
+		return inode, nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	inode := &inode_lock{path: path, file: file, refs: 1}
+	inode_locks[path] = inode
+	return inode, nil
+}
+
+// close drops a connection's reference, closing the descriptor once the
+// last connection in the process is gone
+func (inode *inode_lock) close() error {
+	inode_locks_mutex.Lock()
+	defer inode_locks_mutex.Unlock()
+
+	inode.refs -= 1
+	if inode.refs > 0 {
+		return nil
+	}
+	delete(inode_locks, inode.path)
+	return inode.file.Close()
+}
+
+// acquire moves storage up to level, one step above its current level,
+// without waiting. It returns false if another connection is in the way
+func (inode *inode_lock) acquire(storage *Storage, level lock_level) (bool, error) {
+	inode.mutex.Lock()
+	defer inode.mutex.Unlock()
+
+	switch level {
+	case sharedLock:
+		if inode.level >= pendingLock {
+			return false, nil
+		}
+		if inode.shared == 0 {
+			// Checking the pending byte keeps readers from starving a writer
+			if locked, err := posix_lock(inode.file, false, pendingByte, 1); !locked || err != nil {
+				return false, err
+			}
+			locked, err := posix_lock(inode.file, false, sharedFirst, sharedSize)
+			if unlock_err := posix_unlock(inode.file, pendingByte, 1); err == nil {
+				err = unlock_err
+			}
+			if !locked || err != nil {
+				return false, err
+			}
+			inode.level = sharedLock
+		}
+		inode.shared += 1
+
+	case reservedLock:
+		if inode.level >= reservedLock {
+			// Another connection in this process is already writing
+			return false, nil
+		}
+		if locked, err := posix_lock(inode.file, true, reservedByte, 1); !locked || err != nil {
+			return false, err
+		}
+		inode.level = reservedLock
+
+	case pendingLock:
+		if locked, err := posix_lock(inode.file, true, pendingByte, 1); !locked || err != nil {
+			return false, err
+		}
+		inode.level = pendingLock
+
+	case exclusiveLock:
+		if inode.shared > 1 {
+			return false, nil
+		}
+		if locked, err := posix_lock(inode.file, true, sharedFirst, sharedSize); !locked || err != nil {
+			return false, err
+		}
+		inode.level = exclusiveLock
+	}
+	storage.lock_level = level
+	return true, nil
+}
+
+// release moves storage down to level. Only one connection can be above
+// Shared, so whatever the process holds beyond that belongs to storage
+func (inode *inode_lock) release(storage *Storage, level lock_level) error {
+	inode.mutex.Lock()
+	defer inode.mutex.Unlock()
+
+	var err error
+	from := storage.lock_level
+	if from == exclusiveLock && level < exclusiveLock {
+		_, err = posix_lock(inode.file, false, sharedFirst, sharedSize)
+	}
+	if from >= pendingLock && level < pendingLock && err == nil {
+		err = posix_unlock(inode.file, pendingByte, 1)
+	}
+	if from >= reservedLock && level < reservedLock && err == nil {
+		err = posix_unlock(inode.file, reservedByte, 1)
+	}
+	if from > sharedLock {
+		inode.level = max(level, sharedLock)
+	}
+	if from >= sharedLock && level == noLock {
+		inode.shared -= 1
+		if inode.shared == 0 {
+			if unlock_err := posix_unlock(inode.file, sharedFirst, sharedSize); err == nil {
+				err = unlock_err
+			}
+			inode.level = noLock
+		}
+	}
+	storage.lock_level = level
+	return err
+}
+
+// lock raises the connection's lock to level, retrying for up to the busy
+// timeout while other connections are in the way. A writer that times out
+// waiting for readers drops back to Reserved so they can finish
+func (storage *Storage) lock(level lock_level) error {
+	return storage.lock_within(level, storage.busy_timeout)
+}
+
+func (storage *Storage) lock_within(level lock_level, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for storage.lock_level < level {
+		next := storage.lock_level + 1
+		delay := time.Millisecond
+		for {
+			locked, err := storage.inode.acquire(storage, next)
+			if err != nil {
+				return err
+			}
+			if locked {
+				break
+			}
+			if !time.Now().Before(deadline) {
+				if storage.lock_level == pendingLock {
+					storage.inode.release(storage, reservedLock)
+				}
+				return ErrBusy
+			}
+			time.Sleep(min(delay, time.Until(deadline)))
+			delay = min(2*delay, 50*time.Millisecond)
+		}
+
+		if next == sharedLock {
+			if err := storage.start_reading(); err != nil {
+				storage.inode.release(storage, noLock)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// try_lock raises the connection's lock to level only if that doesn't mean
+// waiting on anyone
+func (storage *Storage) try_lock(level lock_level) (bool, error) {
+	err := storage.lock_within(level, 0)
+	if err == ErrBusy {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unlock lowers the connection's lock to level
+func (storage *Storage) unlock(level lock_level) error {
+	if storage.lock_level <= level {
+		return nil
+	}
+	return storage.inode.release(storage, level)
+}
+
+// start_reading runs as a connection takes its Shared lock. A hot journal
+// is rolled back first, then the connection catches up with whatever other
+// connections committed since it last looked
+func (storage *Storage) start_reading() error {
+	if journal_is_hot(storage.file_name + "-journal") {
+		// The journal is only hot if nobody holds Reserved to write it
+		locked, err := storage.inode.acquire(storage, reservedLock)
+		if err != nil {
+			return err
+		}
+		if locked {
+			err := storage.lock(exclusiveLock)
+			if err == nil {
+				err = recover_hot_journal(storage, storage.file_name+"-journal")
+			}
+			// Playing the journal back updates fileSize on the way, so refresh
+			// won't notice the database changed underneath the cache
+			storage.stale = true
+			if unlock_err := storage.unlock(sharedLock); err == nil {
+				err = unlock_err
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	changed, err := storage.refresh()
+	storage.stale = storage.stale || changed
+	return err
+}
+
+// SetBusyTimeout sets how long a connection keeps retrying a lock another
+// connection holds before giving up with ErrBusy
+func (pager *Pager) SetBusyTimeout(timeout time.Duration) {
+	pager.storage.busy_timeout = timeout
+}
+
+// SetBusyTimeout sets the busy timeout of the tree's connection, see
+// Pager.SetBusyTimeout
+func (btree *BTree) SetBusyTimeout(timeout time.Duration) {
+	btree.pager.SetBusyTimeout(timeout)
+}
+
+// begin_read makes sure the connection holds at least a Shared lock, and
+// drops cached pages another connection may have changed since it last did
+func (pager *Pager) begin_read() error {
+	if pager.storage.lock_level >= sharedLock {
+		return nil
+	}
+	if err := pager.storage.lock(sharedLock); err != nil {
+		return err
+	}
+	if pager.storage.stale {
+		if err := pager.reset_cache(); err != nil {
+			pager.storage.unlock(noLock)
+			return err
+		}
+		pager.storage.stale = false
+	}
+	return nil
+}
+
+// begin_write makes sure the connection holds at least a Reserved lock.
+// Waiting for another writer while holding Shared would keep that writer
+// from ever committing, so unless a transaction already read under its
+// Shared lock the connection steps away between tries
+func (pager *Pager) begin_write() error {
+	if pager.storage.lock_level >= reservedLock {
+		return nil
+	}
+	deadline := time.Now().Add(pager.storage.busy_timeout)
+	delay := time.Millisecond
+	has_read := pager.storage.lock_level >= sharedLock
+	for {
+		if err := pager.begin_read(); err != nil {
+			return err
+		}
+		locked, err := pager.storage.try_lock(reservedLock)
+		if err != nil {
+			return err
+		}
+		if !locked && has_read {
+			if err := pager.storage.lock_within(reservedLock, time.Until(deadline)); err != nil {
+				return err
+			}
+			locked = true
+		}
+		if locked {
+			return pager.check_snapshot(has_read)
+		}
+		if err := pager.storage.unlock(noLock); err != nil {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			return ErrBusy
+		}
+		time.Sleep(min(delay, time.Until(deadline)))
+		delay = min(2*delay, 50*time.Millisecond)
+	}
+}
+
+// check_snapshot runs once a writer holds Reserved. Another connection may
+// have committed to the WAL since this one took its snapshot, and writing on
+// top of an old snapshot would silently undo that commit. A connection that
+// hasn't read anything yet simply moves up to the newest snapshot, one that
+// has gets ErrBusySnapshot and has to roll back and start over
+func (pager *Pager) check_snapshot(has_read bool) error {
+	changed, err := pager.storage.has_changed()
+	if err != nil || !changed {
+		return err
+	}
+	if has_read {
+		return ErrBusySnapshot
+	}
+	if _, err := pager.storage.refresh(); err != nil {
+		return err
+	}
+	return pager.reset_cache()
+}
+
+// unlock gives up as much of the connection's lock as it can. Uncommitted
+// changes keep the lock where it is, open cursors and transactions keep Shared
+func (pager *Pager) unlock() error {
+	if len(pager.written) != 0 || pager.storage.has_uncommitted() {
+		return nil
+	}
+	if pager.holds > 0 {
+		return pager.storage.unlock(sharedLock)
+	}
+	return pager.storage.unlock(noLock)
+}
+
+// reset_cache forgets every cached page and rereads the database size
+func (pager *Pager) reset_cache() error {
+	pager.changes += 1
+	for _, page := range pager.cache.content {
+		if page.pin_count == 0 {
+			pager.cache.remove(page)
+			continue
+		}
+		slotted_array, err := pager.storage.read_page_from_disk(page.page_number)
+		if err != nil {
+			return err
+		}
+		page.slotted_array = slotted_array
+	}
+	pager.num_pages = pager.storage.database_pages()
+	pager.committed_pages = pager.num_pages
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package storage_manager
+
+import "os"
+
+// Without POSIX advisory locks only connections inside one process are
+// kept apart, by inode_lock
+func posix_lock(file *os.File, exclusive bool, start int64, length int64) (bool, error) {
+	return true, nil
+}
+
+func posix_unlock(file *os.File, start int64, length int64) error {
+	return nil
+}
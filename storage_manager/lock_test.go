@@ -0,0 +1,361 @@
+package storage_manager
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriterWaitsForReaders(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	reader := open_test_btree_in_mode(t, file_name, JournalModeDelete)
+	writer := open_test_btree_in_mode(t, file_name, JournalModeDelete)
+	if err := writer.Insert(0, []any{"cat"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+
+	cursor := reader.NewCursor()
+	if !cursor.First() {
+		t.Fatalf("Expected the reader to see key 0: %v", cursor.Err)
+	}
+	if reader.pager.storage.lock_level != sharedLock {
+		t.Fatalf("Expected an open cursor to hold Shared, got %d", reader.pager.storage.lock_level)
+	}
+
+	// A statement outside a transaction can't commit under the reader and
+	// rolls back rather than keep its lock
+	if err := writer.Insert(1, []any{"cat"}); err != ErrBusy {
+		t.Fatalf("Expected committing under a reader to get ErrBusy, got %v", err)
+	}
+	if writer.pager.storage.lock_level != noLock {
+		t.Errorf("Expected a statement that failed to drop the lock, got %d", writer.pager.storage.lock_level)
+	}
+
+	transaction, err := writer.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if err := transaction.Insert(1, []any{"cat"}); err != nil {
+		t.Fatalf("Insert while another connection reads: %v", err)
+	}
+	if err := reader.Insert(2, []any{"cat"}); err != ErrBusy {
+		t.Errorf("Expected a second writer to get ErrBusy, got %v", err)
+	}
+	if err := transaction.Commit(); err != ErrBusy {
+		t.Fatalf("Expected committing under a reader to get ErrBusy, got %v", err)
+	}
+	if writer.pager.storage.lock_level != reservedLock {
+		t.Errorf("Expected a writer that gave up to fall back to Reserved, got %d", writer.pager.storage.lock_level)
+	}
+
+	cursor.Close()
+	if reader.pager.storage.lock_level != noLock {
+		t.Errorf("Expected closing the cursor to drop the lock, got %d", reader.pager.storage.lock_level)
+	}
+	if err := transaction.Commit(); err != nil {
+		t.Fatalf("Commit once the reader left: %v", err)
+	}
+	if writer.pager.storage.lock_level != noLock {
+		t.Errorf("Expected committing to drop the lock, got %d", writer.pager.storage.lock_level)
+	}
+	if n := count_records(t, reader); n != 2 {
+		t.Errorf("Expected 2 records, got %d", n)
+	}
+}
+
+func TestStatementsCommitOutsideTransactions(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeWAL, JournalModeDelete} {
+		t.Run(mode.String(), func(t *testing.T) {
+			file_name := filepath.Join(t.TempDir(), "Boots.db")
+			first := open_test_btree_in_mode(t, file_name, mode)
+			second := open_test_btree_in_mode(t, file_name, mode)
+			if err := first.Insert(0, []any{"cat"}); err != nil {
+				t.Fatalf("Insert: %v", err)
+			}
+			if first.pager.storage.lock_level != noLock || len(first.pager.written) != 0 {
+				t.Errorf("Expected Insert to commit and drop the lock, got lock %d", first.pager.storage.lock_level)
+			}
+
+			// Neither connection waits on the other between statements
+			if err := second.Update(0, []any{"dog"}); err != nil {
+				t.Fatalf("Update from another connection: %v", err)
+			}
+			if err := first.Insert(1, []any{"cat"}); err != nil {
+				t.Fatalf("Insert after the other connection wrote: %v", err)
+			}
+			if err := second.Delete(1); err != nil {
+				t.Fatalf("Delete from another connection: %v", err)
+			}
+			if err := first.Insert(1, []any{"cat"}); err != nil {
+				t.Fatalf("Insert after the other connection deleted: %v", err)
+			}
+
+			// A failed statement leaves nothing behind either
+			if err := second.Insert(1, []any{"dog"}); err != ErrDuplicateKey {
+				t.Errorf("Expected ErrDuplicateKey, got %v", err)
+			}
+			if second.pager.storage.lock_level != noLock {
+				t.Errorf("Expected a failed statement to drop the lock, got %d", second.pager.storage.lock_level)
+			}
+
+			crash(first)
+			crash(second)
+			reopened := open_test_btree_in_mode(t, file_name, mode)
+			for key, want := range []string{"dog", "cat"} {
+				record, err := reopened.Get(uint32(key))
+				if err != nil || !reflect.DeepEqual(record.Values, []any{want}) {
+					t.Errorf("Get(%d) = %v, %v, expected %v", key, record, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBusyTimeoutWaitsForLock(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	reader := open_test_btree_in_mode(t, file_name, JournalModeDelete)
+	writer := open_test_btree_in_mode(t, file_name, JournalModeDelete)
+	if err := writer.Insert(0, []any{"cat"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+
+	transaction, _ := reader.Begin()
+	if _, err := reader.Get(0); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		transaction.Commit()
+	}()
+
+	writer.pager.SetBusyTimeout(5 * time.Second)
+	start := time.Now()
+	if err := writer.Insert(1, []any{"cat"}); err != nil {
+		t.Fatalf("Expected the busy timeout to outlast the reader, got %v", err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("Expected the writer to wait for the reader, it waited %v", waited)
+	}
+}
+
+func TestOpenWaitsForCommits(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	writer := open_test_btree_in_mode(t, file_name, JournalModeDelete)
+	if err := writer.Insert(0, []any{"cat"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+
+	// A writer part way through committing keeps new readers out
+	transaction, _ := writer.Begin()
+	transaction.Insert(1, []any{"cat"})
+	if err := writer.pager.storage.lock(exclusiveLock); err != nil {
+		t.Fatalf("Locking Exclusive: %v", err)
+	}
+	if _, err := OpenInMode(file_name, JournalModeDelete); err != ErrBusy {
+		t.Fatalf("Expected opening without a busy timeout to get ErrBusy, got %v", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		transaction.Commit()
+	}()
+
+	start := time.Now()
+	reader, err := OpenWithBusyTimeout(file_name, JournalModeDelete, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Expected the busy timeout to outlast the commit, got %v", err)
+	}
+	defer reader.Close()
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("Expected opening to wait for the commit, it waited %v", waited)
+	}
+	if n := count_records(t, reader); n != 2 {
+		t.Errorf("Expected 2 records, got %d", n)
+	}
+}
+
+func TestConnectionsSeeEachOthersCommits(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeWAL, JournalModeDelete} {
+		t.Run(mode.String(), func(t *testing.T) {
+			file_name := filepath.Join(t.TempDir(), "Boots.db")
+			first := open_test_btree_in_mode(t, file_name, mode)
+			second := open_test_btree_in_mode(t, file_name, mode)
+			for key := 0; key < 300; key++ {
+				if err := first.Insert(uint32(key), []any{"old"}); err != nil {
+					t.Fatalf("Insert(%d): %v", key, err)
+				}
+			}
+			if n := count_records(t, second); n != 300 {
+				t.Fatalf("Expected the second connection to see 300 records, got %d", n)
+			}
+
+			transaction, err := second.Begin()
+			if err != nil {
+				t.Fatalf("Begin: %v", err)
+			}
+			for key := 0; key < 300; key += 2 {
+				if err := transaction.Update(uint32(key), []any{"new"}); err != nil {
+					t.Fatalf("Update(%d): %v", key, err)
+				}
+			}
+			for key := 300; key < 600; key++ {
+				if err := transaction.Insert(uint32(key), []any{"new"}); err != nil {
+					t.Fatalf("Insert(%d): %v", key, err)
+				}
+			}
+			if err := transaction.Commit(); err != nil {
+				t.Fatalf("Commit: %v", err)
+			}
+
+			if n := count_records(t, first); n != 600 {
+				t.Fatalf("Expected the first connection to see 600 records, got %d", n)
+			}
+			for key := 0; key < 600; key++ {
+				record, err := first.Get(uint32(key))
+				if err != nil {
+					t.Fatalf("Get(%d): %v", key, err)
+				}
+				want := []any{"new"}
+				if key < 300 && key%2 == 1 {
+					want = []any{"old"}
+				}
+				if !reflect.DeepEqual(record.Values, want) {
+					t.Fatalf("Get(%d) = %v, expected %v", key, record.Values, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeWAL, JournalModeDelete} {
+		t.Run(mode.String(), func(t *testing.T) {
+			file_name := filepath.Join(t.TempDir(), "Boots.db")
+			shared := open_test_btree_in_mode(t, file_name, mode)
+			shared.pager.SetBusyTimeout(10 * time.Second)
+
+			const writers, per_writer = 6, 100
+			var group sync.WaitGroup
+			errors := make(chan error, 2*writers)
+			for writer := 0; writer < writers; writer++ {
+				// Half the writers get their own connection, half share one
+				btree := shared
+				if writer%2 == 0 {
+					btree = open_test_btree_in_mode(t, file_name, mode)
+					btree.pager.SetBusyTimeout(10 * time.Second)
+				}
+				group.Add(1)
+				go func(writer int, btree *BTree) {
+					defer group.Done()
+					for i := 0; i < per_writer; i++ {
+						key := uint32(writer*per_writer + i)
+						transaction, err := btree.Begin()
+						for err == ErrTransactionActive {
+							// Another goroutine on this connection is mid transaction
+							time.Sleep(time.Millisecond)
+							transaction, err = btree.Begin()
+						}
+						if err == nil {
+							err = transaction.Insert(key, []any{"cat", int64(key)})
+						}
+						if err == nil {
+							err = transaction.Commit()
+						} else if transaction != nil {
+							transaction.Rollback()
+						}
+						if err != nil {
+							errors <- fmt.Errorf("writer %d key %d: %w", writer, key, err)
+							return
+						}
+					}
+				}(writer, btree)
+			}
+			group.Wait()
+			close(errors)
+			for err := range errors {
+				t.Error(err)
+			}
+
+			if n := count_records(t, shared); n != writers*per_writer {
+				t.Errorf("Expected %d records, got %d", writers*per_writer, n)
+			}
+		})
+	}
+}
+
+// TestLockChild is run by TestLocksWorkAcrossProcesses in a separate process
+// that reads inside a transaction and holds its Shared lock until killed
+func TestLockChild(t *testing.T) {
+	file_name := os.Getenv("BOOTS_LOCK_DB")
+	if file_name == "" {
+		t.Skip("only runs as the child of TestLocksWorkAcrossProcesses")
+	}
+	mode, _ := strconv.Atoi(os.Getenv("BOOTS_LOCK_MODE"))
+	storage, err := InitializeStorage(file_name, JournalMode(mode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	btree := InitializeBtree(InitializePager(storage))
+	if _, err := btree.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := btree.Get(0); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println("locked")
+	time.Sleep(time.Minute)
+}
+
+func TestLocksWorkAcrossProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("spawns a child process")
+	}
+	for _, mode := range []JournalMode{JournalModeWAL, JournalModeDelete} {
+		t.Run(mode.String(), func(t *testing.T) {
+			file_name := filepath.Join(t.TempDir(), "Boots.db")
+			btree := open_test_btree_in_mode(t, file_name, mode)
+			if err := btree.Insert(0, []any{"cat"}); err != nil {
+				t.Fatal(err)
+			}
+
+			child := exec.Command(os.Args[0], "-test.run=^TestLockChild$")
+			child.Env = append(os.Environ(), "BOOTS_LOCK_DB="+file_name, fmt.Sprintf("BOOTS_LOCK_MODE=%d", int(mode)))
+			stdout, err := child.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := child.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer child.Process.Kill()
+			lines := bufio.NewScanner(stdout)
+			for lines.Scan() && lines.Text() != "locked" {
+			}
+
+			err = btree.Insert(1, []any{"cat"})
+			if mode == JournalModeWAL && err != nil {
+				t.Fatalf("Expected a WAL commit to go ahead while another process reads, got %v", err)
+			}
+			if mode != JournalModeWAL && err != ErrBusy {
+				t.Fatalf("Expected ErrBusy while another process reads, got %v", err)
+			}
+
+			child.Process.Kill()
+			child.Wait()
+			if mode != JournalModeWAL {
+				if err := btree.Insert(1, []any{"cat"}); err != nil {
+					t.Fatalf("Insert after the other process died: %v", err)
+				}
+			}
+			if n := count_records(t, btree); n != 2 {
+				t.Errorf("Expected 2 records, got %d", n)
+			}
+		})
+	}
+}
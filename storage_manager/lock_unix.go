@@ -0,0 +1,38 @@
+//go:build unix
+
+package storage_manager
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// posix_lock takes a POSIX advisory lock on length bytes from start without
+// waiting, returning false if another process holds a conflicting lock
+func posix_lock(file *os.File, exclusive bool, start int64, length int64) (bool, error) {
+	lock_type := int16(syscall.F_RDLCK)
+	if exclusive {
+		lock_type = syscall.F_WRLCK
+	}
+	err := syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &syscall.Flock_t{
+		Type:   lock_type,
+		Whence: io.SeekStart,
+		Start:  start,
+		Len:    length,
+	})
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func posix_unlock(file *os.File, start int64, length int64) error {
+	return syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &syscall.Flock_t{
+		Type:   syscall.F_UNLCK,
+		Whence: io.SeekStart,
+		Start:  start,
+		Len:    length,
+	})
+}
@@ -0,0 +1,244 @@
+// Node accessors read and write the B+ tree node header and slotted array
+// described at the top of btree.go directly on a cached Page
+package storage_manager
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	dbHeaderSize   = 100
+	nodeHeaderSize = 21
+
+	leafFlag     = 0x01
+	internalFlag = 0x00
+
+	leafCellHeaderSize = 10 // 4-byte key + 4-byte payload size + 2-byte local size
+	internalCellSize   = 8  // 4-byte child pointer + 4-byte key
+)
+
+// The root lives on page 0 and shares it with the database metadata header
+func (page *Page) header_offset() int {
+	if page.page_number == 0 {
+		return dbHeaderSize
+	}
+	return 0
+}
+
+func (page *Page) field16(offset int) int {
+	start := page.header_offset() + offset
+	return int(binary.BigEndian.Uint16(page.slotted_array[start : start+2]))
+}
+
+func (page *Page) set_field16(offset int, value int) {
+	start := page.header_offset() + offset
+	binary.BigEndian.PutUint16(page.slotted_array[start:start+2], uint16(value))
+}
+
+func (page *Page) field32(offset int) int {
+	start := page.header_offset() + offset
+	return int(binary.BigEndian.Uint32(page.slotted_array[start : start+4]))
+}
+
+func (page *Page) set_field32(offset int, value int) {
+	start := page.header_offset() + offset
+	binary.BigEndian.PutUint32(page.slotted_array[start:start+4], uint32(value))
+}
+
+func (page *Page) is_leaf() bool {
+	return page.slotted_array[page.header_offset()+4] == leafFlag
+}
+
+func (page *Page) cell_count() int           { return page.field16(5) }
+func (page *Page) free_bytes() int           { return page.field16(9 + page.internal_shift()) }
+func (page *Page) rightmost_child() int      { return page.field32(7) }
+func (page *Page) set_rightmost_child(n int) { page.set_field32(7, n) }
+func (page *Page) next_sibling() int         { return page.field32(13) }
+func (page *Page) set_next_sibling(n int)    { page.set_field32(13, n) }
+func (page *Page) prev_sibling() int         { return page.field32(17) }
+func (page *Page) set_prev_sibling(n int)    { page.set_field32(17, n) }
+
+// Internal nodes keep free bytes at 11-12 because 7-10 holds the rightmost child
+func (page *Page) internal_shift() int {
+	if page.is_leaf() {
+		return 0
+	}
+	return 2
+}
+
+// usable_space is the number of bytes available to pointers and cells
+func (page *Page) usable_space() int {
+	return len(page.slotted_array) - page.header_offset() - nodeHeaderSize
+}
+
+func (page *Page) used_space() int {
+	return page.usable_space() - page.free_bytes()
+}
+
+// init_node clears the page and writes an empty node header of the given kind
+func (page *Page) init_node(flags byte) {
+	start := page.header_offset()
+	clear(page.slotted_array[start:])
+	page.slotted_array[start+4] = flags
+	page.set_field32(0, page.page_number)
+	page.write_cells(nil)
+}
+
+// cell returns the raw bytes of the i-th cell in key order. A damaged page
+// whose pointer, cell header or cell runs off the page is ErrCorrupt
+func (page *Page) cell(i int) ([]byte, error) {
+	flags := page.slotted_array[page.header_offset()+4]
+	if flags != leafFlag && flags != internalFlag {
+		return nil, fmt.Errorf("%w: page %d has node flags %d", ErrCorrupt, page.page_number, flags)
+	}
+	page_size := len(page.slotted_array)
+	body := page.header_offset() + nodeHeaderSize
+	pointer := body + 2*i
+	if i < 0 || pointer+2 > page_size {
+		return nil, fmt.Errorf("%w: page %d has no room for cell %d", ErrCorrupt, page.page_number, i)
+	}
+	offset := int(binary.BigEndian.Uint16(page.slotted_array[pointer : pointer+2]))
+	size := internalCellSize
+	if page.is_leaf() {
+		if offset+leafCellHeaderSize > page_size {
+			return nil, fmt.Errorf("%w: cell %d of page %d starts at %d", ErrCorrupt, i, page.page_number, offset)
+		}
+		header := page.slotted_array[offset : offset+leafCellHeaderSize]
+		payload_size, local_size := int(binary.BigEndian.Uint32(header[4:8])), int(binary.BigEndian.Uint16(header[8:10]))
+		if local_size > payload_size {
+			return nil, fmt.Errorf("%w: cell %d of page %d holds more than its payload", ErrCorrupt, i, page.page_number)
+		}
+		size = leaf_cell_size(payload_size, local_size)
+	}
+	if offset < body+2*page.cell_count() || offset+size > page_size {
+		return nil, fmt.Errorf("%w: cell %d of page %d runs from %d to %d", ErrCorrupt, i, page.page_number, offset, offset+size)
+	}
+	return page.slotted_array[offset : offset+size], nil
+}
+
+// cells returns a copy of every cell so callers can rearrange them freely
+func (page *Page) cells() ([][]byte, error) {
+	cells := make([][]byte, page.cell_count())
+	for i := range cells {
+		cell, err := page.cell(i)
+		if err != nil {
+			return nil, err
+		}
+		cells[i] = append([]byte(nil), cell...)
+	}
+	return cells, nil
+}
+
+func (page *Page) cell_key(i int) (uint32, error) {
+	cell, err := page.cell(i)
+	if err != nil {
+		return 0, err
+	}
+	if page.is_leaf() {
+		return leaf_cell_key(cell), nil
+	}
+	return internal_cell_key(cell), nil
+}
+
+// cells_fit reports whether cells and their 2-byte pointers fit in the page
+func (page *Page) cells_fit(cells [][]byte) bool {
+	return cells_size(cells) <= page.usable_space()
+}
+
+func cells_size(cells [][]byte) int {
+	size := 0
+	for _, cell := range cells {
+		size += len(cell) + 2
+	}
+	return size
+}
+
+// write_cells rewrites the slotted array with cells in the given order. The
+// content area is packed against the end of the page, so any fragmentation
+// left behind by removed cells is compacted away
+func (page *Page) write_cells(cells [][]byte) {
+	start := page.header_offset()
+	body := start + nodeHeaderSize
+	clear(page.slotted_array[body:])
+
+	content := len(page.slotted_array)
+	total := 0
+	for i, cell := range cells {
+		content -= len(cell)
+		total += len(cell)
+		copy(page.slotted_array[content:], cell)
+		pointer := body + 2*i
+		binary.BigEndian.PutUint16(page.slotted_array[pointer:pointer+2], uint16(content))
+	}
+
+	page.set_field16(5, len(cells))
+	free := content - (body + 2*len(cells))
+	if page.is_leaf() {
+		page.set_field16(7, content%65536) // 0 on an empty 64 KiB page
+		page.set_field16(9, free)
+		page.set_field16(11, total)
+	} else {
+		page.set_field16(11, free)
+	}
+}
+
+// Cells whose payload spilled into overflow pages end with the first
+// overflow page number
+func leaf_cell_size(payload_size int, local_size int) int {
+	size := leafCellHeaderSize + local_size
+	if payload_size > local_size {
+		size += 4
+	}
+	return size
+}
+
+func leaf_cell(key uint32, payload_size int, local []byte, overflow int) []byte {
+	cell := make([]byte, leaf_cell_size(payload_size, len(local)))
+	binary.BigEndian.PutUint32(cell[0:4], key)
+	binary.BigEndian.PutUint32(cell[4:8], uint32(payload_size))
+	binary.BigEndian.PutUint16(cell[8:10], uint16(len(local)))
+	copy(cell[leafCellHeaderSize:], local)
+	if payload_size > len(local) {
+		binary.BigEndian.PutUint32(cell[len(cell)-4:], uint32(overflow))
+	}
+	return cell
+}
+
+func leaf_cell_key(cell []byte) uint32 {
+	return binary.BigEndian.Uint32(cell[0:4])
+}
+
+func leaf_cell_payload_size(cell []byte) int {
+	return int(binary.BigEndian.Uint32(cell[4:8]))
+}
+
+// leaf_cell_local returns the part of the payload stored in the leaf itself
+func leaf_cell_local(cell []byte) []byte {
+	local_size := int(binary.BigEndian.Uint16(cell[8:10]))
+	return cell[leafCellHeaderSize : leafCellHeaderSize+local_size]
+}
+
+// leaf_cell_overflow returns the first overflow page, or 0 when the whole
+// payload is local
+func leaf_cell_overflow(cell []byte) int {
+	if leaf_cell_payload_size(cell) == len(leaf_cell_local(cell)) {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(cell[len(cell)-4:]))
+}
+
+func internal_cell(child int, key uint32) []byte {
+	cell := make([]byte, internalCellSize)
+	binary.BigEndian.PutUint32(cell[0:4], uint32(child))
+	binary.BigEndian.PutUint32(cell[4:8], key)
+	return cell
+}
+
+func internal_cell_child(cell []byte) int {
+	return int(binary.BigEndian.Uint32(cell[0:4]))
+}
+
+func internal_cell_key(cell []byte) uint32 {
+	return binary.BigEndian.Uint32(cell[4:8])
+}
@@ -0,0 +1,143 @@
+/**
+ * Overflow Pages (payloads too large to keep whole in a leaf)
+ *
+ * A leaf cell keeps at most "max local" payload bytes. Bigger payloads keep a
+ * prefix in the cell and spill the rest into a chain of overflow pages, with
+ * the first overflow page number stored in the last 4 bytes of the cell.
+ *
+ * **Local Payload Thresholds (SQLite rules, usable = page size):**
+ * - max local = (usable - 12) * max payload fraction (header byte 23) / 255 - 23
+ * - min local = (usable - 12) * min payload fraction (header byte 24) / 255 - 23
+ * - local = min local + (payload - min local) % (usable - 4), or min local
+ *   when that would exceed max local, so the last overflow page fills up
+ *
+ * **Overflow Page:**
+ * - 0-3: Next overflow page (uint32_t, 0 on the last page)
+ * - 4 to the end of the page: Payload bytes
+ *
+ * The default fractions cap a leaf cell at roughly a quarter page, which
+ * keeps both halves of any split or redistribution within a page.
+ */
+
+package storage_manager
+
+import "encoding/binary"
+
+const overflowHeaderSize = 4
+
+func payload_fraction_limit(root *Page, header_byte int) int {
+	fraction := int(root.slotted_array[header_byte])
+	return (len(root.slotted_array)-12)*fraction/255 - 23
+}
+
+func max_local(root *Page) int {
+	return payload_fraction_limit(root, 23)
+}
+
+func min_local(root *Page) int {
+	return payload_fraction_limit(root, 24)
+}
+
+// local_payload_size returns how many bytes of a payload stay in the leaf
+func local_payload_size(root *Page, payload_size int) int {
+	max_local, min_local := max_local(root), min_local(root)
+	if payload_size <= max_local {
+		return payload_size
+	}
+	local := min_local + (payload_size-min_local)%(len(root.slotted_array)-overflowHeaderSize)
+	if local > max_local {
+		local = min_local
+	}
+	return local
+}
+
+// build_leaf_cell lays out payload as a leaf cell, writing whatever doesn't
+// stay local into a fresh overflow chain
+func (btree *BTree) build_leaf_cell(key uint32, payload []byte) ([]byte, error) {
+	root, err := btree.get_page(0)
+	if err != nil {
+		return nil, err
+	}
+	local_size := local_payload_size(root, len(payload))
+	overflow := 0
+	if local_size < len(payload) {
+		if overflow, err = btree.write_overflow(payload[local_size:]); err != nil {
+			return nil, err
+		}
+	}
+	return leaf_cell(key, len(payload), payload[:local_size], overflow), nil
+}
+
+// write_overflow stores data across newly allocated overflow pages and
+// returns the first page of the chain. Each page is let go of as soon as it
+// points at the next one, so a long chain never pins more than two pages
+func (btree *BTree) write_overflow(data []byte) (int, error) {
+	first := 0
+	var previous *Page
+	for len(data) > 0 {
+		page, err := btree.pager.AllocatePage()
+		if err != nil {
+			if previous != nil {
+				btree.pager.Unpin(previous)
+			}
+			return 0, err
+		}
+		n := copy(page.slotted_array[overflowHeaderSize:], data)
+		data = data[n:]
+		if previous == nil {
+			first = page.page_number
+		} else {
+			binary.BigEndian.PutUint32(previous.slotted_array[0:4], uint32(page.page_number))
+			btree.pager.Unpin(previous)
+		}
+		previous = page
+	}
+	if previous != nil {
+		btree.pager.Unpin(previous)
+	}
+	return first, nil
+}
+
+// read_payload reassembles a cell's payload from its local part and its
+// overflow chain, letting go of each overflow page once its bytes are copied
+func (btree *BTree) read_payload(cell []byte) ([]byte, error) {
+	local := leaf_cell_local(cell)
+	size := leaf_cell_payload_size(cell)
+	if size == len(local) {
+		return local, nil
+	}
+
+	payload := make([]byte, 0, size)
+	payload = append(payload, local...)
+	for next := leaf_cell_overflow(cell); len(payload) < size; {
+		if next == 0 {
+			return nil, ErrMalformedRecord
+		}
+		page, err := btree.pager.GetPage(next)
+		if err != nil {
+			return nil, err
+		}
+		n := min(size-len(payload), len(page.slotted_array)-overflowHeaderSize)
+		payload = append(payload, page.slotted_array[overflowHeaderSize:overflowHeaderSize+n]...)
+		next = int(binary.BigEndian.Uint32(page.slotted_array[0:4]))
+		btree.pager.Unpin(page)
+	}
+	return payload, nil
+}
+
+// free_overflow puts every page of a cell's overflow chain on the freelist
+func (btree *BTree) free_overflow(cell []byte) error {
+	for next := leaf_cell_overflow(cell); next != 0; {
+		page, err := btree.pager.GetPage(next)
+		if err != nil {
+			return err
+		}
+		next = int(binary.BigEndian.Uint32(page.slotted_array[0:4]))
+		err = btree.pager.FreePage(page)
+		btree.pager.Unpin(page)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
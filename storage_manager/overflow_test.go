@@ -0,0 +1,119 @@
+package storage_manager
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLocalPayloadHonorsHeaderFractions(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	btree.Insert(0, []any{"luna"})
+	root := get_test_page(t, btree, 0)
+
+	max_local, min_local := max_local(root), min_local(root)
+	if max_local != (defaultPageSize-12)*64/255-23 || min_local != (defaultPageSize-12)*32/255-23 {
+		t.Fatalf("Unexpected thresholds max %d min %d", max_local, min_local)
+	}
+	for _, size := range []int{1, max_local, max_local + 1, 3 * defaultPageSize, 100000} {
+		local := local_payload_size(root, size)
+		if local > max_local || (size > max_local && local < min_local) {
+			t.Errorf("Payload of %d bytes keeps %d bytes local", size, local)
+		}
+		if size <= max_local && local != size {
+			t.Errorf("Payload of %d bytes should stay local, kept %d", size, local)
+		}
+	}
+
+	// Lowering the max fraction makes smaller payloads spill
+	root.slotted_array[23] = 40
+	if local_payload_size(root, 800) == 800 {
+		t.Errorf("Expected an 800 byte payload to spill with max fraction 40")
+	}
+}
+
+func TestOverflowChainsRoundTrip(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+
+	random := rand.New(rand.NewSource(4))
+	avatars := map[uint32][]byte{}
+	for key := uint32(0); key < 60; key++ {
+		avatar := make([]byte, random.Intn(5*defaultPageSize))
+		random.Read(avatar)
+		avatars[key] = avatar
+		if err := btree.Insert(key, []any{"cat", avatar}); err != nil {
+			t.Fatalf("Insert(%d): %v", key, err)
+		}
+	}
+	check_node(t, btree, get_test_page(t, btree, 0), 0, 1<<32)
+	btree.pager.FlushCache()
+
+	reopened := open_test_btree(t, file_name)
+	for key, avatar := range avatars {
+		record, err := reopened.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%d): %v", key, err)
+		}
+		if !bytes.Equal(record.Values[1].([]byte), avatar) {
+			t.Fatalf("Avatar %d came back different", key)
+		}
+	}
+}
+
+func TestOverflowChainsStayWithinTheCache(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	btree.pager.SetCacheSize(8)
+	avatar := bytes.Repeat([]byte{7}, 40*defaultPageSize)
+
+	if err := btree.Insert(1, []any{avatar}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if n := len(btree.pager.cache.content); n > 8 {
+		t.Errorf("Writing the chain grew the cache to %d pages", n)
+	}
+	btree.pager.reset_cache()
+	record, err := btree.Get(1)
+	if err != nil || !bytes.Equal(record.Values[0].([]byte), avatar) {
+		t.Fatalf("Get(1) read back wrong: %v", err)
+	}
+	if n := len(btree.pager.cache.content); n > 8 {
+		t.Errorf("Reading the chain grew the cache to %d pages", n)
+	}
+}
+
+func TestUpdateMovesPayloadsInAndOutOfOverflow(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	document := bytes.Repeat([]byte(`{"name":"whiskers"},`), 1000)
+
+	btree.Insert(1, []any{"small"})
+	if err := btree.Update(1, []any{document}); err != nil {
+		t.Fatal(err)
+	}
+	record, _ := btree.Get(1)
+	if !reflect.DeepEqual(record.Values, []any{document}) {
+		t.Fatalf("Expected the document after growing into overflow pages")
+	}
+
+	if err := btree.Update(1, []any{"small again"}); err != nil {
+		t.Fatal(err)
+	}
+	record, _ = btree.Get(1)
+	if !reflect.DeepEqual(record.Values, []any{"small again"}) {
+		t.Fatalf("Get(1) = %v", record.Values)
+	}
+}
+
+func TestBrokenOverflowChainIsReported(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	btree.Insert(1, []any{bytes.Repeat([]byte{7}, 3*defaultPageSize)})
+
+	cell := test_cell(t, get_test_page(t, btree, 0), 0)
+	overflow := get_test_page(t, btree, leaf_cell_overflow(cell))
+	clear(overflow.slotted_array[0:4])
+	if _, err := btree.Get(1); err != ErrMalformedRecord {
+		t.Errorf("Expected ErrMalformedRecord for a truncated chain, got %v", err)
+	}
+}
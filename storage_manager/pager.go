@@ -1,53 +1,298 @@
 // The pager is resposible for managing the buffer pool and interacting with
 // the storage engine and b+ tree on what data needs to be written
+//
+// A connection, the BTree that Open returns and its pager, runs one operation
+// at a time. Goroutines can share a connection but take turns on its mutex,
+// readers included, since even a read moves pages through the cache, pins
+// them and changes the connection's file lock. Reads only run side by side on
+// separate Open handles, which in WAL mode don't block each other or a writer
 package storage_manager
 
 import (
 	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
 	"sync"
 )
 
+var ErrPageOutOfRange = errors.New("page number out of range")
+
 type Page struct {
-	slotted_array [4096]byte
+	slotted_array []byte
 	dirty         bool
 	page_number   int
+	pin_count     int           // Pinned pages are in use and can't be evicted
+	lru_element   *list.Element // The page's entry in PageCache.lruList
 }
 
 type PageCache struct {
 	content map[int]*Page
-	lruList *list.List   // Doubly-linked list for LRU eviction order (front = most recent, back = least recent).
-	maxSize int          // Maximum number of pages the cache can hold.
-	lock    sync.RWMutex // Mutex for thread-safe access (read-write lock for concurrency).
+	lruList *list.List // Doubly-linked list for LRU eviction order (front = most recent, back = least recent).
+	maxSize int        // Maximum number of pages the cache can hold.
 }
 
 type Pager struct {
-	cache   *PageCache
-	storage *Storage
+	cache     *PageCache
+	storage   *Storage
+	num_pages int // Pages in the database, including ones not yet written to disk
+
+	committed_pages int          // num_pages as of the last commit
+	written         map[int]bool // Pages the open transaction changed
+	savepoints      []*savepoint // Open savepoints, innermost last
+
+	mutex sync.Mutex // Serializes goroutines sharing this connection, readers too, see BTree.begin
+	holds int        // Open cursors and transactions, which keep a Shared lock
+
+	changes uint64 // Bumped whenever cached pages may change, so cursors know to re-seek
+}
+
+func (cache *PageCache) add(page *Page) {
+	page.lru_element = cache.lruList.PushFront(page)
+	cache.content[page.page_number] = page
+}
+
+func (cache *PageCache) remove(page *Page) {
+	cache.lruList.Remove(page.lru_element)
+	page.lru_element = nil
+	delete(cache.content, page.page_number)
 }
 
-func (pager *Pager) get_root() *Page {
-	var page *Page
+// touch marks page as the most recently used
+func (cache *PageCache) touch(page *Page) {
+	cache.lruList.MoveToFront(page.lru_element)
+}
+
+func (pager *Pager) get_root() (*Page, error) {
+	return pager.GetPage(0)
+}
+
+// GetPage returns page page_number from the cache, reading it from disk at
+// page_number times the page size on a miss. The page comes back pinned and callers
+// Unpin it once they are done with it
+func (pager *Pager) GetPage(page_number int) (*Page, error) {
+	if page_number < 0 || page_number >= pager.num_pages {
+		return nil, fmt.Errorf("%w: %d", ErrPageOutOfRange, page_number)
+	}
 
-	_, root_in_cache := pager.cache.content[0]
-	if root_in_cache {
-		page = pager.cache.content[0]
+	page, in_cache := pager.cache.content[page_number]
+	if in_cache {
+		pager.cache.touch(page)
 	} else {
-		root_slotted_array := pager.storage.get_root_from_disk()
+		slotted_array, err := pager.storage.read_page_from_disk(page_number)
+		if err != nil {
+			return nil, err
+		}
 		page = &Page{
-			slotted_array: *root_slotted_array,
+			slotted_array: slotted_array,
 			dirty:         false,
+			page_number:   page_number,
 		}
-		pager.cache.content[0] = page
+		if err := pager.evict(); err != nil {
+			return nil, err
+		}
+		pager.cache.add(page)
+	}
+
+	page.pin_count += 1
+	return page, nil
+}
+
+// AllocatePage hands out a zeroed page, reusing one from the freelist when
+// there is one. Otherwise the page is appended to the end of the database
+// and the new size recorded in header bytes 30-33, and the file itself grows
+// once the page is flushed. Like GetPage the page comes back pinned
+func (pager *Pager) AllocatePage() (*Page, error) {
+	root, err := pager.get_root()
+	if err != nil {
+		return nil, err
+	}
+	defer pager.Unpin(root)
+	if page, err := pager.reuse_free_page(root); page != nil || err != nil {
+		return page, err
+	}
+	if err := pager.evict(); err != nil {
+		return nil, err
+	}
+	if err := pager.Write(root); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(root.slotted_array[30:34], uint32(pager.num_pages+1))
+
+	page := &Page{
+		slotted_array: make([]byte, pager.storage.page_size),
+		dirty:         true,
+		page_number:   pager.num_pages,
+		pin_count:     1,
 	}
+	pager.num_pages += 1
+	pager.cache.add(page)
+	return page, nil
+}
+
+// Write must be called before changing a page. The first time a transaction
+// changes a page the journal gets to save its original image, then the page
+// is marked dirty so the next flush commits it. Open savepoints get to save
+// the page's image as well
+func (pager *Pager) Write(page *Page) error {
+	pager.changes += 1
+	pager.save_image(page)
+	if page.dirty {
+		return nil
+	}
+	if err := pager.storage.preserve_page(page); err != nil {
+		return err
+	}
+	page.dirty = true
+	pager.written[page.page_number] = true
+	return nil
+}
+
+func (pager *Pager) Pin(page *Page) {
+	page.pin_count += 1
+}
 
-	return page
+func (pager *Pager) Unpin(page *Page) {
+	page.pin_count -= 1
+}
+
+// SetCacheSize changes how many pages the cache holds before evicting
+func (pager *Pager) SetCacheSize(pages int) error {
+	pager.cache.maxSize = pages
+	return pager.evict()
+}
+
+// evict makes room for one more page by dropping the least recently used
+// unpinned pages, clean ones first. Dirty pages are written back before they
+// go. If everything is pinned the cache is allowed to grow past maxSize
+func (pager *Pager) evict() error {
+	for _, allow_dirty := range []bool{false, true} {
+		element := pager.cache.lruList.Back()
+		for element != nil && len(pager.cache.content) >= pager.cache.maxSize {
+			page := element.Value.(*Page)
+			element = element.Prev()
+			if page.pin_count > 0 || (page.dirty && !allow_dirty) {
+				continue
+			}
+			if page.dirty {
+				if err := pager.storage.spill_page(page); err != nil {
+					return err
+				}
+				page.dirty = false
+			}
+			pager.cache.remove(page)
+		}
+	}
+	return nil
+}
+
+// FlushCache commits every dirty page through the journal in page number
+// order as one transaction and fsyncs it, bumping the file change counter on the way.
+// Committing to a rollback journal takes an Exclusive lock, so it returns
+// ErrBusy if readers in other connections don't finish within the busy
+// timeout. A WAL commit goes ahead under their feet. Pages stay dirty if
+// the commit fails so a later flush retries them
+func (pager *Pager) FlushCache() error {
+	if err := pager.auto_vacuum(); err != nil {
+		return err
+	}
+	var dirty []*Page
+	for _, page := range pager.cache.content {
+		if page.dirty {
+			dirty = append(dirty, page)
+		}
+	}
+	if len(dirty) == 0 && !pager.storage.has_uncommitted() {
+		return pager.unlock()
+	}
+	if err := pager.storage.lock(pager.storage.commit_lock()); err != nil {
+		return err
+	}
+
+	root, err := pager.get_root()
+	if err != nil {
+		return err
+	}
+	defer pager.Unpin(root)
+	if !root.dirty {
+		if err := pager.Write(root); err != nil {
+			return err
+		}
+		dirty = append(dirty, root)
+	}
+	counter := binary.BigEndian.Uint32(root.slotted_array[26:30])
+	binary.BigEndian.PutUint32(root.slotted_array[26:30], counter+1)
+
+	slices.SortFunc(dirty, func(a *Page, b *Page) int {
+		return a.page_number - b.page_number
+	})
+	if err := pager.storage.commit_pages(dirty, pager.num_pages); err != nil {
+		return err
+	}
+	for _, page := range dirty {
+		page.dirty = false
+	}
+	pager.committed_pages = pager.num_pages
+	clear(pager.written)
+	pager.savepoints = nil
+
+	if pager.storage.checkpoint_due() {
+		// Readers of older snapshots still need the log, so the checkpoint
+		// waits for a commit that finds nobody reading
+		locked, err := pager.storage.try_lock(exclusiveLock)
+		if err != nil {
+			return err
+		}
+		if locked {
+			if err := pager.storage.checkpoint(); err != nil {
+				return err
+			}
+		}
+	}
+	return pager.unlock()
+}
+
+// Rollback throws away everything changed since the last commit. Pages the
+// transaction wrote are dropped from the cache, or reloaded in place if
+// something still has them pinned, and pages it allocated are forgotten
+func (pager *Pager) Rollback() error {
+	pager.changes += 1
+	if err := pager.storage.rollback_pages(); err != nil {
+		return err
+	}
+	for _, page := range pager.cache.content {
+		if page.page_number >= pager.committed_pages {
+			pager.cache.remove(page)
+			continue
+		}
+		if !page.dirty && !pager.written[page.page_number] {
+			continue
+		}
+		if page.pin_count == 0 {
+			pager.cache.remove(page)
+			continue
+		}
+		slotted_array, err := pager.storage.read_page_from_disk(page.page_number)
+		if err != nil {
+			return err
+		}
+		page.slotted_array = slotted_array
+		page.dirty = false
+	}
+	pager.num_pages = pager.committed_pages
+	clear(pager.written)
+	pager.savepoints = nil
+	return pager.unlock()
 }
 
-func (pager *Pager) FlushCache(){
-	root := pager.cache.content[0]
-	if root.dirty{
-		pager.storage.write_page_to_disk(root)
+// Close flushes the cache and closes the database file
+func (pager *Pager) Close() error {
+	flush_err := pager.FlushCache()
+	if err := pager.storage.Close(); err != nil && flush_err == nil {
+		return err
 	}
+	return flush_err
 }
 
 func InitializePager(storage_struct *Storage) *Pager {
@@ -55,12 +300,14 @@ func InitializePager(storage_struct *Storage) *Pager {
 		content: make(map[int]*Page), // Initialize the map to avoid nil map panics.
 		lruList: list.New(),          // Create a new empty doubly-linked list for LRU tracking.
 		maxSize: 500,                 // Set the maximum size as provided.
-		lock:    sync.RWMutex{},      // Initialize the RWMutex (zero value is usable, included for clarity).
 	}
 
 	pager_struct := &Pager{
-		cache:   cache,
-		storage: storage_struct,
+		cache:     cache,
+		storage:   storage_struct,
+		num_pages: storage_struct.database_pages(),
+		written:   make(map[int]bool),
 	}
+	pager_struct.committed_pages = pager_struct.num_pages
 	return pager_struct
 }
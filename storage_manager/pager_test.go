@@ -0,0 +1,198 @@
+package storage_manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllocateAndFetchPages(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	pager := btree.pager
+	btree.Insert(1, []any{"luna"})
+
+	if _, err := pager.GetPage(1); !errors.Is(err, ErrPageOutOfRange) {
+		t.Fatalf("Expected ErrPageOutOfRange before allocating, got %v", err)
+	}
+
+	for want := 1; want <= 3; want++ {
+		page, err := pager.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.page_number != want {
+			t.Errorf("Allocated page %d, expected %d", page.page_number, want)
+		}
+		page.slotted_array[0] = byte(want)
+	}
+
+	root := get_test_page(t, btree, 0)
+	if size := binary.BigEndian.Uint32(root.slotted_array[30:34]); size != 4 {
+		t.Errorf("Header records %d pages, expected 4", size)
+	}
+	if cached := get_test_page(t, btree, 2); cached.slotted_array[0] != 2 {
+		t.Errorf("Expected page 2 to come from the cache")
+	}
+	pager.FlushCache()
+	if err := pager.storage.checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, _ := pager.storage.file.Stat(); info.Size() != 4*defaultPageSize {
+		t.Errorf("Expected the file to grow to 4 pages, got %d bytes", info.Size())
+	}
+
+	reopened := open_test_btree(t, file_name)
+	for page_number := 1; page_number <= 3; page_number++ {
+		page := get_test_page(t, reopened, page_number)
+		if page.page_number != page_number || page.slotted_array[0] != byte(page_number) {
+			t.Errorf("Page %d read back wrong", page_number)
+		}
+	}
+	if _, err := reopened.pager.GetPage(4); !errors.Is(err, ErrPageOutOfRange) {
+		t.Errorf("Expected ErrPageOutOfRange past the end, got %v", err)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	pager := btree.pager
+	btree.Insert(1, []any{"luna"})
+	for i := 0; i < 5; i++ {
+		page, _ := pager.AllocatePage()
+		page.slotted_array[0] = byte(page.page_number)
+		pager.Unpin(page)
+	}
+	pager.FlushCache()
+	pager.SetCacheSize(3)
+	if len(pager.cache.content) > 3 {
+		t.Fatalf("Cache holds %d pages after shrinking to 3", len(pager.cache.content))
+	}
+
+	for _, page_number := range []int{1, 2, 3, 1, 4} {
+		page, err := pager.GetPage(page_number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pager.Unpin(page)
+	}
+	// 2 is the least recently used page once 4 comes in
+	for page_number, want := range map[int]bool{1: true, 2: false, 3: true, 4: true} {
+		if _, cached := pager.cache.content[page_number]; cached != want {
+			t.Errorf("Page %d cached = %v, expected %v", page_number, cached, want)
+		}
+	}
+	if pager.cache.lruList.Len() != len(pager.cache.content) {
+		t.Errorf("LRU list and cache map disagree")
+	}
+}
+
+func TestCacheKeepsPinnedPagesAndWritesBackDirtyOnes(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	pager := btree.pager
+	btree.Insert(1, []any{"luna"})
+	pager.SetCacheSize(2)
+
+	pinned, _ := pager.AllocatePage()
+	pinned.slotted_array[0] = 42
+	for i := 0; i < 4; i++ {
+		page, _ := pager.AllocatePage()
+		page.slotted_array[0] = byte(page.page_number)
+		pager.Unpin(page)
+	}
+	if pager.cache.content[pinned.page_number] != pinned {
+		t.Fatalf("Pinned page was evicted")
+	}
+	pager.Unpin(pinned)
+
+	// Dirty pages evicted so far were written back on the way out
+	for page_number := 2; page_number <= 4; page_number++ {
+		if _, cached := pager.cache.content[page_number]; cached {
+			continue
+		}
+		page := get_test_page(t, btree, page_number)
+		if page.slotted_array[0] != byte(page_number) {
+			t.Errorf("Page %d lost its contents on eviction", page_number)
+		}
+		pager.Unpin(page)
+	}
+}
+
+func TestBTreeWorksWithinATinyCache(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	btree.pager.SetCacheSize(8)
+
+	for key := 0; key < 3000; key++ {
+		if err := btree.Insert(uint32(key), []any{"cat", int64(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key := 0; key < 3000; key += 2 {
+		if err := btree.Delete(uint32(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(btree.pager.cache.content) > 8 {
+		t.Errorf("Cache grew to %d pages", len(btree.pager.cache.content))
+	}
+	for _, page := range btree.pager.cache.content {
+		if page.pin_count != 0 {
+			t.Errorf("Page %d still pinned %d times", page.page_number, page.pin_count)
+		}
+	}
+	btree.pager.FlushCache()
+
+	reopened := open_test_btree(t, file_name)
+	records, err := reopened.Range(0, 3000)
+	if err != nil || len(records) != 1500 {
+		t.Fatalf("Range returned %d records, %v", len(records), err)
+	}
+	for i, record := range records {
+		if record.Key != uint32(2*i+1) || record.Values[1] != int64(2*i+1) {
+			t.Fatalf("Unexpected record %+v", record)
+		}
+	}
+}
+
+func TestCloseFlushesEveryDirtyPage(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	for key := 0; key < 1000; key++ {
+		btree.Insert(uint32(key), []any{"cat", int64(key)})
+	}
+	if err := btree.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	for _, page := range btree.pager.cache.content {
+		if page.dirty {
+			t.Errorf("Page %d still dirty after Close", page.page_number)
+		}
+	}
+
+	reopened := open_test_btree(t, file_name)
+	if records, err := reopened.Range(0, 1000); err != nil || len(records) != 1000 {
+		t.Errorf("Range after Close returned %d records, %v", len(records), err)
+	}
+}
+
+func TestFlushReportsWriteErrors(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	transaction, _ := btree.Begin()
+	transaction.Insert(1, []any{"luna"})
+	test_wal(btree).file.Close()
+
+	if err := transaction.Commit(); err == nil {
+		t.Fatal("Expected Commit to fail on a closed file")
+	}
+	if !get_test_page(t, btree, 0).dirty {
+		t.Error("A page that failed to write should stay dirty")
+	}
+	if err := btree.Close(); err == nil {
+		t.Error("Expected Close to report the failed flush")
+	}
+}
@@ -0,0 +1,189 @@
+/**
+ * Record Format (leaf cell payload, modeled on SQLite's record format)
+ *
+ * **Header:**
+ * - Column count (uvarint)
+ * - One serial type per column (uvarint)
+ *
+ * **Serial Types:**
+ * - 0: NULL (0 bytes)
+ * - 1-6: Big-endian two's complement integer of 1, 2, 3, 4, 6 or 8 bytes
+ * - 7: Big-endian IEEE 754 float64 (8 bytes)
+ * - 8: Integer constant 0 (0 bytes)
+ * - 9: Integer constant 1 (0 bytes)
+ * - N >= 12, even: BLOB of (N-12)/2 bytes
+ * - N >= 13, odd: UTF-8 TEXT of (N-13)/2 bytes
+ *
+ * **Body:**
+ * - Column values packed back to back in header order
+ *
+ * Go values map to nil, int64, float64, string and []byte. Plain ints are
+ * accepted when encoding and come back as int64.
+ */
+
+package storage_manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported column type")
+	ErrMalformedRecord = errors.New("malformed record")
+)
+
+// Record is a decoded leaf cell
+type Record struct {
+	Key    uint32
+	Values []any
+}
+
+var integer_widths = [7]int{0, 1, 2, 3, 4, 6, 8}
+
+func integer_serial_type(value int64) uint64 {
+	switch {
+	case value == 0:
+		return 8
+	case value == 1:
+		return 9
+	case value >= math.MinInt8 && value <= math.MaxInt8:
+		return 1
+	case value >= math.MinInt16 && value <= math.MaxInt16:
+		return 2
+	case value >= -1<<23 && value < 1<<23:
+		return 3
+	case value >= math.MinInt32 && value <= math.MaxInt32:
+		return 4
+	case value >= -1<<47 && value < 1<<47:
+		return 5
+	default:
+		return 6
+	}
+}
+
+func encode_record(values []any) ([]byte, error) {
+	header := binary.AppendUvarint(nil, uint64(len(values)))
+	var body []byte
+	for _, value := range values {
+		switch v := value.(type) {
+		case nil:
+			header = binary.AppendUvarint(header, 0)
+		case int:
+			header, body = append_integer(header, body, int64(v))
+		case int64:
+			header, body = append_integer(header, body, v)
+		case float64:
+			header = binary.AppendUvarint(header, 7)
+			body = binary.BigEndian.AppendUint64(body, math.Float64bits(v))
+		case []byte:
+			header = binary.AppendUvarint(header, uint64(12+2*len(v)))
+			body = append(body, v...)
+		case string:
+			header = binary.AppendUvarint(header, uint64(13+2*len(v)))
+			body = append(body, v...)
+		default:
+			return nil, fmt.Errorf("%w: %T", ErrUnsupportedType, value)
+		}
+	}
+	return append(header, body...), nil
+}
+
+func append_integer(header []byte, body []byte, value int64) ([]byte, []byte) {
+	serial_type := integer_serial_type(value)
+	header = binary.AppendUvarint(header, serial_type)
+	if serial_type <= 6 {
+		width := integer_widths[serial_type]
+		var buffer [8]byte
+		binary.BigEndian.PutUint64(buffer[:], uint64(value))
+		body = append(body, buffer[8-width:]...)
+	}
+	return header, body
+}
+
+func decode_record_values(payload []byte) ([]any, error) {
+	count, n := binary.Uvarint(payload)
+	if n <= 0 || count > uint64(len(payload)) {
+		return nil, ErrMalformedRecord
+	}
+	offset := n
+
+	serial_types := make([]uint64, count)
+	for i := range serial_types {
+		serial_type, n := binary.Uvarint(payload[offset:])
+		if n <= 0 || serial_type == 10 || serial_type == 11 || serial_type > uint64(13+2*len(payload)) {
+			return nil, ErrMalformedRecord
+		}
+		serial_types[i] = serial_type
+		offset += n
+	}
+
+	values := make([]any, count)
+	for i, serial_type := range serial_types {
+		size := serial_type_size(serial_type)
+		if offset+size > len(payload) {
+			return nil, ErrMalformedRecord
+		}
+		data := payload[offset : offset+size]
+		offset += size
+
+		switch {
+		case serial_type == 0:
+			values[i] = nil
+		case serial_type <= 6:
+			var buffer [8]byte
+			if data[0]&0x80 != 0 {
+				// Sign extend negative integers
+				for j := range buffer {
+					buffer[j] = 0xff
+				}
+			}
+			copy(buffer[8-size:], data)
+			values[i] = int64(binary.BigEndian.Uint64(buffer[:]))
+		case serial_type == 7:
+			values[i] = math.Float64frombits(binary.BigEndian.Uint64(data))
+		case serial_type == 8:
+			values[i] = int64(0)
+		case serial_type == 9:
+			values[i] = int64(1)
+		case serial_type%2 == 0:
+			values[i] = append([]byte{}, data...)
+		default:
+			values[i] = string(data)
+		}
+	}
+	if offset != len(payload) {
+		return nil, ErrMalformedRecord
+	}
+	return values, nil
+}
+
+func serial_type_size(serial_type uint64) int {
+	switch {
+	case serial_type <= 6:
+		return integer_widths[serial_type]
+	case serial_type == 7:
+		return 8
+	case serial_type < 12:
+		return 0
+	default:
+		return int(serial_type-12) / 2
+	}
+}
+
+func (btree *BTree) decode_record(cell []byte) (*Record, error) {
+	payload, err := btree.read_payload(cell)
+	if err != nil {
+		return nil, err
+	}
+	values, err := decode_record_values(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Record{
+		Key:    leaf_cell_key(cell),
+		Values: values,
+	}, nil
+}
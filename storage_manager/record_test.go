@@ -0,0 +1,90 @@
+package storage_manager
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	values := []any{
+		nil,
+		int64(0), int64(1), int64(-1), int64(127), int64(-128), int64(300),
+		int64(-1 << 23), int64(1<<23 - 1), int64(math.MaxInt32), int64(1 << 40),
+		int64(math.MinInt64), int64(math.MaxInt64),
+		3.25, math.Inf(-1),
+		"", "whiskers", []byte{}, []byte{0, 1, 2},
+	}
+	payload, err := encode_record(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decode_record_values(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, values) {
+		t.Errorf("Round trip mismatch:\nExpected: %v\nGot: %v", values, decoded)
+	}
+
+	// Plain ints are widened to int64
+	payload, _ = encode_record([]any{42})
+	if decoded, _ := decode_record_values(payload); decoded[0] != int64(42) {
+		t.Errorf("Expected int64(42), got %#v", decoded[0])
+	}
+}
+
+func TestRecordUsesSmallestIntegerWidth(t *testing.T) {
+	cases := map[int64]int{0: 0, 1: 0, 2: 1, -200: 2, 40000: 3, 1 << 30: 4, 1 << 40: 6, 1 << 60: 8}
+	for value, width := range cases {
+		payload, _ := encode_record([]any{value})
+		if got := len(payload) - 2; got != width {
+			t.Errorf("%d encoded in %d bytes, expected %d", value, got, width)
+		}
+	}
+}
+
+func TestRecordRejectsBadInput(t *testing.T) {
+	if _, err := encode_record([]any{true}); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("Expected ErrUnsupportedType, got %v", err)
+	}
+	payload, _ := encode_record([]any{"whiskers", int64(3)})
+	for _, bad := range [][]byte{{}, payload[:len(payload)-1], append(payload, 0), {1, 10}} {
+		if _, err := decode_record_values(bad); err != ErrMalformedRecord {
+			t.Errorf("decode(%v): expected ErrMalformedRecord, got %v", bad, err)
+		}
+	}
+}
+
+func TestUpdateRelocatesGrowingRecords(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	for key := 0; key < 200; key++ {
+		btree.Insert(uint32(key), []any{"luna", int64(key)})
+	}
+
+	// Shrinking stays in place, growing forces the leaves to split
+	if err := btree.Update(0, []any{"m"}); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("whiskers", 100)
+	for key := 1; key < 200; key++ {
+		if err := btree.Update(uint32(key), []any{long, int64(key), 4.5}); err != nil {
+			t.Fatalf("Update(%d): %v", key, err)
+		}
+	}
+	check_node(t, btree, get_test_page(t, btree, 0), 0, 1<<32)
+
+	record, _ := btree.Get(0)
+	if !reflect.DeepEqual(record.Values, []any{"m"}) {
+		t.Errorf("Get(0) = %v", record.Values)
+	}
+	for key := 1; key < 200; key++ {
+		record, err := btree.Get(uint32(key))
+		if err != nil || !reflect.DeepEqual(record.Values, []any{long, int64(key), 4.5}) {
+			t.Fatalf("Get(%d) = %v, %v", key, record, err)
+		}
+	}
+}
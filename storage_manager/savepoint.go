@@ -0,0 +1,119 @@
+// Savepoints mark points inside a transaction that it can roll back to
+// without giving up the whole transaction. Each savepoint level keeps the
+// image a page had before it was first changed while that level was the
+// innermost one, so rolling back to a savepoint replays those images from the
+// innermost level outwards
+package storage_manager
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var ErrNoSuchSavepoint = errors.New("no such savepoint")
+
+type savepoint struct {
+	name      string
+	num_pages int            // Pages in the database when the savepoint was taken
+	images    map[int][]byte // Page number -> image before this level changed it
+}
+
+// Savepoint opens a new innermost savepoint level called name
+func (pager *Pager) Savepoint(name string) {
+	pager.savepoints = append(pager.savepoints, &savepoint{
+		name:      name,
+		num_pages: pager.num_pages,
+		images:    make(map[int][]byte),
+	})
+}
+
+// find_savepoint returns the level of the innermost savepoint called name.
+// Names compare case-insensitively like SQL identifiers
+func (pager *Pager) find_savepoint(name string) (int, error) {
+	for level := len(pager.savepoints) - 1; level >= 0; level-- {
+		if strings.EqualFold(pager.savepoints[level].name, name) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", ErrNoSuchSavepoint, name)
+}
+
+// save_image records page's current image in the innermost savepoint, the
+// first time that level sees the page change
+func (pager *Pager) save_image(page *Page) {
+	if len(pager.savepoints) == 0 {
+		return
+	}
+	current := pager.savepoints[len(pager.savepoints)-1]
+	if page.page_number >= current.num_pages {
+		// Allocated after the savepoint, rolling back forgets it entirely
+		return
+	}
+	if _, saved := current.images[page.page_number]; !saved {
+		current.images[page.page_number] = slices.Clone(page.slotted_array)
+	}
+}
+
+// ReleaseSavepoint drops the savepoint called name and every level inside
+// it, keeping their changes as part of the enclosing level
+func (pager *Pager) ReleaseSavepoint(name string) error {
+	level, err := pager.find_savepoint(name)
+	if err != nil {
+		return err
+	}
+	if level > 0 {
+		outer := pager.savepoints[level-1]
+		for _, released := range pager.savepoints[level:] {
+			for page_number, image := range released.images {
+				if _, saved := outer.images[page_number]; !saved && page_number < outer.num_pages {
+					outer.images[page_number] = image
+				}
+			}
+		}
+	}
+	pager.savepoints = pager.savepoints[:level]
+	return nil
+}
+
+// RollbackToSavepoint puts every page back the way it was when the savepoint
+// called name was taken and drops the levels inside it. The savepoint itself
+// stays open, as in SQL
+func (pager *Pager) RollbackToSavepoint(name string) error {
+	level, err := pager.find_savepoint(name)
+	if err != nil {
+		return err
+	}
+	target := pager.savepoints[level]
+	pager.changes += 1
+
+	// The database may have shrunk since, pages past the end are readable
+	// again before their images go back
+	pager.num_pages = max(pager.num_pages, target.num_pages)
+
+	// Outer levels go last so their older images win
+	for i := len(pager.savepoints) - 1; i >= level; i-- {
+		for page_number, image := range pager.savepoints[i].images {
+			if page_number >= target.num_pages {
+				continue
+			}
+			page, err := pager.GetPage(page_number)
+			if err != nil {
+				return err
+			}
+			copy(page.slotted_array, image)
+			page.dirty = true
+			pager.Unpin(page)
+		}
+	}
+
+	for _, page := range pager.cache.content {
+		if page.page_number >= target.num_pages {
+			pager.cache.remove(page)
+		}
+	}
+	pager.num_pages = target.num_pages
+	pager.savepoints = pager.savepoints[:level+1]
+	return nil
+}
@@ -0,0 +1,129 @@
+package storage_manager
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// record_keys lists every key in the tree in order
+func record_keys(t *testing.T, btree *BTree) []uint32 {
+	t.Helper()
+	records, err := btree.Range(0, 1<<32-1)
+	if err != nil {
+		t.Fatalf("Range: %v", err)
+	}
+	keys := make([]uint32, len(records))
+	for i, record := range records {
+		keys[i] = record.Key
+	}
+	return keys
+}
+
+func expect_key_count(t *testing.T, btree *BTree, low uint32, high uint32, want int) {
+	t.Helper()
+	n := 0
+	for _, key := range record_keys(t, btree) {
+		if key >= low && key < high {
+			n += 1
+		}
+	}
+	if n != want {
+		t.Errorf("Expected %d keys in [%d, %d), got %d", want, low, high, n)
+	}
+}
+
+func TestRollbackToSavepoint(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	btree.pager.SetCacheSize(8)
+	payload := strings.Repeat("whiskers", 40)
+
+	transaction, _ := btree.Begin()
+	for key := 0; key < 300; key++ {
+		transaction.Insert(uint32(key), []any{payload})
+	}
+	transaction.Savepoint("batch")
+	for key := 300; key < 600; key++ {
+		transaction.Insert(uint32(key), []any{payload})
+	}
+	transaction.Savepoint("inner")
+	for key := 0; key < 300; key += 2 {
+		transaction.Delete(uint32(key))
+	}
+	for key := 600; key < 900; key++ {
+		transaction.Insert(uint32(key), []any{payload})
+	}
+
+	if err := transaction.RollbackTo("inner"); err != nil {
+		t.Fatalf("RollbackTo(inner): %v", err)
+	}
+	expect_key_count(t, btree, 0, 1000, 600)
+
+	transaction.Delete(5)
+	if err := transaction.RollbackTo("BATCH"); err != nil {
+		t.Fatalf("RollbackTo(BATCH): %v", err)
+	}
+	expect_key_count(t, btree, 0, 1000, 300)
+	if err := transaction.Release("inner"); !errors.Is(err, ErrNoSuchSavepoint) {
+		t.Errorf("Expected ErrNoSuchSavepoint for a savepoint inside the one rolled back to, got %v", err)
+	}
+
+	// The savepoint stays open after rolling back to it
+	transaction.Insert(1000, []any{payload})
+	if err := transaction.RollbackTo("batch"); err != nil {
+		t.Fatalf("RollbackTo(batch) again: %v", err)
+	}
+	expect_key_count(t, btree, 0, 2000, 300)
+
+	transaction.Insert(1000, []any{payload})
+	if err := transaction.Release("batch"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if err := transaction.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	crash(btree)
+
+	reopened := open_test_btree(t, file_name)
+	expect_key_count(t, reopened, 0, 2000, 301)
+	check_node(t, reopened, get_test_page(t, reopened, 0), 0, 1<<32)
+}
+
+func TestReleaseKeepsChangesForOuterSavepoint(t *testing.T) {
+	btree := open_test_btree(t, filepath.Join(t.TempDir(), "Boots.db"))
+	btree.pager.SetCacheSize(8)
+	payload := strings.Repeat("whiskers", 40)
+	for key := 0; key < 300; key++ {
+		btree.Insert(uint32(key), []any{payload})
+	}
+
+	transaction, _ := btree.Begin()
+	transaction.Savepoint("outer")
+	transaction.Savepoint("middle")
+	for key := 0; key < 300; key += 3 {
+		transaction.Delete(uint32(key))
+	}
+	transaction.Savepoint("inner")
+	for key := 300; key < 500; key++ {
+		transaction.Insert(uint32(key), []any{payload})
+	}
+	if err := transaction.Release("middle"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	expect_key_count(t, btree, 0, 1000, 400)
+
+	if err := transaction.RollbackTo("outer"); err != nil {
+		t.Fatalf("RollbackTo: %v", err)
+	}
+	expect_key_count(t, btree, 0, 1000, 300)
+
+	if err := transaction.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if err := transaction.Savepoint("late"); err != ErrTransactionDone {
+		t.Errorf("Expected ErrTransactionDone, got %v", err)
+	}
+	expect_key_count(t, btree, 0, 1000, 300)
+}
@@ -1,37 +1,240 @@
 // The storage engine is responsible for all I/O of the database
 package storage_manager
 
-import "os"
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
 
 type Storage struct {
-	fileSize int64
-	file     *os.File
+	fileSize  int64
+	file      *os.File // Shared by every connection in the process, see lock.go
+	file_name string
+	mode      JournalMode
+	journal   journal
+	page_size int // Header bytes 16-17, or the size the database will be created with
+
+	inode          *inode_lock
+	lock_level     lock_level
+	busy_timeout   time.Duration
+	change_counter uint32 // Header bytes 26-29 as of the last look at the database file
+	stale          bool   // Another connection changed the database since the cache was filled
+}
+
+// read_page_from_disk reads the newest image of a page, checking the WAL
+// before the database file. Pages past the end of the file haven't been
+// written yet and come back zeroed
+func (storage *Storage) read_page_from_disk(page_number int) ([]byte, error) {
+	if buffer, err := storage.journal.read_page(page_number); buffer != nil || err != nil {
+		return buffer, err
+	}
+
+	buffer := make([]byte, storage.page_size)
+	_, err := storage.file.ReadAt(buffer, int64(page_number)*int64(storage.page_size))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// write_page_to_disk writes straight into the database file, which only a
+// WAL checkpoint or a rollback journal does
+func (storage *Storage) write_page_to_disk(page_number int, data []byte) error {
+	offset := int64(page_number) * int64(storage.page_size)
+	if _, err := storage.file.WriteAt(data, offset); err != nil {
+		return err
+	}
+	storage.fileSize = max(storage.fileSize, offset+int64(len(data)))
+	if page_number == 0 {
+		storage.change_counter = binary.BigEndian.Uint32(data[26:30])
+	}
+	return nil
+}
+
+// truncate shrinks the database file down to pages pages
+func (storage *Storage) truncate(pages int) error {
+	size := int64(pages) * int64(storage.page_size)
+	if pages == 0 || storage.fileSize <= size {
+		return nil
+	}
+	if err := storage.file.Truncate(size); err != nil {
+		return err
+	}
+	storage.fileSize = size
+	return nil
+}
+
+// sync forces everything written so far onto stable storage
+func (storage *Storage) sync() error {
+	return storage.file.Sync()
+}
+
+// preserve_page is called before the open transaction first changes page
+func (storage *Storage) preserve_page(page *Page) error {
+	return storage.journal.preserve(page)
+}
+
+// spill_page moves a dirty page out of the cache ahead of its commit
+func (storage *Storage) spill_page(page *Page) error {
+	return storage.journal.spill(page)
+}
+
+// commit_pages durably records pages as one atomic transaction
+func (storage *Storage) commit_pages(pages []*Page, db_size int) error {
+	return storage.journal.commit(pages, db_size)
+}
+
+// rollback_pages undoes every page the open transaction spilled
+func (storage *Storage) rollback_pages() error {
+	return storage.journal.rollback()
 }
 
-func (storage *Storage) get_root_from_disk() *[4096]byte {
-	storage.file.Seek(0, 0)
+func (storage *Storage) has_uncommitted() bool {
+	return storage.journal.has_pending()
+}
+
+// checkpoint moves everything committed to the WAL into the database file
+func (storage *Storage) checkpoint() error {
+	return storage.journal.checkpoint()
+}
+
+// checkpoint_due reports whether the WAL has grown past walAutoCheckpoint
+func (storage *Storage) checkpoint_due() bool {
+	log, is_wal := storage.journal.(*wal)
+	return is_wal && log.frames >= walAutoCheckpoint
+}
+
+// Close shuts the journal down, gives up the connection's lock and closes
+// the database file once no other connection in the process uses it. A WAL
+// is checkpointed and removed by the last connection out, but kept if the
+// checkpoint fails so the next open can replay it
+func (storage *Storage) Close() error {
+	err := storage.journal.close()
+	if unlock_err := storage.unlock(noLock); err == nil {
+		err = unlock_err
+	}
+	if close_err := storage.inode.close(); err == nil {
+		err = close_err
+	}
+	storage.inode = nil
+	return err
+}
+
+// refresh notices changes other connections made to the database file or
+// the WAL since this connection last looked
+func (storage *Storage) refresh() (bool, error) {
+	info, err := storage.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	var header [30]byte
+	if _, err := storage.file.ReadAt(header[:], 0); err != nil && err != io.EOF {
+		return false, err
+	}
+	counter := binary.BigEndian.Uint32(header[26:30])
+	changed := info.Size() != storage.fileSize || counter != storage.change_counter
+	storage.fileSize = info.Size()
+	storage.change_counter = counter
+	if size := header_page_size(header[:]); info.Size() >= dbHeaderSize && valid_page_size(size) {
+		changed = changed || size != storage.page_size
+		storage.page_size = size
+	}
+
+	journal_changed, err := storage.journal.refresh()
+	return changed || journal_changed, err
+}
 
-	var buffer [4096]byte
-	storage.file.Read(buffer[:])
-	return &buffer
+// has_changed reports whether other connections committed since this
+// connection last caught up. Unlike refresh it leaves the connection's view
+// of the database alone, so a reader's snapshot survives the question
+func (storage *Storage) has_changed() (bool, error) {
+	return storage.journal.changed()
 }
 
-func (storage *Storage) write_page_to_disk(page *Page) {
-	page_number := page.page_number
-	storage.file.WriteAt(page.slotted_array[:], int64(page_number)*4096)
+// commit_lock returns the lock a commit needs. A WAL commit only appends to
+// the log past every reader's snapshot so Reserved is enough, anything that
+// writes the database file has to wait for readers to leave
+func (storage *Storage) commit_lock() lock_level {
+	if _, is_wal := storage.journal.(*wal); is_wal {
+		return reservedLock
+	}
+	return exclusiveLock
 }
 
-func InitializeStorage(file_name string) *Storage {
-	file, err := os.OpenFile(file_name, os.O_RDWR|os.O_CREATE, 0666)
+// database_pages returns the size of the database in pages as of the last
+// commit this connection has seen
+func (storage *Storage) database_pages() int {
+	if log, is_wal := storage.journal.(*wal); is_wal && log.db_size != 0 {
+		return log.db_size
+	}
+	return max(1, int(storage.fileSize/int64(storage.page_size)))
+}
 
-	fileInfo, err := file.Stat()
+// InitializeStorage opens the database file in the given journal mode. A
+// hot rollback journal a crash left behind is rolled back the first time the
+// database is read. Transactions committed to a WAL are replayed into the
+// database file unless another connection is using it, and a WAL left over
+// when opening in another mode has to be replayed and removed, so switching
+// modes between opens never loses or half applies a transaction
+func InitializeStorage(file_name string, mode JournalMode) (*Storage, error) {
+	if mode < JournalModeWAL || mode > JournalModeOff {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownJournalMode, mode)
+	}
+	inode, err := open_inode_lock(file_name)
 	if err != nil {
-		file.Close()
+		return nil, err
 	}
 	storage_struct := &Storage{
-		file:     file,
-		fileSize: fileInfo.Size(),
+		file:      inode.file,
+		file_name: file_name,
+		mode:      mode,
+		page_size: defaultPageSize,
+		inode:     inode,
+	}
+	fail := func(err error) (*Storage, error) {
+		storage_struct.unlock(noLock)
+		inode.close()
+		return nil, err
 	}
 
-	return storage_struct
+	_, err = os.Stat(file_name + "-wal")
+	if mode == JournalModeWAL || err == nil {
+		log, err := open_wal(storage_struct, file_name+"-wal")
+		if err != nil {
+			return fail(err)
+		}
+		storage_struct.journal = log
+		if mode == JournalModeWAL {
+			locked, err := storage_struct.try_lock(exclusiveLock)
+			if err == nil && locked {
+				err = log.checkpoint()
+			}
+			if err != nil {
+				log.file.Close()
+				return fail(err)
+			}
+		} else {
+			// A WAL left over from opening in WAL mode has to go first
+			if err := storage_struct.lock_within(exclusiveLock, 0); err != nil {
+				log.file.Close()
+				return fail(err)
+			}
+			if err := log.close(); err != nil {
+				return fail(err)
+			}
+		}
+		if err := storage_struct.unlock(noLock); err != nil {
+			return fail(err)
+		}
+	}
+	if mode != JournalModeWAL {
+		storage_struct.journal = open_rollback_journal(storage_struct, file_name+"-journal", mode)
+	}
+	if _, err := storage_struct.refresh(); err != nil {
+		return fail(err)
+	}
+	return storage_struct, nil
 }
@@ -0,0 +1,146 @@
+// A transaction groups Insert, Update and Delete calls so they commit as one
+// atomic unit through the pager's journal, or roll back together by throwing
+// away the pages they changed. Outside a transaction each call commits on its
+// own as it returns, or rolls back if it fails
+package storage_manager
+
+import "errors"
+
+var (
+	ErrTransactionActive = errors.New("a transaction is already active")
+	ErrTransactionDone   = errors.New("transaction has already been committed or rolled back")
+)
+
+type Transaction struct {
+	btree *BTree
+	done  bool
+}
+
+// Begin starts a transaction. Changes made before it are committed first so
+// a rollback only ever undoes the transaction's own work. Like SQL's BEGIN
+// DEFERRED no lock is taken until the transaction first reads or writes, and
+// then it's held until Commit or Rollback
+func (btree *BTree) Begin() (*Transaction, error) {
+	btree.pager.mutex.Lock()
+	defer btree.pager.mutex.Unlock()
+
+	if btree.transaction != nil {
+		return nil, ErrTransactionActive
+	}
+	if err := btree.pager.FlushCache(); err != nil {
+		return nil, err
+	}
+	btree.transaction = &Transaction{btree: btree}
+	btree.pager.holds += 1
+	return btree.transaction, nil
+}
+
+// InTransaction reports whether an explicit transaction is open
+func (btree *BTree) InTransaction() bool {
+	btree.pager.mutex.Lock()
+	defer btree.pager.mutex.Unlock()
+	return btree.transaction != nil
+}
+
+func (transaction *Transaction) Insert(key uint32, values []any) error {
+	if transaction.done {
+		return ErrTransactionDone
+	}
+	return transaction.btree.Insert(key, values)
+}
+
+func (transaction *Transaction) Update(key uint32, values []any) error {
+	if transaction.done {
+		return ErrTransactionDone
+	}
+	return transaction.btree.Update(key, values)
+}
+
+func (transaction *Transaction) Delete(key uint32) error {
+	if transaction.done {
+		return ErrTransactionDone
+	}
+	return transaction.btree.Delete(key)
+}
+
+// Savepoint marks a point inside the transaction that RollbackTo can return to
+func (transaction *Transaction) Savepoint(name string) error {
+	if transaction.done {
+		return ErrTransactionDone
+	}
+	pager := transaction.btree.pager
+	pager.mutex.Lock()
+	defer pager.mutex.Unlock()
+	pager.Savepoint(name)
+	return nil
+}
+
+// Release forgets the savepoint called name and the ones taken after it,
+// keeping their changes in the transaction
+func (transaction *Transaction) Release(name string) error {
+	if transaction.done {
+		return ErrTransactionDone
+	}
+	pager := transaction.btree.pager
+	pager.mutex.Lock()
+	defer pager.mutex.Unlock()
+	return pager.ReleaseSavepoint(name)
+}
+
+// RollbackTo undoes everything done since the savepoint called name was taken
+func (transaction *Transaction) RollbackTo(name string) error {
+	if transaction.done {
+		return ErrTransactionDone
+	}
+	pager := transaction.btree.pager
+	pager.mutex.Lock()
+	defer pager.mutex.Unlock()
+	return pager.RollbackToSavepoint(name)
+}
+
+// Commit makes every change in the transaction durable at once
+func (transaction *Transaction) Commit() error {
+	if transaction.done {
+		return ErrTransactionDone
+	}
+	pager := transaction.btree.pager
+	pager.mutex.Lock()
+	defer pager.mutex.Unlock()
+	transaction.finish()
+	if err := pager.FlushCache(); err != nil {
+		// Still open, the caller can retry the commit or roll back
+		transaction.reopen()
+		return err
+	}
+	return nil
+}
+
+// Rollback discards every change made since Begin
+func (transaction *Transaction) Rollback() error {
+	if transaction.done {
+		return ErrTransactionDone
+	}
+	pager := transaction.btree.pager
+	pager.mutex.Lock()
+	defer pager.mutex.Unlock()
+	transaction.finish()
+	if err := pager.Rollback(); err != nil {
+		transaction.reopen()
+		return err
+	}
+	return nil
+}
+
+// finish closes the transaction before its last flush or rollback so the
+// pager can give up the lock the transaction held
+func (transaction *Transaction) finish() {
+	transaction.done = true
+	transaction.btree.transaction = nil
+	transaction.btree.pager.holds -= 1
+}
+
+func (transaction *Transaction) reopen() {
+	transaction.done = false
+	transaction.btree.transaction = transaction
+	transaction.btree.pager.holds += 1
+}
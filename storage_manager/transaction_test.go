@@ -0,0 +1,121 @@
+package storage_manager
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTransactionCommitsAtomically(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	transaction, err := btree.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if _, err := btree.Begin(); err != ErrTransactionActive {
+		t.Errorf("Expected ErrTransactionActive, got %v", err)
+	}
+	for key := 0; key < 500; key++ {
+		if err := transaction.Insert(uint32(key), []any{"cat", int64(key)}); err != nil {
+			t.Fatalf("Insert(%d): %v", key, err)
+		}
+	}
+	if err := transaction.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if btree.InTransaction() {
+		t.Error("Expected the transaction to be finished after Commit")
+	}
+	if err := transaction.Insert(500, []any{"cat"}); err != ErrTransactionDone {
+		t.Errorf("Expected ErrTransactionDone, got %v", err)
+	}
+	if err := transaction.Rollback(); err != ErrTransactionDone {
+		t.Errorf("Expected ErrTransactionDone, got %v", err)
+	}
+	crash(btree)
+
+	reopened := open_test_btree(t, file_name)
+	if n := count_records(t, reopened); n != 500 {
+		t.Errorf("Expected 500 records, got %d", n)
+	}
+}
+
+func TestTransactionRollbackDiscardsChanges(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeWAL, JournalModeDelete} {
+		t.Run(mode.String(), func(t *testing.T) {
+			file_name := filepath.Join(t.TempDir(), "Boots.db")
+			btree := open_test_btree_in_mode(t, file_name, mode)
+			for key := 0; key < 200; key++ {
+				btree.Insert(uint32(key), []any{fmt.Sprintf("cat%d", key)})
+			}
+
+			// A tiny cache makes the transaction spill pages before rolling back
+			btree.pager.SetCacheSize(4)
+			transaction, err := btree.Begin()
+			if err != nil {
+				t.Fatalf("Begin: %v", err)
+			}
+			num_pages := btree.pager.num_pages
+			payload := strings.Repeat("whiskers", 40)
+			for key := 200; key < 1000; key++ {
+				transaction.Insert(uint32(key), []any{payload})
+			}
+			for key := 0; key < 200; key += 2 {
+				transaction.Delete(uint32(key))
+			}
+			for key := 1; key < 200; key += 2 {
+				transaction.Update(uint32(key), []any{payload})
+			}
+			if err := transaction.Rollback(); err != nil {
+				t.Fatalf("Rollback: %v", err)
+			}
+
+			if btree.pager.num_pages != num_pages {
+				t.Errorf("Expected %d pages after rollback, got %d", num_pages, btree.pager.num_pages)
+			}
+			if n := count_records(t, btree); n != 200 {
+				t.Fatalf("Expected the 200 records from before Begin, got %d", n)
+			}
+			for key := 0; key < 200; key++ {
+				record, err := btree.Get(uint32(key))
+				if err != nil {
+					t.Fatalf("Get(%d): %v", key, err)
+				}
+				if want := []any{fmt.Sprintf("cat%d", key)}; !reflect.DeepEqual(record.Values, want) {
+					t.Fatalf("Get(%d) = %v, expected %v", key, record.Values, want)
+				}
+			}
+
+			// The tree is still usable and the rollback stays rolled back
+			if err := btree.Insert(200, []any{"cat200"}); err != nil {
+				t.Fatalf("Insert after rollback: %v", err)
+			}
+			if err := btree.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			reopened := open_test_btree_in_mode(t, file_name, mode)
+			if n := count_records(t, reopened); n != 201 {
+				t.Errorf("Expected 201 records after reopening, got %d", n)
+			}
+		})
+	}
+}
+
+func TestCloseRollsBackOpenTransaction(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	btree.Insert(0, []any{"cat"})
+	transaction, _ := btree.Begin()
+	transaction.Insert(1, []any{"cat"})
+	if err := btree.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopened := open_test_btree(t, file_name)
+	if n := count_records(t, reopened); n != 1 {
+		t.Errorf("Expected only the record from before Begin, got %d", n)
+	}
+}
@@ -0,0 +1,677 @@
+/**
+ * Vacuum (giving free pages back to the file system)
+ *
+ * Freed pages stay in the file on the freelist until something reclaims them.
+ * VACUUM rebuilds the whole database packed tight into a temporary file, then
+ * copies it over the database as one transaction and truncates the rest. An
+ * incremental vacuum instead moves the pages in use at the end of the file
+ * into freelist holes nearer the front and truncates the tail.
+ *
+ * **Header Fields (page 0):**
+ * - 54-57: Largest root page (uint32_t, 0 if no auto-vacuum). The only root
+ *   is page 0 for now, so an auto-vacuum database stores 1
+ * - 66-69: Incremental vacuum mode (uint32_t, non-zero enables)
+ *
+ * **Auto-Vacuum Modes:**
+ * - None (54-57 zero): free pages wait for the next allocation or VACUUM
+ * - Full (54-57 non-zero, 66-69 zero): every commit vacuums the freelist away
+ * - Incremental (both non-zero): only IncrementalVacuum reclaims free pages
+ *
+ * There are no pointer map pages, a move finds the pointer to the page by
+ * walking the tree once per vacuum.
+ */
+
+package storage_manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+type AutoVacuum int
+
+const (
+	AutoVacuumNone AutoVacuum = iota
+	AutoVacuumFull
+	AutoVacuumIncremental
+)
+
+var (
+	ErrUnknownAutoVacuum = errors.New("unknown auto-vacuum mode")
+	ErrCursorsOpen       = errors.New("cannot vacuum while cursors are open")
+)
+
+func (mode AutoVacuum) String() string {
+	switch mode {
+	case AutoVacuumNone:
+		return "NONE"
+	case AutoVacuumFull:
+		return "FULL"
+	case AutoVacuumIncremental:
+		return "INCREMENTAL"
+	}
+	return fmt.Sprintf("AutoVacuum(%d)", int(mode))
+}
+
+func auto_vacuum_mode(root *Page) AutoVacuum {
+	if binary.BigEndian.Uint32(root.slotted_array[54:58]) == 0 {
+		return AutoVacuumNone
+	}
+	if binary.BigEndian.Uint32(root.slotted_array[66:70]) != 0 {
+		return AutoVacuumIncremental
+	}
+	return AutoVacuumFull
+}
+
+// SetAutoVacuum chooses what happens to pages as they're freed. Without
+// pointer maps any database can switch modes at any time
+func (btree *BTree) SetAutoVacuum(mode AutoVacuum) error {
+	if mode < AutoVacuumNone || mode > AutoVacuumIncremental {
+		return fmt.Errorf("%w: %d", ErrUnknownAutoVacuum, mode)
+	}
+	if err := btree.begin(true); err != nil {
+		return err
+	}
+	defer btree.end()
+	return btree.autocommit(btree.set_auto_vacuum(mode))
+}
+
+func (btree *BTree) set_auto_vacuum(mode AutoVacuum) error {
+	root, err := btree.get_page(0)
+	if err != nil {
+		return err
+	}
+	if err := btree.initialize_root(root); err != nil {
+		return err
+	}
+	if err := btree.write(root); err != nil {
+		return err
+	}
+	largest_root, incremental := 0, 0
+	if mode != AutoVacuumNone {
+		largest_root = 1
+	}
+	if mode == AutoVacuumIncremental {
+		incremental = 1
+	}
+	binary.BigEndian.PutUint32(root.slotted_array[54:58], uint32(largest_root))
+	binary.BigEndian.PutUint32(root.slotted_array[66:70], uint32(incremental))
+	return nil
+}
+
+func (btree *BTree) AutoVacuum() (AutoVacuum, error) {
+	if err := btree.begin(false); err != nil {
+		return AutoVacuumNone, err
+	}
+	defer btree.end()
+
+	root, err := btree.get_page(0)
+	if err != nil {
+		return AutoVacuumNone, err
+	}
+	return auto_vacuum_mode(root), nil
+}
+
+// IncrementalVacuum gives up to pages free pages back to the file system,
+// or all of them if pages isn't positive. Inside a transaction the smaller
+// file is committed along with everything else
+func (btree *BTree) IncrementalVacuum(pages int) error {
+	if err := btree.begin(true); err != nil {
+		return err
+	}
+	defer btree.end()
+
+	if btree.pager.holds > btree.open_transactions() {
+		return ErrCursorsOpen
+	}
+	return btree.autocommit(btree.pager.incremental_vacuum(pages))
+}
+
+func (btree *BTree) open_transactions() int {
+	if btree.transaction != nil {
+		return 1
+	}
+	return 0
+}
+
+// auto_vacuum runs before a commit of a Full auto-vacuum database, unless an
+// open cursor still points into pages that would move
+func (pager *Pager) auto_vacuum() error {
+	if len(pager.written) == 0 || pager.holds > 0 {
+		return nil
+	}
+	root, err := pager.get_root()
+	if err != nil {
+		return err
+	}
+	defer pager.Unpin(root)
+	if auto_vacuum_mode(root) != AutoVacuumFull || free_page_count(root) == 0 {
+		return nil
+	}
+	return pager.incremental_vacuum(0)
+}
+
+const (
+	childPointer        = iota // Cell of an internal node, or its rightmost child past the last cell
+	overflowPointer            // Last 4 bytes of a leaf cell
+	nextOverflowPointer        // Bytes 0-3 of the previous overflow page
+)
+
+// page_reference says where the one pointer to a page lives
+type page_reference struct {
+	kind int
+	from int // Page holding the pointer
+	cell int
+}
+
+// page_references walks the tree from the root and records where the pointer
+// to every page it reaches lives
+func (pager *Pager) page_references() (map[int]page_reference, error) {
+	references := make(map[int]page_reference)
+	var walk func(page_number int) error
+	walk = func(page_number int) error {
+		node, err := pager.GetPage(page_number)
+		if err != nil {
+			return err
+		}
+		defer pager.Unpin(node)
+
+		if !node.is_leaf() {
+			for i := 0; i <= node.cell_count(); i++ {
+				child, err := child_at(node, i)
+				if err != nil {
+					return err
+				}
+				references[child] = page_reference{childPointer, page_number, i}
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		for i := 0; i < node.cell_count(); i++ {
+			cell, err := node.cell(i)
+			if err != nil {
+				return err
+			}
+			next := leaf_cell_overflow(cell)
+			reference := page_reference{overflowPointer, page_number, i}
+			for next != 0 {
+				references[next] = reference
+				overflow, err := pager.GetPage(next)
+				if err != nil {
+					return err
+				}
+				reference = page_reference{nextOverflowPointer, next, 0}
+				next = int(binary.BigEndian.Uint32(overflow.slotted_array[0:4]))
+				pager.Unpin(overflow)
+			}
+		}
+		return nil
+	}
+
+	root, err := pager.get_root()
+	if err != nil {
+		return nil, err
+	}
+	defer pager.Unpin(root)
+	if !is_initialized(root) {
+		return references, nil
+	}
+	return references, walk(0)
+}
+
+// free_page_set returns every page on the freelist. A freelist naming a page
+// twice, or looping back on itself, is ErrCorrupt
+func (pager *Pager) free_page_set(root *Page) (map[int]bool, error) {
+	free := make(map[int]bool)
+	for next := first_trunk(root); next != 0; {
+		if err := pager.check_free_page(next); err != nil {
+			return nil, err
+		}
+		trunk, err := pager.GetPage(next)
+		if err != nil {
+			return nil, err
+		}
+		leaves, err := pager.trunk_leaves(trunk)
+		if err == nil {
+			next, err = pager.trunk_next(trunk)
+		}
+		pager.Unpin(trunk)
+		if err != nil {
+			return nil, err
+		}
+		for _, page_number := range append(leaves, trunk.page_number) {
+			if free[page_number] {
+				return nil, fmt.Errorf("%w: freelist holds page %d twice", ErrCorrupt, page_number)
+			}
+			free[page_number] = true
+		}
+	}
+	return free, nil
+}
+
+// incremental_vacuum takes limit pages off the freelist, or all of them if
+// limit isn't positive, by moving the pages in use from the end of the
+// database into free pages below the new end and truncating
+func (pager *Pager) incremental_vacuum(limit int) error {
+	root, err := pager.get_root()
+	if err != nil {
+		return err
+	}
+	defer pager.Unpin(root)
+	free, err := pager.free_page_set(root)
+	if err != nil {
+		return err
+	}
+	reclaim := len(free)
+	if limit > 0 {
+		reclaim = min(reclaim, limit)
+	}
+	if reclaim == 0 {
+		return nil
+	}
+	references, err := pager.page_references()
+	if err != nil {
+		return err
+	}
+
+	end := pager.num_pages - reclaim
+	var holes []int
+	for page_number := 1; page_number < end; page_number++ {
+		if free[page_number] {
+			holes = append(holes, page_number)
+		}
+	}
+	moved := make(map[int]int)
+	for page_number := end; page_number < pager.num_pages; page_number++ {
+		reference, reachable := references[page_number]
+		if free[page_number] || !reachable {
+			// Nothing to keep, the page goes with the tail
+			continue
+		}
+		if err := pager.relocate(page_number, holes[0], reference, moved); err != nil {
+			return err
+		}
+		holes = holes[1:]
+	}
+
+	// Holes left over go back on a freelist rebuilt without the tail
+	if err := pager.Write(root); err != nil {
+		return err
+	}
+	set_freelist(root, 0, 0)
+	for _, hole := range holes {
+		page, err := pager.GetPage(hole)
+		if err != nil {
+			return err
+		}
+		err = pager.FreePage(page)
+		pager.Unpin(page)
+		if err != nil {
+			return err
+		}
+	}
+	return pager.truncate(end)
+}
+
+// relocate copies page_number into the free page hole and points whatever
+// pointed at it there instead. moved maps pages already relocated to where
+// they went, in case one of them holds the pointer
+func (pager *Pager) relocate(page_number int, hole int, reference page_reference, moved map[int]int) error {
+	source, err := pager.GetPage(page_number)
+	if err != nil {
+		return err
+	}
+	defer pager.Unpin(source)
+	target, err := pager.GetPage(hole)
+	if err != nil {
+		return err
+	}
+	defer pager.Unpin(target)
+	if err := pager.Write(target); err != nil {
+		return err
+	}
+	copy(target.slotted_array, source.slotted_array)
+
+	if reference.kind == childPointer {
+		target.set_field32(0, hole)
+		if prev := target.prev_sibling(); prev != 0 {
+			err := pager.update_page(prev, func(page *Page) error {
+				page.set_next_sibling(hole)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if next := target.next_sibling(); next != 0 {
+			err := pager.update_page(next, func(page *Page) error {
+				page.set_prev_sibling(hole)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	from := reference.from
+	if to, found := moved[from]; found {
+		from = to
+	}
+	err = pager.update_page(from, func(holder *Page) error {
+		if reference.kind == nextOverflowPointer {
+			binary.BigEndian.PutUint32(holder.slotted_array[0:4], uint32(hole))
+			return nil
+		}
+		if reference.kind == childPointer && reference.cell == holder.cell_count() {
+			holder.set_rightmost_child(hole)
+			return nil
+		}
+		cell, err := holder.cell(reference.cell)
+		if err != nil {
+			return err
+		}
+		if reference.kind == childPointer {
+			binary.BigEndian.PutUint32(cell[0:4], uint32(hole))
+		} else {
+			binary.BigEndian.PutUint32(cell[len(cell)-4:], uint32(hole))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	moved[page_number] = hole
+	return nil
+}
+
+// update_page applies change to a page, telling the journal first
+func (pager *Pager) update_page(page_number int, change func(page *Page) error) error {
+	page, err := pager.GetPage(page_number)
+	if err != nil {
+		return err
+	}
+	defer pager.Unpin(page)
+	if err := pager.Write(page); err != nil {
+		return err
+	}
+	return change(page)
+}
+
+// truncate shrinks the database to num_pages pages as of the next commit.
+// The pages cut off go through Write first so the journal can bring them
+// back if the transaction rolls back
+func (pager *Pager) truncate(num_pages int) error {
+	for page_number := num_pages; page_number < pager.num_pages; page_number++ {
+		page, err := pager.GetPage(page_number)
+		if err != nil {
+			return err
+		}
+		err = pager.Write(page)
+		pager.Unpin(page)
+		if err != nil {
+			return err
+		}
+	}
+	for _, page := range pager.cache.content {
+		if page.page_number >= num_pages {
+			pager.cache.remove(page)
+		}
+	}
+	pager.num_pages = num_pages
+
+	root, err := pager.get_root()
+	if err != nil {
+		return err
+	}
+	defer pager.Unpin(root)
+	if err := pager.Write(root); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(root.slotted_array[30:34], uint32(num_pages))
+	return nil
+}
+
+// Vacuum rebuilds the database into a temporary file with every node packed
+// full and nothing on the freelist, then copies that over the database in
+// one transaction, so a crash leaves either the old database or the new one.
+// It can't run inside a transaction or while cursors are open, and commits
+// any changes made before it first
+func (btree *BTree) Vacuum() error {
+	pager := btree.pager
+	pager.mutex.Lock()
+	defer pager.mutex.Unlock()
+	if btree.transaction != nil {
+		return ErrTransactionActive
+	}
+	if pager.holds > 0 {
+		return ErrCursorsOpen
+	}
+	if err := pager.FlushCache(); err != nil {
+		return err
+	}
+	if err := pager.begin_write(); err != nil {
+		pager.unlock()
+		return err
+	}
+	defer pager.unlock()
+	defer btree.release()
+
+	if err := btree.vacuum(); err != nil {
+		if rollback_err := pager.Rollback(); rollback_err != nil {
+			return rollback_err
+		}
+		return err
+	}
+	return pager.FlushCache()
+}
+
+func (btree *BTree) vacuum() error {
+	pager := btree.pager
+	root, err := btree.get_page(0)
+	if err != nil || !is_initialized(root) {
+		return err
+	}
+
+	temp_name := pager.storage.file_name + "-vacuum"
+	if err := os.Remove(temp_name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	storage, err := InitializeStorage(temp_name, JournalModeOff)
+	if err != nil {
+		return err
+	}
+	storage.page_size = pager.storage.page_size
+	defer os.Remove(temp_name)
+	defer storage.Close()
+	temp := InitializeBtree(InitializePager(storage))
+	if err := btree.copy_into(temp, root); err != nil {
+		return err
+	}
+
+	// Page 0 goes first so the header the allocations below update is the
+	// rebuilt one
+	for page_number := 0; page_number < temp.pager.num_pages; page_number++ {
+		source, err := temp.pager.GetPage(page_number)
+		if err != nil {
+			return err
+		}
+		var target *Page
+		if page_number < pager.num_pages {
+			target, err = pager.GetPage(page_number)
+		} else {
+			target, err = pager.AllocatePage()
+		}
+		if err == nil {
+			err = pager.Write(target)
+		}
+		if err != nil {
+			temp.pager.Unpin(source)
+			return err
+		}
+		copy(target.slotted_array, source.slotted_array)
+		pager.Unpin(target)
+		temp.pager.Unpin(source)
+	}
+	if temp.pager.num_pages < pager.num_pages {
+		return pager.truncate(temp.pager.num_pages)
+	}
+	return nil
+}
+
+// copy_into bulk loads every record of btree into the empty tree temp. Leaves
+// are filled one after another in key order and each level of internal
+// nodes is built over the one below, so every page but the last on a level
+// ends up full
+func (btree *BTree) copy_into(temp *BTree, root *Page) error {
+	temp_root, err := temp.pager.get_root()
+	if err != nil {
+		return err
+	}
+	defer temp.pager.Unpin(temp_root)
+	if err := temp.pager.Write(temp_root); err != nil {
+		return err
+	}
+	copy(temp_root.slotted_array[:dbHeaderSize], root.slotted_array[:dbHeaderSize])
+	set_freelist(temp_root, 0, 0)
+	temp_root.init_node(leafFlag)
+
+	type node_entry struct {
+		page_number int
+		first_key   uint32
+	}
+	var nodes []node_entry
+	var previous *Page
+	var cells [][]byte
+	// add_node writes cells out as the next node on a level
+	add_node := func(flags byte, rightmost int) error {
+		page, err := temp.pager.AllocatePage()
+		if err != nil {
+			return err
+		}
+		page.init_node(flags)
+		page.write_cells(cells)
+		if flags == internalFlag {
+			page.set_rightmost_child(rightmost)
+		}
+		if previous != nil {
+			previous.set_next_sibling(page.page_number)
+			page.set_prev_sibling(previous.page_number)
+			temp.pager.Unpin(previous)
+		}
+		previous = page
+		return nil
+	}
+	finish_level := func() {
+		if previous != nil {
+			temp.pager.Unpin(previous)
+			previous = nil
+		}
+	}
+	node_space := temp.pager.storage.page_size - nodeHeaderSize
+
+	path, err := btree.find_leaf_node(root, 0)
+	if err != nil {
+		return err
+	}
+	first_key := uint32(0)
+	for page_number := path[len(path)-1].page_number; ; {
+		leaf, err := btree.get_page(page_number)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < leaf.cell_count(); i++ {
+			leaf_cell, err := leaf.cell(i)
+			if err != nil {
+				return err
+			}
+			key := leaf_cell_key(leaf_cell)
+			payload, err := btree.read_payload(leaf_cell)
+			if err != nil {
+				return err
+			}
+			cell, err := temp.build_leaf_cell(key, payload)
+			if err != nil {
+				return err
+			}
+			if len(cells) > 0 && cells_size(cells)+len(cell)+2 > node_space {
+				if err := add_node(leafFlag, 0); err != nil {
+					return err
+				}
+				nodes = append(nodes, node_entry{previous.page_number, first_key})
+				cells = cells[:0]
+			}
+			if len(cells) == 0 {
+				first_key = key
+			}
+			cells = append(cells, cell)
+		}
+		page_number = leaf.next_sibling()
+		btree.release()
+		temp.release()
+		if page_number == 0 {
+			break
+		}
+	}
+
+	if len(nodes) == 0 && temp_root.cells_fit(cells) {
+		// Small enough to stay in the root
+		temp_root.write_cells(cells)
+		return nil
+	}
+	if len(nodes) == 0 {
+		// One leaf too big for the root, the root needs two children
+		mid := split_point(cells)
+		last := cells[mid:]
+		cells = cells[:mid]
+		if err := add_node(leafFlag, 0); err != nil {
+			return err
+		}
+		nodes = append(nodes, node_entry{previous.page_number, first_key})
+		cells, first_key = last, leaf_cell_key(last[0])
+	}
+	if err := add_node(leafFlag, 0); err != nil {
+		return err
+	}
+	nodes = append(nodes, node_entry{previous.page_number, first_key})
+	finish_level()
+
+	// Each internal node takes children until its cells fill the page, a
+	// child's separator being the first key of the child after it
+	for {
+		if (len(nodes)-1)*(internalCellSize+2) <= temp_root.usable_space() {
+			cells = cells[:0]
+			for i := 0; i < len(nodes)-1; i++ {
+				cells = append(cells, internal_cell(nodes[i].page_number, nodes[i+1].first_key))
+			}
+			temp_root.init_node(internalFlag)
+			temp_root.write_cells(cells)
+			temp_root.set_rightmost_child(nodes[len(nodes)-1].page_number)
+			return nil
+		}
+
+		// Children are shared out evenly so no node is left with only one
+		per_node := node_space/(internalCellSize+2) + 1
+		parent_count := (len(nodes) + per_node - 1) / per_node
+		var parents []node_entry
+		for i, start := 0, 0; i < parent_count; i++ {
+			end := start + (len(nodes)-start)/(parent_count-i)
+			children := nodes[start:end]
+			start = end
+			cells = cells[:0]
+			for i := 0; i < len(children)-1; i++ {
+				cells = append(cells, internal_cell(children[i].page_number, children[i+1].first_key))
+			}
+			if err := add_node(internalFlag, children[len(children)-1].page_number); err != nil {
+				return err
+			}
+			parents = append(parents, node_entry{previous.page_number, children[0].first_key})
+		}
+		finish_level()
+		nodes = parents
+	}
+}
@@ -0,0 +1,257 @@
+package storage_manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fill_and_purge inserts records, some with overflow chains, then deletes
+// all but every third one, leaving the database full of free pages
+func fill_and_purge(t *testing.T, btree *BTree) {
+	t.Helper()
+	transaction, err := btree.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	for key := 0; key < 3000; key++ {
+		if err := transaction.Insert(uint32(key), test_values(key)); err != nil {
+			t.Fatalf("Insert(%d): %v", key, err)
+		}
+	}
+	for key := 0; key < 3000; key++ {
+		if key%3 != 0 {
+			if err := transaction.Delete(uint32(key)); err != nil {
+				t.Fatalf("Delete(%d): %v", key, err)
+			}
+		}
+	}
+	if err := transaction.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func test_values(key int) []any {
+	if key%50 == 0 {
+		return []any{fmt.Sprintf("cat%d", key), strings.Repeat("whiskers", 1000)}
+	}
+	return []any{fmt.Sprintf("cat%d", key), int64(key)}
+}
+
+// check_purged_tree verifies the tree's structure and that it holds exactly
+// the records fill_and_purge left behind
+func check_purged_tree(t *testing.T, btree *BTree) {
+	t.Helper()
+	// Range goes first, it takes the lock that rolls back a hot journal
+	records, err := btree.Range(0, 1<<32-1)
+	if err != nil {
+		t.Fatalf("Range: %v", err)
+	}
+	root := get_test_page(t, btree, 0)
+	check_node(t, btree, root, 0, 1<<32)
+	btree.pager.Unpin(root)
+
+	if len(records) != 1000 {
+		t.Fatalf("Expected 1000 records, got %d", len(records))
+	}
+	for i, record := range records {
+		if record.Key != uint32(3*i) || !reflect.DeepEqual(record.Values, test_values(3*i)) {
+			t.Fatalf("Record %d read back wrong: key %d", i, record.Key)
+		}
+	}
+	cursor, backward := btree.NewCursor(), 0
+	for ok := cursor.Last(); ok; ok = cursor.Prev() {
+		backward += 1
+	}
+	cursor.Close()
+	if backward != len(records) {
+		t.Fatalf("Backward scan saw %d records, expected %d", backward, len(records))
+	}
+}
+
+func TestVacuumShrinksDatabase(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeWAL, JournalModeDelete} {
+		t.Run(mode.String(), func(t *testing.T) {
+			file_name := filepath.Join(t.TempDir(), "Boots.db")
+			btree := open_test_btree_in_mode(t, file_name, mode)
+			btree.SetAutoVacuum(AutoVacuumIncremental)
+			fill_and_purge(t, btree)
+			num_pages := btree.pager.num_pages
+
+			if err := btree.Vacuum(); err != nil {
+				t.Fatalf("Vacuum: %v", err)
+			}
+			if btree.pager.num_pages >= num_pages/2 {
+				t.Errorf("Expected Vacuum to more than halve %d pages, got %d", num_pages, btree.pager.num_pages)
+			}
+			if free := len(free_pages(t, btree)); free != 0 {
+				t.Errorf("Expected an empty freelist, got %d pages", free)
+			}
+			if _, err := os.Stat(file_name + "-vacuum"); !os.IsNotExist(err) {
+				t.Errorf("Expected the temporary file to be gone, got %v", err)
+			}
+			if mode, _ := btree.AutoVacuum(); mode != AutoVacuumIncremental {
+				t.Errorf("Expected Vacuum to keep the header, auto-vacuum is %v", mode)
+			}
+			check_purged_tree(t, btree)
+			vacuumed_pages := btree.pager.num_pages
+			if err := btree.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if info, _ := os.Stat(file_name); info.Size() != int64(vacuumed_pages)*defaultPageSize {
+				t.Errorf("Expected the file to shrink to %d pages, got %d bytes", vacuumed_pages, info.Size())
+			}
+			reopened := open_test_btree_in_mode(t, file_name, mode)
+			check_purged_tree(t, reopened)
+			for key := 1; key < 3000; key += 3 {
+				if err := reopened.Insert(uint32(key), test_values(key)); err != nil {
+					t.Fatalf("Insert(%d) after Vacuum: %v", key, err)
+				}
+			}
+		})
+	}
+}
+
+func TestVacuumIsAllOrNothing(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree_in_mode(t, file_name, JournalModeDelete)
+	fill_and_purge(t, btree)
+
+	transaction, _ := btree.Begin()
+	if err := btree.Vacuum(); err != ErrTransactionActive {
+		t.Errorf("Expected ErrTransactionActive, got %v", err)
+	}
+	transaction.Rollback()
+	cursor := btree.NewCursor()
+	cursor.First()
+	if err := btree.Vacuum(); err != ErrCursorsOpen {
+		t.Errorf("Expected ErrCursorsOpen, got %v", err)
+	}
+	cursor.Close()
+
+	// Dying halfway through copying back leaves a hot journal behind
+	btree.pager.SetCacheSize(8)
+	if err := btree.vacuum_without_commit(); err != nil {
+		t.Fatal(err)
+	}
+	crash(btree)
+
+	reopened := open_test_btree_in_mode(t, file_name, JournalModeDelete)
+	check_purged_tree(t, reopened)
+}
+
+// vacuum_without_commit does all of Vacuum but the commit, spilling to the
+// database file if the cache is small enough
+func (btree *BTree) vacuum_without_commit() error {
+	btree.pager.mutex.Lock()
+	defer btree.pager.mutex.Unlock()
+	if err := btree.pager.begin_write(); err != nil {
+		return err
+	}
+	defer btree.release()
+	return btree.vacuum()
+}
+
+func TestIncrementalVacuum(t *testing.T) {
+	for _, mode := range []JournalMode{JournalModeWAL, JournalModeDelete} {
+		t.Run(mode.String(), func(t *testing.T) {
+			file_name := filepath.Join(t.TempDir(), "Boots.db")
+			btree := open_test_btree_in_mode(t, file_name, mode)
+			if err := btree.SetAutoVacuum(AutoVacuumIncremental); err != nil {
+				t.Fatal(err)
+			}
+			fill_and_purge(t, btree)
+			num_pages := btree.pager.num_pages
+			free := len(free_pages(t, btree))
+			if free == 0 {
+				t.Fatal("Expected deletes to free pages in incremental mode")
+			}
+
+			if err := btree.IncrementalVacuum(10); err != nil {
+				t.Fatalf("IncrementalVacuum: %v", err)
+			}
+			if btree.pager.num_pages != num_pages-10 || len(free_pages(t, btree)) != free-10 {
+				t.Errorf("Expected 10 pages reclaimed, %d -> %d pages", num_pages, btree.pager.num_pages)
+			}
+			check_purged_tree(t, btree)
+
+			// Rolled back, the pages come back
+			transaction, _ := btree.Begin()
+			btree.IncrementalVacuum(0)
+			if err := transaction.Rollback(); err != nil {
+				t.Fatalf("Rollback: %v", err)
+			}
+			if btree.pager.num_pages != num_pages-10 {
+				t.Errorf("Expected rollback to restore %d pages, got %d", num_pages-10, btree.pager.num_pages)
+			}
+			check_purged_tree(t, btree)
+
+			if err := btree.IncrementalVacuum(0); err != nil {
+				t.Fatalf("IncrementalVacuum: %v", err)
+			}
+			if btree.pager.num_pages != num_pages-free {
+				t.Errorf("Expected %d pages after reclaiming everything, got %d", num_pages-free, btree.pager.num_pages)
+			}
+			if len(free_pages(t, btree)) != 0 {
+				t.Errorf("Expected an empty freelist")
+			}
+			check_purged_tree(t, btree)
+			if err := btree.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened := open_test_btree_in_mode(t, file_name, mode)
+			check_purged_tree(t, reopened)
+			if info, _ := os.Stat(file_name); info.Size() != int64(num_pages-free)*defaultPageSize {
+				t.Errorf("Expected the file to shrink to %d pages, got %d bytes", num_pages-free, info.Size())
+			}
+		})
+	}
+}
+
+func TestFullAutoVacuumTruncatesOnCommit(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree_in_mode(t, file_name, JournalModeDelete)
+	if err := btree.SetAutoVacuum(AutoVacuumFull); err != nil {
+		t.Fatal(err)
+	}
+	transaction, _ := btree.Begin()
+	for key := 0; key < 3000; key++ {
+		transaction.Insert(uint32(key), test_values(key))
+	}
+	transaction.Commit()
+	num_pages := btree.pager.num_pages
+
+	// An open cursor holds the vacuum off until a later commit
+	cursor := btree.NewCursor()
+	cursor.First()
+	transaction, _ = btree.Begin()
+	for key := 0; key < 3000; key++ {
+		if key%3 != 0 {
+			transaction.Delete(uint32(key))
+		}
+	}
+	transaction.Commit()
+	if len(free_pages(t, btree)) == 0 {
+		t.Errorf("Expected free pages to wait for the cursor to close")
+	}
+	cursor.Close()
+
+	btree.Delete(1)
+	btree.Insert(1, test_values(1))
+	if err := btree.pager.FlushCache(); err != nil {
+		t.Fatal(err)
+	}
+	if len(free_pages(t, btree)) != 0 {
+		t.Errorf("Expected the commit to empty the freelist")
+	}
+	if info, _ := os.Stat(file_name); info.Size() >= int64(num_pages)*defaultPageSize/2 {
+		t.Errorf("Expected the file to shrink well below %d pages, got %d bytes", num_pages, info.Size())
+	}
+	btree.Delete(1)
+	check_purged_tree(t, btree)
+}
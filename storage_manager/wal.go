@@ -0,0 +1,445 @@
+/**
+ * Write-Ahead Log (Boots.db-wal, modeled on SQLite's WAL)
+ *
+ * Committed page images are appended to the WAL instead of overwriting
+ * Boots.db. Reads check the WAL index first, and a checkpoint copies the
+ * newest image of every page back into Boots.db and resets the log.
+ *
+ * **WAL Header (32 bytes):**
+ * - 0-3: Magic number (uint32_t, 0x424f5457 "BOTW")
+ * - 4-7: Format version (uint32_t, 1)
+ * - 8-11: Page size (uint32_t)
+ * - 12-15: Checkpoint sequence number (uint32_t)
+ * - 16-19: Salt-1 (uint32_t, random, changes on every reset)
+ * - 20-23: Salt-2 (uint32_t, random, changes on every reset)
+ * - 24-31: Checksum of bytes 0-23
+ *
+ * **Frame (24-byte header followed by one page):**
+ * - 0-3: Page number (uint32_t)
+ * - 4-7: Database size in pages for commit frames, 0 otherwise
+ * - 8-15: Salt-1 and Salt-2 copied from the WAL header
+ * - 16-23: Cumulative checksum of bytes 0-15 and the page, seeded with the
+ *   previous frame's checksum (or the header's for the first frame)
+ *
+ * A transaction is its frames up to and including a commit frame. Recovery
+ * walks the frames while the salts and checksums hold and keeps everything
+ * up to the last commit frame, so a torn or half written transaction simply
+ * disappears.
+ *
+ * **Snapshots:**
+ * Each connection has its own index and only catches it up with the log as
+ * it takes its Shared lock, so the frames it knows about are a snapshot that
+ * holds for as long as it keeps reading. Writers commit by appending past
+ * every snapshot under a Reserved lock without waiting for readers, and a
+ * checkpoint, which overwrites the database file, only runs once nobody is
+ * reading. A transaction that wants to write on top of a snapshot someone
+ * has since committed past gets ErrBusySnapshot.
+ */
+
+package storage_manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"os"
+)
+
+const (
+	walMagic           = 0x424f5457
+	walVersion         = 1
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+
+	// Committing past this many frames triggers a checkpoint
+	walAutoCheckpoint = 1000
+)
+
+type wal struct {
+	storage *Storage
+	file    *os.File
+
+	page_size           int // Header bytes 8-11, the size of every page image in the log
+	checkpoint_sequence uint32
+	salt1, salt2        uint32
+	checksum            [2]uint32 // Running checksum of the last frame written
+
+	end     int64         // Offset the next frame is written at
+	index   map[int]int64 // Page number -> offset of its newest committed frame
+	pending map[int]int64 // Frames spilled by the open transaction, not yet committed
+	frames  int           // Committed frames since the last reset
+	db_size int           // Database size in pages as of the last commit, 0 if none
+
+	// Committed state to fall back on when pending frames are thrown away
+	commit_end      int64
+	commit_checksum [2]uint32
+}
+
+// wal_checksum folds data into a running checksum eight bytes at a time, the
+// way SQLite does. data is always a multiple of 8 bytes long
+func wal_checksum(data []byte, checksum [2]uint32) [2]uint32 {
+	s0, s1 := checksum[0], checksum[1]
+	for i := 0; i < len(data); i += 8 {
+		s0 += binary.BigEndian.Uint32(data[i:i+4]) + s1
+		s1 += binary.BigEndian.Uint32(data[i+4:i+8]) + s0
+	}
+	return [2]uint32{s0, s1}
+}
+
+func open_wal(storage *Storage, file_name string) (*wal, error) {
+	file, err := os.OpenFile(file_name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	log := &wal{
+		storage: storage,
+		file:    file,
+		index:   make(map[int]int64),
+		pending: make(map[int]int64),
+	}
+	if err := log.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+// recover rebuilds the index from the frames of every committed transaction
+// in the log. A missing or damaged header means there is nothing to recover,
+// and the next writer starts a new generation of the log
+func (log *wal) recover() error {
+	clear(log.index)
+	clear(log.pending)
+	log.frames = 0
+	log.db_size = 0
+	log.end = 0
+	log.commit_end = 0
+
+	header := make([]byte, walHeaderSize)
+	if _, err := log.file.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	checksum := wal_checksum(header[0:24], [2]uint32{})
+	if binary.BigEndian.Uint32(header[0:4]) != walMagic ||
+		!valid_page_size(int(binary.BigEndian.Uint32(header[8:12]))) ||
+		binary.BigEndian.Uint32(header[24:28]) != checksum[0] ||
+		binary.BigEndian.Uint32(header[28:32]) != checksum[1] {
+		return nil
+	}
+	log.page_size = int(binary.BigEndian.Uint32(header[8:12]))
+	log.checkpoint_sequence = binary.BigEndian.Uint32(header[12:16])
+	log.salt1 = binary.BigEndian.Uint32(header[16:20])
+	log.salt2 = binary.BigEndian.Uint32(header[20:24])
+	log.commit_checksum = checksum
+	log.commit_end = walHeaderSize
+	if _, err := log.scan(true); err != nil {
+		return err
+	}
+	if log.db_size != 0 && log.storage != nil {
+		// A database that so far only exists in the log has its page size
+		// nowhere else
+		log.storage.page_size = log.page_size
+	}
+	return nil
+}
+
+func (log *wal) frame_size() int64 {
+	return int64(walFrameHeaderSize + log.page_size)
+}
+
+// scan walks the frames after the last known commit while the salts and
+// checksums hold, indexing every transaction that reached its commit frame.
+// Without apply it only reports whether there is one, leaving the index as
+// it is
+func (log *wal) scan(apply bool) (bool, error) {
+	frame := make([]byte, log.frame_size())
+	uncommitted := make(map[int]int64)
+	checksum := log.commit_checksum
+	changed := false
+	for offset := log.commit_end; ; offset += log.frame_size() {
+		if _, err := log.file.ReadAt(frame, offset); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return false, err
+		}
+		if binary.BigEndian.Uint32(frame[8:12]) != log.salt1 || binary.BigEndian.Uint32(frame[12:16]) != log.salt2 {
+			break
+		}
+		checksum = wal_checksum(frame[walFrameHeaderSize:], wal_checksum(frame[0:16], checksum))
+		if binary.BigEndian.Uint32(frame[16:20]) != checksum[0] || binary.BigEndian.Uint32(frame[20:24]) != checksum[1] {
+			break
+		}
+
+		uncommitted[int(binary.BigEndian.Uint32(frame[0:4]))] = offset + walFrameHeaderSize
+		if db_size := int(binary.BigEndian.Uint32(frame[4:8])); db_size != 0 {
+			if !apply {
+				return true, nil
+			}
+			for page_number, data_offset := range uncommitted {
+				log.index[page_number] = data_offset
+			}
+			log.frames += len(uncommitted)
+			clear(uncommitted)
+			log.db_size = db_size
+			log.commit_end = offset + log.frame_size()
+			log.commit_checksum = checksum
+			changed = true
+		}
+	}
+	if !apply {
+		return false, nil
+	}
+
+	// Anything after the last commit frame is overwritten by the next writer
+	log.end = log.commit_end
+	log.checksum = log.commit_checksum
+	return changed, nil
+}
+
+// refresh catches the index up with transactions other connections committed.
+// A log that was checkpointed and reset, or removed and created again, is
+// read from the start
+func (log *wal) refresh() (bool, error) {
+	open_info, err := log.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	disk_info, err := os.Stat(log.file.Name())
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err != nil || !os.SameFile(open_info, disk_info) {
+		file, err := os.OpenFile(log.file.Name(), os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return false, err
+		}
+		log.file.Close()
+		log.file = file
+		return log.reread()
+	}
+
+	header := make([]byte, walHeaderSize)
+	if _, err := log.file.ReadAt(header, 0); err != nil && err != io.EOF {
+		return false, err
+	}
+	if log.commit_end == 0 ||
+		binary.BigEndian.Uint32(header[12:16]) != log.checkpoint_sequence ||
+		binary.BigEndian.Uint32(header[16:20]) != log.salt1 ||
+		binary.BigEndian.Uint32(header[20:24]) != log.salt2 {
+		return log.reread()
+	}
+	return log.scan(true)
+}
+
+// changed reports whether another connection committed since the index was
+// last caught up, without catching it up. It's only asked while the
+// connection holds Shared, when nobody can checkpoint and the log can only
+// have grown
+func (log *wal) changed() (bool, error) {
+	if log.commit_end == 0 {
+		// The log had no header, another connection may have started one
+		probe := &wal{file: log.file, index: make(map[int]int64), pending: make(map[int]int64)}
+		if err := probe.recover(); err != nil {
+			return false, err
+		}
+		return probe.db_size != 0, nil
+	}
+	return log.scan(false)
+}
+
+// reread rebuilds the index from scratch, reporting whether that could have
+// changed any page
+func (log *wal) reread() (bool, error) {
+	had_frames := len(log.index) != 0
+	if err := log.recover(); err != nil {
+		return false, err
+	}
+	return had_frames || len(log.index) != 0, nil
+}
+
+// reset empties the log and starts a new generation with fresh salts so
+// frames left over from the old one can never pass as valid
+func (log *wal) reset() error {
+	if err := log.file.Truncate(0); err != nil {
+		return err
+	}
+	log.page_size = log.storage.page_size
+	log.checkpoint_sequence += 1
+	log.salt1 = rand.Uint32()
+	log.salt2 = rand.Uint32()
+
+	header := make([]byte, walHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], walMagic)
+	binary.BigEndian.PutUint32(header[4:8], walVersion)
+	binary.BigEndian.PutUint32(header[8:12], uint32(log.page_size))
+	binary.BigEndian.PutUint32(header[12:16], log.checkpoint_sequence)
+	binary.BigEndian.PutUint32(header[16:20], log.salt1)
+	binary.BigEndian.PutUint32(header[20:24], log.salt2)
+	log.checksum = wal_checksum(header[0:24], [2]uint32{})
+	binary.BigEndian.PutUint32(header[24:28], log.checksum[0])
+	binary.BigEndian.PutUint32(header[28:32], log.checksum[1])
+	if _, err := log.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+
+	log.end = walHeaderSize
+	log.commit_end = walHeaderSize
+	log.commit_checksum = log.checksum
+	clear(log.index)
+	clear(log.pending)
+	log.frames = 0
+	log.db_size = 0
+	return log.file.Sync()
+}
+
+// append_frame writes one page image at the end of the log. A non-zero
+// db_size marks it as the commit frame of its transaction
+func (log *wal) append_frame(page *Page, db_size int) error {
+	if log.end == 0 || log.page_size != len(page.slotted_array) {
+		// No valid header yet, this is the first frame of a new log. A log
+		// of another page size can only be left over from before the
+		// database was created, see SetPageSize
+		if err := log.reset(); err != nil {
+			return err
+		}
+	}
+	frame := make([]byte, log.frame_size())
+	binary.BigEndian.PutUint32(frame[0:4], uint32(page.page_number))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(db_size))
+	binary.BigEndian.PutUint32(frame[8:12], log.salt1)
+	binary.BigEndian.PutUint32(frame[12:16], log.salt2)
+	copy(frame[walFrameHeaderSize:], page.slotted_array)
+	checksum := wal_checksum(frame[walFrameHeaderSize:], wal_checksum(frame[0:16], log.checksum))
+	binary.BigEndian.PutUint32(frame[16:20], checksum[0])
+	binary.BigEndian.PutUint32(frame[20:24], checksum[1])
+
+	if _, err := log.file.WriteAt(frame, log.end); err != nil {
+		return err
+	}
+	log.checksum = checksum
+	log.pending[page.page_number] = log.end + walFrameHeaderSize
+	log.end += log.frame_size()
+	return nil
+}
+
+// preserve has nothing to do, the database file never changes before a
+// checkpoint so the original of every page is still there
+func (log *wal) preserve(page *Page) error {
+	return nil
+}
+
+// spill writes a dirty page that has to leave the cache before its
+// transaction commits. Only this connection can see it until then
+func (log *wal) spill(page *Page) error {
+	return log.append_frame(page, 0)
+}
+
+// commit appends pages with the last one as the commit frame, fsyncs the log
+// and makes every frame of the transaction visible through the index
+func (log *wal) commit(pages []*Page, db_size int) error {
+	for i, page := range pages {
+		commit_size := 0
+		if i == len(pages)-1 {
+			commit_size = db_size
+		}
+		if err := log.append_frame(page, commit_size); err != nil {
+			return err
+		}
+	}
+	if err := log.file.Sync(); err != nil {
+		return err
+	}
+
+	for page_number, offset := range log.pending {
+		log.index[page_number] = offset
+	}
+	log.frames += len(log.pending)
+	clear(log.pending)
+	log.db_size = db_size
+	log.commit_end = log.end
+	log.commit_checksum = log.checksum
+	return nil
+}
+
+// rollback forgets spilled frames of a transaction that won't commit
+func (log *wal) rollback() error {
+	clear(log.pending)
+	log.end = log.commit_end
+	log.checksum = log.commit_checksum
+	return nil
+}
+
+func (log *wal) has_pending() bool {
+	return len(log.pending) != 0
+}
+
+// read_page returns the newest image of page_number in the log, or nil if
+// the log doesn't hold one
+func (log *wal) read_page(page_number int) ([]byte, error) {
+	offset, found := log.pending[page_number]
+	if !found {
+		offset, found = log.index[page_number]
+	}
+	if !found {
+		return nil, nil
+	}
+
+	buffer := make([]byte, log.page_size)
+	if _, err := log.file.ReadAt(buffer, offset); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+var errWalPending = errors.New("wal: cannot checkpoint with uncommitted frames")
+
+// checkpoint copies the newest committed image of every page into the
+// database file, fsyncs it and resets the log
+func (log *wal) checkpoint() error {
+	storage := log.storage
+	if len(log.pending) != 0 {
+		return errWalPending
+	}
+	if len(log.index) == 0 {
+		return nil
+	}
+
+	buffer := make([]byte, log.page_size)
+	for page_number, offset := range log.index {
+		if _, err := log.file.ReadAt(buffer, offset); err != nil {
+			return err
+		}
+		if err := storage.write_page_to_disk(page_number, buffer); err != nil {
+			return err
+		}
+	}
+	if err := storage.truncate(log.db_size); err != nil {
+		return err
+	}
+	if err := storage.sync(); err != nil {
+		return err
+	}
+	return log.reset()
+}
+
+// close checkpoints and removes the log, unless other connections are still
+// using it and the last one out has to. If the checkpoint fails the log is
+// kept so the next open can replay it
+func (log *wal) close() error {
+	locked, err := log.storage.try_lock(exclusiveLock)
+	if err == nil && locked {
+		err = log.checkpoint()
+	}
+	if close_err := log.file.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil && locked {
+		err = os.Remove(log.file.Name())
+	}
+	return err
+}
@@ -0,0 +1,362 @@
+package storage_manager
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// crash abandons a database without flushing or checkpointing, the way a
+// killed process would leave it
+func crash(btree *BTree) {
+	close_files(btree.pager.storage)
+}
+
+func test_wal(btree *BTree) *wal {
+	return btree.pager.storage.journal.(*wal)
+}
+
+func count_records(t *testing.T, btree *BTree) int {
+	t.Helper()
+	records, err := btree.Range(0, 1<<32-1)
+	if err != nil {
+		t.Fatalf("Range: %v", err)
+	}
+	for i, record := range records {
+		if record.Key != uint32(i) {
+			t.Fatalf("Expected key %d, got %d", i, record.Key)
+		}
+	}
+	return len(records)
+}
+
+func TestCommittedFramesAreReplayedAfterCrash(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	for key := 0; key < 500; key++ {
+		btree.Insert(uint32(key), []any{"cat", int64(key)})
+	}
+	if err := btree.pager.FlushCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The commit only reached the WAL, so reads have to go through its index
+	if info, _ := os.Stat(file_name); info.Size() != 0 {
+		t.Fatalf("Expected an empty database file before checkpointing, got %d bytes", info.Size())
+	}
+	btree.pager.SetCacheSize(1)
+	if count_records(t, btree) != 500 {
+		t.Fatal("Expected reads to find committed pages in the WAL")
+	}
+	crash(btree)
+
+	reopened := open_test_btree(t, file_name)
+	if n := count_records(t, reopened); n != 500 {
+		t.Errorf("Expected 500 records after recovery, got %d", n)
+	}
+	if info, _ := os.Stat(file_name); info.Size() == 0 {
+		t.Errorf("Expected recovery to checkpoint into the database file")
+	}
+	if len(test_wal(reopened).index) != 0 {
+		t.Errorf("Expected an empty WAL after recovery")
+	}
+}
+
+func TestUncommittedFramesAreDiscarded(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	for key := 0; key < 100; key++ {
+		btree.Insert(uint32(key), []any{"cat"})
+	}
+	btree.pager.FlushCache()
+
+	// A tiny cache spills the second batch into the WAL without committing it
+	btree.pager.SetCacheSize(4)
+	transaction, _ := btree.Begin()
+	for key := 100; key < 3000; key++ {
+		transaction.Insert(uint32(key), []any{"cat"})
+	}
+	if !btree.pager.storage.has_uncommitted() {
+		t.Fatal("Expected spilled frames in the WAL")
+	}
+	crash(btree)
+
+	reopened := open_test_btree(t, file_name)
+	if n := count_records(t, reopened); n != 100 {
+		t.Errorf("Expected only the 100 committed records, got %d", n)
+	}
+}
+
+func TestTornCommitIsIgnored(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	btree.Insert(0, []any{"luna"})
+	btree.pager.FlushCache()
+	btree.Insert(1, []any{"milo"})
+	btree.pager.FlushCache()
+	crash(btree)
+
+	// Damage the page image of the very last frame, the second commit
+	wal_file, _ := os.OpenFile(file_name+"-wal", os.O_RDWR, 0)
+	info, _ := wal_file.Stat()
+	wal_file.WriteAt([]byte{0xff}, info.Size()-100)
+	wal_file.Close()
+
+	reopened := open_test_btree(t, file_name)
+	if n := count_records(t, reopened); n != 1 {
+		t.Errorf("Expected only the first commit to survive, got %d records", n)
+	}
+}
+
+func TestCheckpointAndCloseEmptyTheWAL(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	btree := open_test_btree(t, file_name)
+	payload := strings.Repeat("x", 2000)
+	for key := 0; key < walAutoCheckpoint; key++ {
+		btree.Insert(uint32(key), []any{payload})
+		btree.pager.FlushCache()
+	}
+	if test_wal(btree).frames >= walAutoCheckpoint {
+		t.Errorf("Expected an automatic checkpoint, WAL holds %d frames", test_wal(btree).frames)
+	}
+
+	btree.Insert(walAutoCheckpoint, []any{payload})
+	if err := btree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file_name + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("Expected Close to remove the WAL, got %v", err)
+	}
+
+	reopened := open_test_btree(t, file_name)
+	if n := count_records(t, reopened); n != walAutoCheckpoint+1 {
+		t.Errorf("Expected %d records, got %d", walAutoCheckpoint+1, n)
+	}
+}
+
+func TestReadersKeepTheirSnapshot(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	reader := open_test_btree(t, file_name)
+	writer := open_test_btree(t, file_name)
+	for key := 0; key < 300; key++ {
+		writer.Insert(uint32(key), []any{"old"})
+	}
+	writer.pager.FlushCache()
+
+	// A tiny cache makes the reader go back to its snapshot for every page
+	reader.pager.SetCacheSize(4)
+	transaction, _ := reader.Begin()
+	if n := count_records(t, reader); n != 300 {
+		t.Fatalf("Expected the reader to see 300 records, got %d", n)
+	}
+	cursor := reader.NewCursor()
+	if !cursor.First() {
+		t.Fatalf("First: %v", cursor.Err)
+	}
+
+	for key := 0; key < 300; key++ {
+		writer.Update(uint32(key), []any{"new"})
+	}
+	for key := 300; key < 600; key++ {
+		writer.Insert(uint32(key), []any{"new"})
+	}
+	if err := writer.pager.FlushCache(); err != nil {
+		t.Fatalf("Expected the writer to commit while the reader reads, got %v", err)
+	}
+
+	seen := 0
+	for ; cursor.Valid(); cursor.Next() {
+		record, err := cursor.Record()
+		if err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+		if !reflect.DeepEqual(record.Values, []any{"old"}) {
+			t.Fatalf("Key %d = %v, expected the snapshot's value", cursor.Key(), record.Values)
+		}
+		seen += 1
+	}
+	cursor.Close()
+	if seen != 300 {
+		t.Errorf("Expected the cursor to see 300 records, got %d", seen)
+	}
+	if n := count_records(t, reader); n != 300 {
+		t.Errorf("Expected the transaction to keep seeing 300 records, got %d", n)
+	}
+
+	if err := transaction.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if n := count_records(t, reader); n != 600 {
+		t.Errorf("Expected a new snapshot to see 600 records, got %d", n)
+	}
+	record, err := reader.Get(0)
+	if err != nil || !reflect.DeepEqual(record.Values, []any{"new"}) {
+		t.Errorf("Get(0) = %v, %v, expected the writer's value", record, err)
+	}
+}
+
+func TestWritingOnStaleSnapshotIsBusy(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	reader := open_test_btree(t, file_name)
+	writer := open_test_btree(t, file_name)
+	writer.Insert(0, []any{"cat"})
+	writer.pager.FlushCache()
+
+	transaction, _ := reader.Begin()
+	if _, err := reader.Get(0); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	writer.Insert(1, []any{"cat"})
+	if err := writer.pager.FlushCache(); err != nil {
+		t.Fatalf("FlushCache: %v", err)
+	}
+
+	reader.pager.SetBusyTimeout(time.Second)
+	err := transaction.Insert(2, []any{"cat"})
+	if err != ErrBusySnapshot || !errors.Is(err, ErrBusy) {
+		t.Fatalf("Expected ErrBusySnapshot, got %v", err)
+	}
+	if n := count_records(t, reader); n != 1 {
+		t.Errorf("Expected the transaction to keep its snapshot, got %d records", n)
+	}
+	if err := transaction.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	// Starting over writes on top of the newest snapshot
+	if err := reader.Insert(2, []any{"cat"}); err != nil {
+		t.Fatalf("Insert after starting over: %v", err)
+	}
+	reader.pager.FlushCache()
+	if n := count_records(t, writer); n != 3 {
+		t.Errorf("Expected 3 records, got %d", n)
+	}
+}
+
+func TestCheckpointWaitsForReaders(t *testing.T) {
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+	reader := open_test_btree(t, file_name)
+	writer := open_test_btree(t, file_name)
+	writer.Insert(0, []any{"old"})
+	writer.pager.FlushCache()
+
+	transaction, _ := reader.Begin()
+	reader.Get(0)
+	writer.Update(0, []any{"new"})
+	test_wal(writer).frames = walAutoCheckpoint
+	if err := writer.pager.FlushCache(); err != nil {
+		t.Fatalf("FlushCache: %v", err)
+	}
+	if test_wal(writer).frames == 0 {
+		t.Fatal("Expected the checkpoint to wait for the reader")
+	}
+	if writer.pager.storage.lock_level != noLock {
+		t.Errorf("Expected the writer to drop its lock, got %d", writer.pager.storage.lock_level)
+	}
+
+	// Dropping the cache makes the reader reread page 0 from its snapshot
+	reader.pager.reset_cache()
+	record, err := reader.Get(0)
+	if err != nil || !reflect.DeepEqual(record.Values, []any{"old"}) {
+		t.Fatalf("Get(0) = %v, %v, expected the snapshot's value", record, err)
+	}
+	transaction.Commit()
+
+	writer.Insert(1, []any{"new"})
+	if err := writer.pager.FlushCache(); err != nil {
+		t.Fatalf("FlushCache: %v", err)
+	}
+	if frames := test_wal(writer).frames; frames != 0 {
+		t.Errorf("Expected a checkpoint once the reader left, WAL holds %d frames", frames)
+	}
+	if n := count_records(t, reader); n != 2 {
+		t.Errorf("Expected 2 records, got %d", n)
+	}
+}
+
+const crashBatchSize = 50
+
+// TestCrashChild is run by kill_child_mid_commit in a separate process that
+// commits batches until it gets killed
+func TestCrashChild(t *testing.T) {
+	file_name := os.Getenv("BOOTS_CRASH_DB")
+	if file_name == "" {
+		t.Skip("only runs as the child of a killed process test")
+	}
+	mode, _ := strconv.Atoi(os.Getenv("BOOTS_CRASH_MODE"))
+	storage, err := InitializeStorage(file_name, JournalMode(mode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	btree := InitializeBtree(InitializePager(storage))
+	btree.pager.SetCacheSize(16)
+
+	payload := strings.Repeat("whiskers", 40)
+	for batch := 0; ; batch++ {
+		// Each batch is one transaction, so a crash keeps all of it or none
+		transaction, err := btree.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < crashBatchSize; i++ {
+			if err := transaction.Insert(uint32(batch*crashBatchSize+i), []any{payload}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := transaction.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Println("committed", batch)
+	}
+}
+
+func TestWALSurvivesKilledProcess(t *testing.T) {
+	kill_child_mid_commit(t, JournalModeWAL)
+}
+
+// kill_child_mid_commit kills TestCrashChild part way through a batch and
+// checks that reopening keeps exactly the batches it committed
+func kill_child_mid_commit(t *testing.T, mode JournalMode) {
+	if testing.Short() {
+		t.Skip("spawns a child process")
+	}
+	file_name := filepath.Join(t.TempDir(), "Boots.db")
+
+	child := exec.Command(os.Args[0], "-test.run=^TestCrashChild$")
+	child.Env = append(os.Environ(), "BOOTS_CRASH_DB="+file_name, fmt.Sprintf("BOOTS_CRASH_MODE=%d", int(mode)))
+	stdout, err := child.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Kill the child somewhere in the middle of its fifth batch or so
+	lines := bufio.NewScanner(stdout)
+	commits := 0
+	for commits < 5 && lines.Scan() {
+		if strings.HasPrefix(lines.Text(), "committed") {
+			commits += 1
+		}
+	}
+	child.Process.Kill()
+	child.Wait()
+	if commits < 5 {
+		t.Fatalf("Child stopped after %d commits", commits)
+	}
+
+	btree := open_test_btree_in_mode(t, file_name, mode)
+	n := count_records(t, btree)
+	if n%crashBatchSize != 0 || n < commits*crashBatchSize {
+		t.Errorf("Expected whole committed batches, got %d records after %d commits", n, commits)
+	}
+}